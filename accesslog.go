@@ -0,0 +1,111 @@
+package keylightexporter
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// An accessLog writes structured access log entries, one JSON object per
+// request.
+type accessLog struct {
+	mu sync.Mutex
+	e  *json.Encoder
+}
+
+// newAccessLog creates an accessLog which writes to w.
+func newAccessLog(w io.Writer) *accessLog {
+	return &accessLog{e: json.NewEncoder(w)}
+}
+
+// An accessEntry is a single access log entry.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Target     string    `json:"target,omitempty"`
+	Status     int       `json:"status"`
+	Duration   float64   `json:"duration_seconds"`
+}
+
+// wrap returns an http.Handler which logs each request served by h.
+func (l *accessLog) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		h.ServeHTTP(sw, r)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// Errors are ignored because there is nowhere useful to report them.
+		_ = l.e.Encode(accessEntry{
+			Time:       start.UTC(),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Target:     r.URL.Query().Get("target"),
+			Status:     sw.Status(),
+			Duration:   time.Since(start).Seconds(),
+		})
+	})
+}
+
+// logRequests returns an http.Handler which logs the outcome of each request
+// served by h to ll at debug level.
+func logRequests(ll *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		h.ServeHTTP(sw, r)
+
+		ll.Debug("served request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"target", r.URL.Query().Get("target"),
+			"status", sw.Status(),
+			"elapsed", time.Since(start),
+		)
+	})
+}
+
+var _ http.ResponseWriter = &statusWriter{}
+
+// A statusWriter is an http.ResponseWriter which records the HTTP status code
+// of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Status returns the HTTP status code of the response.
+func (w *statusWriter) Status() int {
+	if w.code == 0 {
+		// Nothing was written, which implies HTTP 200.
+		return http.StatusOK
+	}
+
+	return w.code
+}
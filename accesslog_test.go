@@ -0,0 +1,87 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerAccessLog(t *testing.T) {
+	// Entries are written after each response is sent, so wait for each
+	// write to complete.
+	lines := make(chan []byte, 2)
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithAccessLog(chanWriter(lines)))
+
+	_ = testBody(t, testGet(t, srv, "foo"))
+
+	res := testGet(t, srv, "")
+	_ = res.Body.Close()
+
+	var buf bytes.Buffer
+	for i := 0; i < cap(lines); i++ {
+		select {
+		case b := <-lines:
+			_, _ = buf.Write(b)
+		case <-time.After(1 * time.Second):
+			t.Fatal("timed out waiting for access log entry")
+		}
+	}
+
+	type entry struct {
+		Time       string  `json:"time"`
+		RemoteAddr string  `json:"remote_addr"`
+		Method     string  `json:"method"`
+		Path       string  `json:"path"`
+		Target     string  `json:"target"`
+		Status     int     `json:"status"`
+		Duration   float64 `json:"duration_seconds"`
+	}
+
+	var entries []entry
+	d := json.NewDecoder(&buf)
+	for d.More() {
+		var e entry
+		if err := d.Decode(&e); err != nil {
+			t.Fatalf("failed to decode access log entry: %v", err)
+		}
+
+		if e.Time == "" || e.RemoteAddr == "" || e.Duration <= 0 {
+			t.Fatalf("access log entry is missing fields: %+v", e)
+		}
+
+		// Clear non-deterministic fields.
+		e.Time, e.RemoteAddr, e.Duration = "", "", 0
+		entries = append(entries, e)
+	}
+
+	want := []entry{
+		{
+			Method: http.MethodGet,
+			Path:   "/",
+			Target: "foo",
+			Status: http.StatusOK,
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "/",
+			Status: http.StatusBadRequest,
+		},
+	}
+
+	if diff := cmp.Diff(want, entries); diff != "" {
+		t.Fatalf("unexpected access log entries (-want +got):\n%s", diff)
+	}
+}
+
+// A chanWriter is an io.Writer which sends a copy of each write to a channel.
+type chanWriter chan<- []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
@@ -0,0 +1,86 @@
+package keylightexporter
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// A targetAllowlist restricts the devices which may be scraped by the handler,
+// so that an exposed exporter cannot be used to probe arbitrary hosts.
+type targetAllowlist struct {
+	hosts    map[string]struct{}
+	prefixes []netip.Prefix
+}
+
+// newTargetAllowlist creates a targetAllowlist from entries, each of which may
+// be a hostname, an IP address, or a CIDR range.
+func newTargetAllowlist(entries []string) *targetAllowlist {
+	a := &targetAllowlist{hosts: make(map[string]struct{})}
+	for _, e := range entries {
+		if p, err := netip.ParsePrefix(e); err == nil {
+			a.prefixes = append(a.prefixes, p.Masked())
+			continue
+		}
+		if ip, err := netip.ParseAddr(e); err == nil {
+			ip = ip.Unmap()
+			a.prefixes = append(a.prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+
+		a.hosts[strings.ToLower(e)] = struct{}{}
+	}
+
+	return a
+}
+
+// allowed reports whether the device at addr, as normalized by buildAddr, may
+// be scraped. Hosts which are not explicitly permitted by name are resolved,
+// and every resolved address must fall within a permitted range.
+func (a *targetAllowlist) allowed(ctx context.Context, addr string) bool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if _, ok := a.hosts[host]; ok {
+		return true
+	}
+
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		if ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return false
+		}
+	}
+
+	if len(ips) == 0 {
+		return false
+	}
+
+	for _, ip := range ips {
+		// Zoned addresses never match a prefix, so match them by their
+		// address alone.
+		if !a.contains(ip.Unmap().WithZone("")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// contains reports whether ip falls within a permitted range.
+func (a *targetAllowlist) contains(ip netip.Addr) bool {
+	for _, p := range a.prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package keylightexporter_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerAllowedTargets(t *testing.T) {
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithAllowedTargets([]string{
+		"192.168.1.0/24",
+		"2001:db8::1",
+		"keylight.example.com",
+	}))
+
+	tests := []struct {
+		name, target string
+		code         int
+	}{
+		{
+			name:   "IPv4 in range",
+			target: "192.168.1.10",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "IPv4 with port in range",
+			target: "http://192.168.1.10:9123",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "IPv6 address",
+			target: "[2001:db8::1]:9123",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "IPv6 address with zone",
+			target: "fe80::1%eth0",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "allowed IPv6 address with zone",
+			target: "[2001:db8::1%eth0]",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "hostname",
+			target: "keylight.example.com",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "IPv4 loopback",
+			target: "127.0.0.1",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "loopback hostname",
+			target: "localhost",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "IPv6 loopback",
+			target: "http://[::1]",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "IPv4 link-local",
+			target: "169.254.169.254",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "IPv6 link-local",
+			target: "http://[fe80::1]",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "IPv4 out of range",
+			target: "192.168.2.10",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "IPv4-mapped IPv6 out of range",
+			target: "http://[::ffff:10.0.0.1]",
+			code:   http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := testGet(t, srv, tt.target)
+			_ = res.Body.Close()
+
+			if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
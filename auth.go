@@ -0,0 +1,57 @@
+package keylightexporter
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A basicAuth verifies HTTP basic authentication credentials against a
+// configured user and bcrypt password hash.
+type basicAuth struct {
+	user string
+	hash []byte
+}
+
+// newBasicAuth creates a basicAuth which permits user with a password
+// matching the bcrypt hash passwordHash.
+func newBasicAuth(user, passwordHash string) *basicAuth {
+	return &basicAuth{
+		user: user,
+		hash: []byte(passwordHash),
+	}
+}
+
+// BasicAuth wraps h so that it requires HTTP basic authentication, permitting
+// only user with a password matching the bcrypt hash passwordHash, as
+// WithBasicAuth does for the handler created by NewHandler. This allows other
+// handlers served alongside the exporter, such as profiling endpoints, to be
+// protected by the same credentials.
+func BasicAuth(user, passwordHash string, h http.Handler) http.Handler {
+	a := newBasicAuth(user, passwordHash)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.authorize(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorize reports whether r contains valid credentials. If it does not,
+// authorize replies to the request with HTTP 401.
+func (a *basicAuth) authorize(w http.ResponseWriter, r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if ok {
+		// Always compare the password so that the response time does not
+		// reveal whether the user is valid.
+		validUser := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+		validPass := bcrypt.CompareHashAndPassword(a.hash, []byte(pass)) == nil
+		if validUser && validPass {
+			return true
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="keylight_exporter", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,105 @@
+package keylightexporter_test
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHandlerBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+
+	var fetches atomic.Int32
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			fetches.Add(1)
+			return testData(), nil
+		},
+	}, keylightexporter.WithBasicAuth("prometheus", string(hash)))
+
+	tests := []struct {
+		name       string
+		user, pass string
+		noAuth     bool
+		code       int
+	}{
+		{
+			name:   "no credentials",
+			noAuth: true,
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name: "bad user",
+			user: "root",
+			pass: "secret",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "bad password",
+			user: "prometheus",
+			pass: "hunter2",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "OK",
+			user: "prometheus",
+			pass: "secret",
+			code: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetches.Store(0)
+
+			// Omit the target parameter so that unauthenticated requests
+			// fail before the target is validated.
+			target := "foo"
+			if tt.code != http.StatusOK {
+				target = ""
+			}
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"?target="+target, nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+			if !tt.noAuth {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			_ = res.Body.Close()
+
+			if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+
+			var (
+				wantAuth    string
+				wantFetches int32 = 1
+			)
+			if tt.code == http.StatusUnauthorized {
+				wantAuth = `Basic realm="keylight_exporter", charset="UTF-8"`
+				wantFetches = 0
+			}
+
+			if diff := cmp.Diff(wantAuth, res.Header.Get("WWW-Authenticate")); diff != "" {
+				t.Fatalf("unexpected WWW-Authenticate header (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(wantFetches, fetches.Load()); diff != "" {
+				t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
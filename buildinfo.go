@@ -0,0 +1,64 @@
+package keylightexporter
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version information which may be set at build time using the linker:
+//
+//	go build -ldflags "-X github.com/mdlayher/keylight_exporter.version=v1.0.0 -X github.com/mdlayher/keylight_exporter.commit=abc123"
+//
+// If unset, the values are determined from the build information embedded by
+// the Go toolchain where possible.
+var (
+	version string
+	commit  string
+)
+
+// userAgent is the User-Agent sent with all requests to devices, so that
+// exporter traffic can be identified in device and network logs.
+var userAgent = "keylight_exporter/" + readBuildInfo().version
+
+// A buildInfo describes the build of the exporter.
+type buildInfo struct {
+	version, commit, goversion string
+}
+
+// readBuildInfo returns the build information for the exporter.
+func readBuildInfo() buildInfo {
+	bi := buildInfo{
+		version:   version,
+		commit:    commit,
+		goversion: runtime.Version(),
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if bi.version == "" && info.Main.Version != "" {
+			bi.version = info.Main.Version
+		}
+
+		for _, s := range info.Settings {
+			if bi.commit == "" && s.Key == "vcs.revision" {
+				bi.commit = s.Value
+			}
+		}
+	}
+
+	if bi.version == "" {
+		bi.version = "unknown"
+	}
+	if bi.commit == "" {
+		bi.commit = "unknown"
+	}
+
+	return bi
+}
+
+// Version returns a human-readable description of the exporter's version,
+// commit, and Go version.
+func Version() string {
+	bi := readBuildInfo()
+	return fmt.Sprintf("keylight_exporter %s (commit: %s, go: %s)", bi.version, bi.commit, bi.goversion)
+}
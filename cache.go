@@ -0,0 +1,210 @@
+package keylightexporter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Fetcher = &CachingFetcher{}
+
+// A CachingFetcher is a Fetcher which caches the Data fetched from each device
+// by another Fetcher for a fixed duration, so that multiple scrapes of a device
+// within that duration only contact the device once.
+type CachingFetcher struct {
+	f            Fetcher
+	fresh, stale time.Duration
+
+	// fallback is the maximum age of cached data which is served when a fetch
+	// fails, if positive.
+	fallback time.Duration
+
+	// now is the clock used to determine the age of cached data.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// A cacheEntry stores the cached Data for a single device.
+type cacheEntry struct {
+	// fetch serializes fetches of the device so that concurrent scrapes of
+	// an expired entry only fetch from the device once.
+	fetch sync.Mutex
+
+	// Guarded by CachingFetcher.mu.
+	d          *Data
+	cached     time.Time
+	refs       int
+	refreshing bool
+}
+
+// NewCachingFetcher creates a CachingFetcher which caches the Data returned by
+// f for each device address for ttl. Errors are not cached.
+func NewCachingFetcher(f Fetcher, ttl time.Duration) *CachingFetcher {
+	return NewStaleCachingFetcher(f, ttl, ttl)
+}
+
+// NewStaleCachingFetcher creates a CachingFetcher which caches the Data
+// returned by f for each device address with stale-while-revalidate semantics.
+// Data younger than fresh is returned directly. Data younger than stale is
+// returned immediately while a single background fetch refreshes it. Older
+// data is discarded and fetched from the device again. If stale is less than
+// fresh, fresh is used. Errors are not cached.
+//
+// A background fetch is bounded by the deadline of the Fetch call which
+// triggered it, but is not canceled when that call returns.
+func NewStaleCachingFetcher(f Fetcher, fresh, stale time.Duration) *CachingFetcher {
+	if stale < fresh {
+		stale = fresh
+	}
+
+	return &CachingFetcher{
+		f:       f,
+		fresh:   fresh,
+		stale:   stale,
+		now:     time.Now,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// Fetch implements Fetcher. The returned Data may be shared with other callers
+// and must not be modified.
+func (c *CachingFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	e := c.acquire(addr)
+	defer c.release(e)
+
+	c.mu.Lock()
+	d, age := e.d, c.now().Sub(e.cached)
+	switch {
+	case d != nil && age < c.fresh:
+		c.mu.Unlock()
+		return d, nil
+	case d != nil && age < c.stale:
+		if !e.refreshing {
+			// The background fetch holds its own reference so the entry is
+			// not evicted while it runs.
+			e.refreshing = true
+			e.refs++
+			go c.refresh(ctx, addr, e)
+		}
+
+		c.mu.Unlock()
+		return d, nil
+	}
+	c.mu.Unlock()
+
+	e.fetch.Lock()
+	defer e.fetch.Unlock()
+
+	// Another caller may have fetched the device while this one waited.
+	c.mu.Lock()
+	d, ok := e.d, e.d != nil && c.now().Sub(e.cached) < c.fresh
+	c.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	return c.fetch(ctx, addr, e)
+}
+
+// refresh fetches the device at addr in the background to refresh e, and
+// releases the reference to e held on its behalf.
+func (c *CachingFetcher) refresh(ctx context.Context, addr string, e *cacheEntry) {
+	defer c.release(e)
+
+	rctx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(rctx, time.Until(deadline))
+		defer cancel()
+	}
+
+	e.fetch.Lock()
+	defer e.fetch.Unlock()
+
+	// Stale data continues to be served if the refresh fails, until it
+	// expires.
+	_, _ = c.fetch(rctx, addr, e)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refreshing = false
+}
+
+// fetch fetches the device at addr and caches the result in e. The caller must
+// hold e.fetch.
+func (c *CachingFetcher) fetch(ctx context.Context, addr string, e *cacheEntry) (*Data, error) {
+	d, err := c.f.Fetch(ctx, addr)
+	if err != nil {
+		return c.fallbackData(e, err)
+	}
+	if d.LightsErr != nil {
+		// Do not cache partial data, so the next fetch retries the lights.
+		return d, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Copy the Data so that the time at which it was cached can be reported
+	// without modifying the Data returned by the underlying Fetcher.
+	now := c.now()
+	cd := *d
+	cd.CachedAt = now
+
+	e.d, e.cached = &cd, now
+	return &cd, nil
+}
+
+// fallbackData returns a copy of the cached Data in e with StaleErr set to err
+// if a stale fallback is configured and the Data is young enough, or err
+// otherwise.
+func (c *CachingFetcher) fallbackData(e *cacheEntry, err error) (*Data, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fallback <= 0 || e.d == nil || c.now().Sub(e.cached) >= c.fallback {
+		return nil, err
+	}
+
+	d := *e.d
+	d.StaleErr = err
+	return &d, nil
+}
+
+// retention returns the duration for which cached data is retained.
+func (c *CachingFetcher) retention() time.Duration {
+	return max(c.stale, c.fallback)
+}
+
+// acquire returns the cacheEntry for addr, creating it if necessary, and
+// evicts any other expired entries which are not in use.
+func (c *CachingFetcher) acquire(addr string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, e := range c.entries {
+		if k != addr && e.refs == 0 && now.Sub(e.cached) >= c.retention() {
+			delete(c.entries, k)
+		}
+	}
+
+	e, ok := c.entries[addr]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[addr] = e
+	}
+
+	e.refs++
+	return e
+}
+
+// release indicates that the caller of acquire is done with e.
+func (c *CachingFetcher) release(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.refs--
+}
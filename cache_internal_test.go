@@ -0,0 +1,187 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+)
+
+func TestStaleCachingFetcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		now     = time.Unix(0, 0)
+		fetches int
+
+		// Each fetch of the device signals started and then waits for a
+		// token from proceed, so the test controls when fetches complete.
+		started = make(chan struct{}, 4)
+		proceed = make(chan struct{}, 4)
+	)
+
+	c := NewStaleCachingFetcher(discoverFetcher(func(_ context.Context, _ string) (*Data, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+
+		started <- struct{}{}
+		<-proceed
+
+		return &Data{Device: &keylight.Device{SerialNumber: "1111"}}, nil
+	}), 10*time.Second, 1*time.Minute)
+
+	c.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	fetch := func(cached time.Duration) {
+		t.Helper()
+
+		d, err := c.Fetch(context.Background(), "foo")
+		if err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+
+		if diff := cmp.Diff(time.Unix(0, 0).Add(cached), d.CachedAt); diff != "" {
+			t.Fatalf("unexpected cache time (-want +got):\n%s", diff)
+		}
+	}
+
+	count := func(want int) {
+		t.Helper()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if diff := cmp.Diff(want, fetches); diff != "" {
+			t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+		}
+	}
+
+	// The first fetch blocks until the device is fetched.
+	proceed <- struct{}{}
+	fetch(0)
+	<-started
+	count(1)
+
+	// Fresh data is served directly.
+	advance(5 * time.Second)
+	fetch(0)
+	count(1)
+
+	// Stale data is served immediately while a single background fetch
+	// refreshes it, even when scraped again during the refresh.
+	advance(25 * time.Second)
+	fetch(0)
+	<-started
+	fetch(0)
+	count(2)
+
+	// The refresh holds the entry's fetch lock until its data is stored.
+	c.mu.Lock()
+	e := c.entries["foo"]
+	c.mu.Unlock()
+
+	proceed <- struct{}{}
+	e.fetch.Lock()
+	e.fetch.Unlock()
+
+	fetch(30 * time.Second)
+	count(2)
+
+	// Expired data is discarded and fetched again.
+	advance(2 * time.Minute)
+	proceed <- struct{}{}
+	fetch(150 * time.Second)
+	<-started
+	count(3)
+}
+
+func TestCachingFetcherStaleFallback(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		now  = time.Unix(0, 0)
+		down bool
+	)
+
+	errDown := errors.New("device is down")
+
+	c := NewCachingFetcher(discoverFetcher(func(_ context.Context, _ string) (*Data, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if down {
+			return nil, errDown
+		}
+
+		return &Data{Device: &keylight.Device{SerialNumber: "1111"}}, nil
+	}), 10*time.Second)
+
+	c.fallback = 1 * time.Minute
+	c.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	set := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+
+	// Errors are returned until the device has been fetched successfully.
+	set(func() { down = true })
+	if _, err := c.Fetch(context.Background(), "foo"); !errors.Is(err, errDown) {
+		t.Fatalf("unexpected error: want %v, got %v", errDown, err)
+	}
+
+	set(func() { down = false })
+	if _, err := c.Fetch(context.Background(), "foo"); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+
+	// Once the cached data expires, failures serve the stale data.
+	set(func() {
+		now = now.Add(30 * time.Second)
+		down = true
+	})
+
+	d, err := c.Fetch(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("failed to fetch stale data: %v", err)
+	}
+	if !errors.Is(d.StaleErr, errDown) {
+		t.Fatalf("unexpected stale error: want %v, got %v", errDown, d.StaleErr)
+	}
+	if diff := cmp.Diff(time.Unix(0, 0), d.CachedAt); diff != "" {
+		t.Fatalf("unexpected cache time (-want +got):\n%s", diff)
+	}
+
+	// Fetching another device does not evict the stale data before the
+	// fallback expires.
+	if _, err := c.Fetch(context.Background(), "bar"); !errors.Is(err, errDown) {
+		t.Fatalf("unexpected error: want %v, got %v", errDown, err)
+	}
+	if d, err := c.Fetch(context.Background(), "foo"); err != nil || d.StaleErr == nil {
+		t.Fatalf("expected stale data, but got: %v, %v", d, err)
+	}
+
+	// Data older than the fallback is no longer served.
+	set(func() { now = now.Add(30 * time.Second) })
+	if _, err := c.Fetch(context.Background(), "foo"); !errors.Is(err, errDown) {
+		t.Fatalf("unexpected error: want %v, got %v", errDown, err)
+	}
+}
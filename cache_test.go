@@ -0,0 +1,192 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestCachingFetcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches = make(map[string]int)
+	)
+
+	f := keylightexporter.NewCachingFetcher(testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			fetches[addr]++
+			if addr == "bad" {
+				return nil, errors.New("device unreachable")
+			}
+			if addr == "partial" {
+				d := testData()
+				d.Lights, d.LightsErr = nil, errors.New("lights unavailable")
+				return d, nil
+			}
+
+			// Give concurrent callers a chance to stampede.
+			time.Sleep(10 * time.Millisecond)
+			return testData(), nil
+		},
+	}, 100*time.Millisecond)
+
+	fetch := func(addr string) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = f.Fetch(context.Background(), addr)
+			}()
+		}
+		wg.Wait()
+	}
+
+	// Concurrent fetches of each target only reach the underlying Fetcher
+	// once, except for errors and partial data which are not cached.
+	fetch("foo")
+	fetch("bar")
+	fetch("bad")
+	fetch("partial")
+	fetch("foo")
+
+	check := func(want map[string]int) {
+		t.Helper()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if diff := cmp.Diff(want, fetches); diff != "" {
+			t.Fatalf("unexpected fetches (-want +got):\n%s", diff)
+		}
+	}
+
+	check(map[string]int{"foo": 1, "bar": 1, "bad": 4, "partial": 4})
+
+	// Once the cache expires, the device is fetched again.
+	time.Sleep(150 * time.Millisecond)
+	fetch("foo")
+
+	check(map[string]int{"foo": 2, "bar": 1, "bad": 4, "partial": 4})
+}
+
+func TestHandlerCache(t *testing.T) {
+	var fetches atomic.Int32
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			fetches.Add(1)
+			return testData(), nil
+		},
+	}, keylightexporter.WithCache(1*time.Minute))
+
+	for i := 0; i < 3; i++ {
+		_ = testBody(t, testGet(t, srv, "foo"))
+	}
+
+	if diff := cmp.Diff(int32(1), fetches.Load()); diff != "" {
+		t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerCacheEquivalentTargets(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches = make(map[string]int)
+	)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			fetches[addr]++
+			return testData(), nil
+		},
+	}, keylightexporter.WithCache(1*time.Minute))
+
+	// Each spelling of the same device shares a single cache entry.
+	for _, target := range []string{"foo", "foo:9123", "http://foo:9123", "http://FOO:9123/"} {
+		b := testBody(t, testGet(t, srv, target))
+		if up := upMetric(true, "http://foo:9123"); !bytes.Contains(b, []byte(up)) {
+			t.Fatalf("up metric was not found for %q: %s", target, up)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff(map[string]int{"http://foo:9123": 1}, fetches); diff != "" {
+		t.Fatalf("unexpected fetches (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerCacheAge(t *testing.T) {
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithStaleCache(1*time.Minute, 2*time.Minute))
+
+	// The age of the cached data is reported with each scrape.
+	for i := 0; i < 2; i++ {
+		b := testBody(t, testGet(t, srv, "foo"))
+
+		const age = `keylight_cache_age_seconds{serial="1111"} `
+		if !bytes.Contains(b, []byte(age)) {
+			t.Fatalf("cache age metric was not found: %s", age)
+		}
+	}
+}
+
+func TestHandlerStaleFallback(t *testing.T) {
+	var down atomic.Bool
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			if down.Load() {
+				return nil, errors.New("device unreachable")
+			}
+
+			return testData(), nil
+		},
+	},
+		// Fetch the device on every scrape, but fall back to the last
+		// successful fetch.
+		keylightexporter.WithCache(time.Nanosecond),
+		keylightexporter.WithStaleFallback(1*time.Minute),
+	)
+
+	const light = `keylight_light_on{light="light0",name="test",serial="1111"} 1`
+
+	b := testBody(t, testGet(t, srv, "foo"))
+	for _, s := range []string{
+		upMetric(true, "http://foo:9123"),
+		`keylight_data_stale{serial="1111"} 0`,
+		light,
+	} {
+		if !bytes.Contains(b, []byte(s+"\n")) {
+			t.Fatalf("series was not found: %s", s)
+		}
+	}
+
+	// Once the device fails, the cached data is served, but the device is
+	// reported as down.
+	down.Store(true)
+	b = testBody(t, testGet(t, srv, "foo"))
+	for _, s := range []string{
+		`keylight_up{serial="1111",target="http://foo:9123"} 0`,
+		`keylight_data_stale{serial="1111"} 1`,
+		`keylight_scrape_consecutive_failures{target="http://foo:9123"} 1`,
+		`keylight_scrape_errors_total{reason="other"} 1`,
+		light,
+	} {
+		if !bytes.Contains(b, []byte(s+"\n")) {
+			t.Fatalf("series was not found: %s", s)
+		}
+	}
+}
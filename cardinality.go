@@ -0,0 +1,74 @@
+package keylightexporter
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/mdlayher/metricslite"
+)
+
+// A cardinalityTracker tracks the number of distinct series emitted by the
+// handler, and reports a warning whenever series are emitted beyond a
+// configured limit. Only the first limit series are retained, so that the
+// memory used by the tracker is bounded even when the limit is exceeded.
+type cardinalityTracker struct {
+	limit    int
+	warnings metricslite.Counter
+
+	mu   sync.Mutex
+	seen map[uint64]struct{}
+}
+
+// newCardinalityTracker creates a cardinalityTracker which reports warnings
+// using the counter warnings once more than limit distinct series are seen.
+func newCardinalityTracker(limit int, warnings metricslite.Counter) *cardinalityTracker {
+	return &cardinalityTracker{
+		limit:    limit,
+		warnings: warnings,
+		seen:     make(map[uint64]struct{}),
+	}
+}
+
+// observe records the series identified by keys, reporting whether any of them
+// are beyond the limit, and the number of distinct series seen including those
+// beyond the limit. Series beyond the limit are not retained, so they are
+// counted again by each call which observes them.
+func (c *cardinalityTracker) observe(keys []uint64) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var beyond int
+	for _, k := range keys {
+		if _, ok := c.seen[k]; ok {
+			continue
+		}
+		if len(c.seen) < c.limit {
+			c.seen[k] = struct{}{}
+			continue
+		}
+
+		beyond++
+	}
+
+	n := len(c.seen) + beyond
+	if beyond == 0 {
+		return n, false
+	}
+
+	c.warnings(1)
+	return n, true
+}
+
+// seriesKey returns a hash which identifies the series with the metric name and
+// label values.
+func seriesKey(name string, labels []string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	for _, l := range labels {
+		// Separate each value with a byte that cannot appear in valid UTF-8.
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(l))
+	}
+
+	return h.Sum64()
+}
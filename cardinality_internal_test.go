@@ -0,0 +1,40 @@
+package keylightexporter
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCardinalityTrackerBounded(t *testing.T) {
+	var warnings int
+	c := newCardinalityTracker(2, func(_ float64, _ ...string) { warnings++ })
+
+	observe := func(want int, over bool, keys ...uint64) {
+		t.Helper()
+
+		n, ok := c.observe(keys)
+		if diff := cmp.Diff(want, n); diff != "" {
+			t.Fatalf("unexpected number of series (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(over, ok); diff != "" {
+			t.Fatalf("unexpected limit result (-want +got):\n%s", diff)
+		}
+	}
+
+	observe(2, false, 1, 2)
+	observe(2, false, 1, 2)
+
+	// Series beyond the limit are reported on each observation, but are not
+	// retained.
+	observe(4, true, 1, 3, 4)
+	observe(3, true, 3)
+	observe(2, false, 2)
+
+	if diff := cmp.Diff(2, len(c.seen)); diff != "" {
+		t.Fatalf("unexpected number of retained series (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(2, warnings); diff != "" {
+		t.Fatalf("unexpected number of warnings (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,138 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var _ Fetcher = &circuitFetcher{}
+
+const (
+	// defaultCircuitFailures is the default number of consecutive failures
+	// which open the circuit breaker for a device.
+	defaultCircuitFailures = 3
+
+	// defaultCircuitCooldown is the default duration for which an open
+	// circuit breaker skips fetches from a device.
+	defaultCircuitCooldown = 30 * time.Second
+)
+
+// errCircuitOpen is returned by a circuitFetcher when a fetch is skipped
+// because the device has failed repeatedly.
+var errCircuitOpen = errors.New("circuit breaker is open for repeatedly failing device")
+
+// A circuitFetcher is a Fetcher which stops fetching data from devices which
+// fail repeatedly, so that an unreachable device does not consume the timeout
+// of every scrape.
+//
+// Each device starts with its circuit closed. Once failures consecutive
+// fetches fail, the circuit opens and fetches fail immediately with
+// errCircuitOpen for cooldown. The next fetch then probes the device while any
+// concurrent fetches continue to fail immediately: if the probe succeeds the
+// circuit closes, and otherwise it opens for another cooldown.
+type circuitFetcher struct {
+	f        Fetcher
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	devices map[string]*circuit
+}
+
+// A circuit is the circuit breaker state for a single device.
+type circuit struct {
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// newCircuitFetcher creates a circuitFetcher which opens the circuit for a
+// device after failures consecutive failures, for cooldown. If either value is
+// not positive, a default of 3 failures or 30 seconds is used, respectively.
+func newCircuitFetcher(f Fetcher, failures int, cooldown time.Duration) *circuitFetcher {
+	if failures <= 0 {
+		failures = defaultCircuitFailures
+	}
+	if cooldown <= 0 {
+		cooldown = defaultCircuitCooldown
+	}
+
+	return &circuitFetcher{
+		f:        f,
+		failures: failures,
+		cooldown: cooldown,
+		now:      time.Now,
+		devices:  make(map[string]*circuit),
+	}
+}
+
+// Fetch implements Fetcher.
+func (f *circuitFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	if !f.allow(addr) {
+		return nil, errCircuitOpen
+	}
+
+	d, err := f.f.Fetch(ctx, addr)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		// Close the circuit, forgetting any previous failures.
+		delete(f.devices, addr)
+		return d, nil
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, which says nothing about the device.
+		if c, ok := f.devices[addr]; ok {
+			c.probing = false
+		}
+		return nil, err
+	}
+
+	c, ok := f.devices[addr]
+	if !ok {
+		c = &circuit{}
+		f.devices[addr] = c
+	}
+
+	c.failures++
+	if c.probing || c.failures >= f.failures {
+		c.opened, c.probing = f.now(), false
+	}
+
+	return nil, err
+}
+
+// allow reports whether data may be fetched from the device at addr, marking
+// the fetch as the probe of a circuit whose cooldown has elapsed.
+func (f *circuitFetcher) allow(addr string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.devices[addr]
+	if !ok || c.opened.IsZero() {
+		return true
+	}
+
+	if c.probing || f.now().Sub(c.opened) < f.cooldown {
+		return false
+	}
+
+	c.probing = true
+	return true
+}
+
+// open reports whether the circuit for the device at addr is open, including
+// while its probe is in progress.
+func (f *circuitFetcher) open(addr string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.devices[addr]
+	return ok && !c.opened.IsZero()
+}
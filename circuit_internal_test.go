@@ -0,0 +1,137 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+)
+
+func TestCircuitFetcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		now     = time.Unix(0, 0)
+		fetches int
+		fail    = true
+
+		// When set, each fetch of the device signals started and then waits
+		// for a token from proceed, so the test controls when fetches
+		// complete.
+		block   bool
+		started = make(chan struct{}, 1)
+		proceed = make(chan struct{}, 1)
+	)
+
+	errDown := errors.New("device is down")
+
+	c := newCircuitFetcher(discoverFetcher(func(_ context.Context, _ string) (*Data, error) {
+		mu.Lock()
+		fetches++
+		b, f := block, fail
+		mu.Unlock()
+
+		if b {
+			started <- struct{}{}
+			<-proceed
+		}
+
+		if f {
+			return nil, errDown
+		}
+
+		return &Data{Device: &keylight.Device{SerialNumber: "1111"}}, nil
+	}), 2, 1*time.Minute)
+
+	c.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	set := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+
+	fetch := func(want error) {
+		t.Helper()
+
+		_, err := c.Fetch(context.Background(), "foo")
+		if !errors.Is(err, want) {
+			t.Fatalf("unexpected error: want %v, got %v", want, err)
+		}
+	}
+
+	check := func(wantFetches int, wantOpen bool) {
+		t.Helper()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if diff := cmp.Diff(wantFetches, fetches); diff != "" {
+			t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantOpen, c.open("foo")); diff != "" {
+			t.Fatalf("unexpected circuit state (-want +got):\n%s", diff)
+		}
+	}
+
+	// The circuit stays closed until the failure threshold is reached.
+	fetch(errDown)
+	check(1, false)
+	fetch(errDown)
+	check(2, true)
+
+	// While open, fetches fail immediately without reaching the device.
+	fetch(errCircuitOpen)
+	set(func() { now = now.Add(30 * time.Second) })
+	fetch(errCircuitOpen)
+	check(2, true)
+
+	// After the cooldown, a single failed probe opens the circuit again.
+	set(func() { now = now.Add(30 * time.Second) })
+	fetch(errDown)
+	check(3, true)
+	fetch(errCircuitOpen)
+	check(3, true)
+
+	// Fetches made while the probe is in progress fail immediately, and the
+	// successful probe closes the circuit.
+	set(func() {
+		now = now.Add(1 * time.Minute)
+		block, fail = true, false
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Fetch(context.Background(), "foo")
+		done <- err
+	}()
+
+	<-started
+	fetch(errCircuitOpen)
+	check(4, true)
+
+	proceed <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatalf("failed to probe: %v", err)
+	}
+	check(4, false)
+
+	// Once closed, failures are counted from zero again.
+	set(func() { block, fail = false, true })
+	fetch(errDown)
+	check(5, false)
+	fetch(errDown)
+	check(6, true)
+
+	// Other devices are unaffected.
+	if c.open("bar") {
+		t.Fatal("circuit for another device is open")
+	}
+}
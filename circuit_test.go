@@ -0,0 +1,56 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerCircuitBreaker(t *testing.T) {
+	var fetches atomic.Int32
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if addr == "http://bar:9123" {
+				return testData(), nil
+			}
+
+			fetches.Add(1)
+			return nil, errors.New("device is down")
+		},
+	}, keylightexporter.WithCircuitBreaker(2, time.Hour))
+
+	for _, want := range []string{"0", "1", "1"} {
+		b := testBody(t, testGet(t, srv, "foo"))
+
+		for _, m := range []string{
+			upMetric(false, "http://foo:9123"),
+			`keylight_circuit_open{target="http://foo:9123"} ` + want,
+		} {
+			if !bytes.Contains(b, []byte(m+"\n")) {
+				t.Fatalf("metric was not found: %s", m)
+			}
+		}
+	}
+
+	// The third scrape did not reach the device.
+	if diff := cmp.Diff(int32(2), fetches.Load()); diff != "" {
+		t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+	}
+
+	b := testBody(t, testGet(t, srv, "bar"))
+	for _, m := range []string{
+		upMetric(true, "http://bar:9123"),
+		`keylight_circuit_open{target="http://bar:9123"} 0`,
+		`keylight_scrape_errors_total{reason="circuit_open"} 1`,
+	} {
+		if !bytes.Contains(b, []byte(m+"\n")) {
+			t.Fatalf("metric was not found: %s", m)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package keylightexporter
+
+import "time"
+
+// A clock reports the current time. The handler shares a single clock with
+// each of its time-dependent components, such as the cache, circuit breaker,
+// and poller, so that tests may replace it to control time deterministically.
+type clock interface {
+	Now() time.Time
+}
+
+// A systemClock is a clock which reports the system time.
+type systemClock struct{}
+
+// Now implements clock.
+func (systemClock) Now() time.Time { return time.Now() }
+
+// withClock configures the handler to use c as the source of the current time.
+// It is unexported as it is only intended for tests.
+func withClock(c clock) Option {
+	return func(cfg *config) {
+		cfg.clock = c
+	}
+}
+
+// now returns the function used to determine the current time.
+func (cfg *config) now() func() time.Time {
+	if cfg.clock == nil {
+		return time.Now
+	}
+
+	return cfg.clock.Now
+}
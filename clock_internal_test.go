@@ -0,0 +1,102 @@
+package keylightexporter
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerClock(t *testing.T) {
+	c := newFakeClock(time.Unix(1000, 0))
+
+	var (
+		mu      sync.Mutex
+		fetches int
+	)
+
+	h := NewHandler(prometheus.NewPedanticRegistry(),
+		discoverFetcher(func(_ context.Context, _ string) (*Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetches++
+
+			return &Data{
+				Device: &keylight.Device{SerialNumber: "1111"},
+				Lights: []*keylight.Light{{On: true}},
+			}, nil
+		}),
+		withClock(c),
+		WithCache(1*time.Minute),
+	)
+
+	scrape := func(want int, success, age string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?target=foo", nil))
+
+		b, err := io.ReadAll(w.Result().Body)
+		if err != nil {
+			t.Fatalf("failed to read HTTP body: %v", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if diff := cmp.Diff(want, fetches); diff != "" {
+			t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+		}
+
+		// The cache, its age, and the last success time are all driven by
+		// the clock.
+		for _, series := range []string{
+			`keylight_last_success_timestamp_seconds{serial="1111"} ` + success + "\n",
+			`keylight_cache_age_seconds{serial="1111"} ` + age + "\n",
+		} {
+			if !strings.Contains(string(b), series) {
+				t.Fatalf("series was not found: %s", series)
+			}
+		}
+	}
+
+	scrape(1, "1000", "0")
+
+	// Cached data is served until the TTL elapses, without sleeping.
+	c.Add(30 * time.Second)
+	scrape(1, "1000", "30")
+
+	c.Add(30 * time.Second)
+	scrape(2, "1060", "0")
+}
+
+// A fakeClock is a clock which only advances when Add is called.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newFakeClock creates a fakeClock which reports now.
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+// Now implements clock.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Add advances the clock by d.
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
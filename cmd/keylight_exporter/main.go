@@ -3,22 +3,304 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	keylightexporter "github.com/mdlayher/keylight_exporter"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/model"
 )
 
 func main() {
 	var (
-		metricsAddr = flag.String("metrics.addr", ":9288", "address for Elgato Key Light exporter")
+		metricsAddr = flag.String("metrics.addr", ":9288", "address for Elgato Key Light exporter, or unix:///path/to/socket for a Unix domain socket")
 		metricsPath = flag.String("metrics.path", "/metrics", "URL path for surfacing collected metrics")
+
+		scrapeTimeout = flag.Duration("scrape.timeout", 0, "maximum duration of each device scrape, capped by the Prometheus scrape timeout (default 5s if neither is set)")
+
+		defaultPort = flag.Int("default.port", 9123, "port used to communicate with Key Light devices whose target does not specify a port")
+
+		scrapeConcurrency    = flag.Int("scrape.target-concurrency", 0, "maximum number of devices fetched concurrently when a scrape specifies multiple comma-separated targets (default 8)")
+		scrapeMaxTargets     = flag.Int("scrape.max-targets", 0, "maximum number of comma-separated targets which may be specified by a single scrape (default 100)")
+		scrapeMaxConcurrency = flag.Int("scrape.max-concurrency", 0, "optional maximum number of devices fetched concurrently across all scrapes")
+
+		deviceConnectProxy  = flag.String("device.connect-proxy", "", "optional address of an HTTP CONNECT proxy used to reach Key Light devices")
+		deviceProxy         = flag.String("device.proxy", "", "optional http:// or socks5:// URL of a proxy used to reach Key Light devices")
+		deviceTLSServerName = flag.String("device.tls.server-name", "", "optional server name used to verify the TLS certificates of HTTPS Key Light devices")
+		deviceTLSSkipVerify = flag.Bool("device.tls.insecure-skip-verify", false, "skip verification of the TLS certificates of HTTPS Key Light devices, such as self-signed certificates")
+		deviceTLSCAFile     = flag.String("device.tls.ca-file", "", "optional PEM file of certificate authorities used to verify the TLS certificates of HTTPS Key Light devices")
+		deviceAllowed       = flag.String("device.allowed-targets", "", "optional comma-separated hostnames, IP addresses, or CIDR ranges of the only Key Light devices which may be scraped")
+		deviceCacheTTL      = flag.Duration("device.cache-ttl", 0, "optional duration for which data fetched from each Key Light device is cached and reused by subsequent scrapes")
+		deviceCacheStale    = flag.Duration("device.cache-stale", 0, "optional duration for which cached data older than -device.cache-ttl is still served while it is refreshed in the background")
+		deviceCacheFallback = flag.Duration("device.cache-stale-fallback", 0, "optional maximum age of cached data which is served when a Key Light device cannot be fetched, reporting the device as down, requires -device.cache-ttl")
+		deviceDNSCacheTTL   = flag.Duration("device.dns-cache-ttl", 30*time.Second, "duration for which the resolved addresses of Key Light device hostnames are cached, or 0 to resolve them for every connection")
+		deviceConnTimeout   = flag.Duration("device.connect-timeout", 2*time.Second, "maximum duration of each TCP connection attempt to a Key Light device, which should be shorter than the scrape timeout")
+		deviceMaxBodySize   = flag.Int64("device.max-body-size", 256<<10, "maximum size in bytes of each HTTP response body read from a Key Light device")
+		deviceIdleTimeout   = flag.Duration("device.idle-conn-timeout", 0, "optional duration after which idle HTTP connections to Key Light devices are closed, which should be shorter than the devices' own idle timeout (default 5s)")
+		deviceMaxIdleConns  = flag.Int("device.max-idle-conns-per-host", 0, "optional maximum number of idle HTTP connections retained for each Key Light device (default 2)")
+		deviceNoKeepAlives  = flag.Bool("device.disable-keep-alives", false, "use a new HTTP connection for each request to a Key Light device rather than reusing connections")
+		deviceBasePath      = flag.String("device.base-path", "", "optional path prefix under which the Key Light API is served, such as by a reverse proxy in front of the devices")
+		deviceScheme        = flag.String("device.scheme", "", "optional URL scheme, http or https, used for every Key Light device regardless of its target")
+		deviceMinInterval   = flag.Duration("device.min-request-interval", 0, "optional minimum interval between consecutive HTTP requests to the same Key Light device, for devices which misbehave under rapid requests")
+		deviceRetries       = flag.Int("device.retry-attempts", 0, "optional maximum number of attempts to fetch data from a Key Light device when transient errors occur")
+		deviceRetryBackoff  = flag.Duration("device.retry-backoff", 100*time.Millisecond, "initial backoff between attempts to fetch data from a Key Light device, doubled on each retry")
+		deviceCircuitFails  = flag.Int("device.circuit-breaker-failures", 0, "optional number of consecutive failures after which a Key Light device is reported as down without being fetched for -device.circuit-breaker-cooldown")
+		deviceCircuitCool   = flag.Duration("device.circuit-breaker-cooldown", 30*time.Second, "duration for which a repeatedly failing Key Light device is not fetched before it is probed again")
+		deviceNegativeTTL   = flag.Duration("device.negative-cache-ttl", 0, "optional duration for which a failure to fetch a Key Light device is cached, so that scrapes of an unreachable device fail immediately")
+		devicePoll          = flag.Duration("device.poll-interval", 0, "optional interval on which Key Light devices are fetched in the background, so that scrapes serve the most recent data immediately")
+		deviceSingleFlight  = flag.Bool("device.single-flight", true, "coalesce concurrent scrapes of the same Key Light device into a single fetch")
+		deviceWiFiSignal    = flag.Bool("device.wifi-signal", false, "report the WiFi signal strength of Key Light devices, if reported in their accessory information")
+		deviceTempLimits    = flag.Bool("device.temperature-limits", false, "report the color temperature limits of Key Light devices if reported by their light settings, using an additional request on each scrape")
+		deviceMaxWatts      = flag.Float64("device.estimated-max-watts", 0, "optional power draw in watts of a light at full brightness, used to export an estimate of the power draw of each light")
+		deviceConcurrent    = flag.Bool("device.concurrent-fetch", false, "fetch Key Light device information and light state concurrently")
+
+		webTLSCert = flag.String("web.tls.cert", "", "optional TLS certificate file used to serve the exporter over HTTPS, requires -web.tls.key")
+		webTLSKey  = flag.String("web.tls.key", "", "optional TLS private key file used to serve the exporter over HTTPS, requires -web.tls.cert")
+
+		webBasicAuthUser = flag.String("web.basic-auth.user", "", "optional user required to access the exporter using HTTP basic authentication, requires -web.basic-auth.password-hash")
+		webBasicAuthHash = flag.String("web.basic-auth.password-hash", "", "bcrypt hash of the password required to access the exporter using HTTP basic authentication")
+
+		webExternalLabels = flag.String("web.external-labels", "", "optional comma-separated key=value labels attached to all exported series")
+
+		metricsNamespace = flag.String("metrics.namespace", "keylight", "prefix of all exported metric names")
+		cardinalityLimit = flag.Int("metrics.cardinality-limit", 0, "optional number of distinct device series beyond which new series produce high cardinality warnings")
+
+		configFile = flag.String("config.file", "", "optional YAML file which maps friendly target names to Key Light device addresses and labels, reloaded on SIGHUP")
+
+		logLevel      = flag.String("log.level", "info", "minimum level of scrape logs: debug, info, warn, or error")
+		logAccessFile = flag.String("log.access-file", "", "optional file for JSON access logs, reopened on SIGHUP for rotation (\"-\" for stderr)")
+
+		discover     = flag.Bool("discover", false, "serve a JSON list of Key Light devices discovered on the local network using mDNS at /discover")
+		discoverAuto = flag.Bool("discover.auto", false, "scrape all Key Light devices discovered on the local network using mDNS when a scrape specifies no target")
+		control      = flag.Bool("control", false, "accept POST requests at /control which turn Key Light devices on or off and set their brightness and color temperature")
+
+		fake            = flag.Bool("fake", false, "serve deterministic data for any target without contacting Key Light devices, for demos and testing")
+		fakeLights      = flag.Int("fake.lights", 1, "number of lights reported by each fake device, requires -fake")
+		fakeBrightness  = flag.Int("fake.brightness", 20, "brightness percentage reported by each fake light, requires -fake")
+		fakeTemperature = flag.Int("fake.temperature", 4200, "color temperature in Kelvin reported by each fake light, requires -fake")
+		fakeFailTarget  = flag.String("fake.fail-target", "", "optional target whose fake scrapes always fail, requires -fake")
+
+		snapshotFile = flag.String("snapshot.file", "", "optional JSON device snapshot served for every target without contacting Key Light devices, or a directory of snapshots named after each target's host, such as office-light.json")
+		snapshotDump = flag.String("snapshot.dump", "", "optional target of a Key Light device whose JSON snapshot is printed to stdout for use with -snapshot.file, after which the exporter exits")
+
+		debug      = flag.Bool("debug", false, "enable additional metrics and endpoints for debugging the exporter")
+		debugPprof = flag.Bool("debug.pprof", false, "serve Go runtime profiling data using net/http/pprof at /debug/pprof/")
+
+		printVersion = flag.Bool("version", false, "print the version of the Elgato Key Light exporter and exit")
+
+		shutdownTimeout = flag.Duration("shutdown.timeout", 10*time.Second, "maximum time to wait for in-flight scrapes to complete during shutdown")
 	)
 
+	// Flags may also be set using environment variables, for convenience in
+	// container deployments.
+	bindEnv(flag.CommandLine)
 	flag.Parse()
+	if err := setFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatalf("failed to parse environment: %v", err)
+	}
+
+	if *printVersion {
+		fmt.Println(keylightexporter.Version())
+		return
+	}
+
+	if *snapshotDump != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := keylightexporter.DumpData(ctx, os.Stdout, nil, *snapshotDump); err != nil {
+			log.Fatalf("failed to dump device snapshot: %v", err)
+		}
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("failed to parse log level: %v", err)
+	}
+
+	opts := []keylightexporter.Option{
+		keylightexporter.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: level,
+		}))),
+	}
+	if *defaultPort < 1 || *defaultPort > 65535 {
+		log.Fatalf("invalid default port %d: must be between 1 and 65535", *defaultPort)
+	}
+	opts = append(opts, keylightexporter.WithDefaultPort(*defaultPort))
+	if *scrapeTimeout > 0 {
+		opts = append(opts, keylightexporter.WithTimeout(*scrapeTimeout))
+	}
+	if *scrapeConcurrency > 0 {
+		opts = append(opts, keylightexporter.WithMaxTargetConcurrency(*scrapeConcurrency))
+	}
+	if *scrapeMaxTargets > 0 {
+		opts = append(opts, keylightexporter.WithMaxTargetsPerRequest(*scrapeMaxTargets))
+	}
+	if *scrapeMaxConcurrency > 0 {
+		opts = append(opts, keylightexporter.WithMaxConcurrency(*scrapeMaxConcurrency))
+	}
+	if *deviceConnectProxy != "" && *deviceProxy != "" {
+		log.Fatal("only one of -device.connect-proxy and -device.proxy may be specified")
+	}
+	if *deviceConnectProxy != "" {
+		u, err := parseProxy(*deviceConnectProxy, "http")
+		if err != nil {
+			log.Fatalf("failed to parse CONNECT proxy address: %v", err)
+		}
+
+		opts = append(opts, keylightexporter.WithConnectProxy(u))
+	}
+	if *deviceProxy != "" {
+		u, err := parseProxy(*deviceProxy, "http", "https", "socks5")
+		if err != nil {
+			log.Fatalf("failed to parse proxy URL: %v", err)
+		}
+
+		opts = append(opts, keylightexporter.WithProxy(u))
+	}
+	if *deviceTLSServerName != "" {
+		opts = append(opts, keylightexporter.WithTLSConfig(&tls.Config{
+			ServerName: *deviceTLSServerName,
+		}))
+	}
+	if *deviceTLSSkipVerify {
+		opts = append(opts, keylightexporter.WithInsecureSkipVerify(true))
+	}
+	if *deviceTLSCAFile != "" {
+		pool, err := loadCertPool(*deviceTLSCAFile)
+		if err != nil {
+			log.Fatalf("failed to load device certificate authorities: %v", err)
+		}
+
+		opts = append(opts, keylightexporter.WithRootCAs(pool))
+	}
+	if *deviceAllowed != "" {
+		opts = append(opts, keylightexporter.WithAllowedTargets(strings.Split(*deviceAllowed, ",")))
+	}
+	if *deviceCacheTTL > 0 {
+		opts = append(opts, keylightexporter.WithStaleCache(*deviceCacheTTL, *deviceCacheStale))
+		if *deviceCacheFallback > 0 {
+			opts = append(opts, keylightexporter.WithStaleFallback(*deviceCacheFallback))
+		}
+	}
+	opts = append(opts, keylightexporter.WithConnectTimeout(*deviceConnTimeout))
+	opts = append(opts, keylightexporter.WithMaxBodySize(*deviceMaxBodySize))
+	opts = append(opts, keylightexporter.WithTransportConfig(keylightexporter.TransportConfig{
+		MaxIdleConnsPerHost: *deviceMaxIdleConns,
+		IdleConnTimeout:     *deviceIdleTimeout,
+		DisableKeepAlives:   *deviceNoKeepAlives,
+	}))
+	if *deviceBasePath != "" {
+		opts = append(opts, keylightexporter.WithBasePath(*deviceBasePath))
+	}
+	switch *deviceScheme {
+	case "":
+	case "http", "https":
+		opts = append(opts, keylightexporter.WithForceScheme(*deviceScheme))
+	default:
+		log.Fatalf("invalid -device.scheme %q: must be http or https", *deviceScheme)
+	}
+	if *deviceMinInterval > 0 {
+		opts = append(opts, keylightexporter.WithMinRequestInterval(*deviceMinInterval))
+	}
+	if *deviceDNSCacheTTL > 0 {
+		opts = append(opts, keylightexporter.WithDNSCache(*deviceDNSCacheTTL))
+	}
+	if *deviceCircuitFails > 0 {
+		opts = append(opts, keylightexporter.WithCircuitBreaker(*deviceCircuitFails, *deviceCircuitCool))
+	}
+	if *deviceNegativeTTL > 0 {
+		opts = append(opts, keylightexporter.WithNegativeCache(*deviceNegativeTTL))
+	}
+	if *deviceSingleFlight {
+		opts = append(opts, keylightexporter.WithSingleFlight())
+	}
+	if *deviceRetries > 1 {
+		opts = append(opts, keylightexporter.WithRetry(*deviceRetries, *deviceRetryBackoff))
+	}
+	if *deviceWiFiSignal {
+		opts = append(opts, keylightexporter.WithWiFiSignal())
+	}
+	if *deviceTempLimits {
+		opts = append(opts, keylightexporter.WithTemperatureLimits())
+	}
+	if *deviceMaxWatts > 0 {
+		opts = append(opts, keylightexporter.WithEstimatedPower(*deviceMaxWatts))
+	}
+	if *deviceConcurrent {
+		opts = append(opts, keylightexporter.WithConcurrentFetch())
+	}
+	if *webExternalLabels != "" {
+		labels, err := parseLabels(*webExternalLabels)
+		if err != nil {
+			log.Fatalf("failed to parse external labels: %v", err)
+		}
+
+		opts = append(opts, keylightexporter.WithExternalLabels(labels))
+	}
+	if *webBasicAuthUser != "" || *webBasicAuthHash != "" {
+		if *webBasicAuthUser == "" || *webBasicAuthHash == "" {
+			log.Fatal("both a basic authentication user and password hash must be specified")
+		}
+
+		opts = append(opts, keylightexporter.WithBasicAuth(*webBasicAuthUser, *webBasicAuthHash))
+	}
+	if *discover {
+		opts = append(opts, keylightexporter.WithDiscoverer(keylightexporter.NewDiscoverer()))
+	}
+	if *discoverAuto {
+		opts = append(opts, keylightexporter.WithAutoDiscover(true))
+	}
+	if *control {
+		opts = append(opts, keylightexporter.WithControl(true))
+	}
+	if *debug {
+		opts = append(opts, keylightexporter.WithDebug())
+	}
+	if *metricsNamespace != "" {
+		opts = append(opts, keylightexporter.WithNamespace(*metricsNamespace))
+	}
+	if *cardinalityLimit > 0 {
+		opts = append(opts, keylightexporter.WithCardinalityLimit(*cardinalityLimit))
+	}
+	if *configFile != "" {
+		nt, err := namedTargets(*configFile)
+		if err != nil {
+			log.Fatalf("failed to load config file: %v", err)
+		}
+
+		opts = append(opts, keylightexporter.WithNamedTargets(nt))
+	}
+	if *logAccessFile != "" {
+		w, err := accessLogWriter(*logAccessFile)
+		if err != nil {
+			log.Fatalf("failed to open access log: %v", err)
+		}
+
+		opts = append(opts, keylightexporter.WithAccessLog(w))
+	}
 
 	reg := prometheus.NewPedanticRegistry()
 	reg.MustRegister(
@@ -26,15 +308,545 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
+	if *fake && *snapshotFile != "" {
+		log.Fatal("only one of -fake and -snapshot.file may be specified")
+	}
+
+	var f keylightexporter.Fetcher
+	if *snapshotFile != "" {
+		f = &keylightexporter.FileFetcher{Path: *snapshotFile}
+	}
+	if *fake {
+		f = &keylightexporter.FakeFetcher{
+			Lights:      *fakeLights,
+			Brightness:  *fakeBrightness,
+			Temperature: *fakeTemperature,
+			FailTarget:  *fakeFailTarget,
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *devicePoll > 0 {
+		// Polling stops once shutdown begins.
+		opts = append(opts, keylightexporter.WithBackgroundPoll(ctx, *devicePoll))
+	}
+
+	h := keylightexporter.NewHandler(reg, f, opts...)
+
 	mux := http.NewServeMux()
-	mux.Handle(*metricsPath, keylightexporter.NewHandler(reg, nil))
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, *metricsPath, http.StatusMovedPermanently)
-	})
+	mux.Handle(*metricsPath, h)
+	mux.Handle("/probe/", h)
+	mux.Handle("/inventory", h)
+	mux.Handle("/validate", h)
+	mux.Handle("/healthz", healthHandler(ctx))
+	if *debug {
+		mux.Handle("/debug/raw", h)
+	}
+	if *discover {
+		mux.Handle("/discover", h)
+	}
+	if *control {
+		mux.Handle("/control", h)
+	}
+	if *configFile != "" || *discover || *discoverAuto {
+		// Serve the known targets for Prometheus HTTP service discovery.
+		mux.Handle("/targets", h)
+	}
+	if *debugPprof {
+		// The profiles reveal the command line and runtime state, so they
+		// require the same credentials as the exporter.
+		handlePprof(mux, *webBasicAuthUser, *webBasicAuthHash)
+	}
+	mux.Handle("/", landingHandler(*metricsPath))
 
-	log.Printf("starting Elgato Key Light exporter on %q", *metricsAddr)
+	var expiry prometheus.Gauge
+	if *webTLSCert != "" {
+		ns := *metricsNamespace
+		if ns == "" {
+			ns = "keylight"
+		}
+
+		expiry = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: "exporter",
+			Name:      "tls_cert_expiry_timestamp_seconds",
+			Help:      "The UNIX time in seconds at which the TLS certificate served by the exporter expires.",
+		})
+		reg.MustRegister(expiry)
+	}
 
-	if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+	tlsCfg, err := serverTLSConfig(*webTLSCert, *webTLSKey, expiry)
+	if err != nil {
+		log.Fatalf("failed to configure TLS: %v", err)
+	}
+
+	ln, err := listen(*metricsAddr)
+	if err != nil {
 		log.Fatalf("cannot start Elgato Key Light exporter: %v", err)
 	}
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+
+	log.Printf("starting Elgato Key Light exporter on %q", ln.Addr())
+
+	if err := serve(ctx, &http.Server{Handler: mux}, ln, *shutdownTimeout); err != nil {
+		log.Fatalf("failed to serve Elgato Key Light exporter: %v", err)
+	}
+}
+
+// landingPage is the HTML template for the exporter's landing page.
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Elgato Key Light exporter</title>
+</head>
+<body>
+<h1>Elgato Key Light exporter</h1>
+<p>{{.Version}}</p>
+<form action="{{.Path}}" method="get">
+<label for="target">Target:</label>
+<input type="text" id="target" name="target" placeholder="keylight:9123" value="{{.Target}}">
+<input type="submit" value="Scrape">
+</form>
+<p><a href="{{.Path}}">Metrics</a> require a target parameter which specifies the Key Light device to scrape.</p>
+</body>
+</html>
+`))
+
+// landingHandler returns an http.Handler which serves an HTML landing page at
+// "/" for GET and HEAD requests, including a form which scrapes a target using
+// the metrics handler at path.
+func landingHandler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		// html/template escapes the user-controlled target value.
+		err := landingPage.Execute(w, struct {
+			Version, Path, Target string
+		}{
+			Version: keylightexporter.Version(),
+			Path:    path,
+			Target:  r.URL.Query().Get("target"),
+		})
+		if err != nil {
+			log.Printf("failed to render landing page: %v", err)
+		}
+	})
+}
+
+// handlePprof registers the net/http/pprof handlers on mux under
+// "/debug/pprof/", rather than relying on their registration with
+// http.DefaultServeMux. If user is set, the handlers require HTTP basic
+// authentication with user and a password matching the bcrypt hash
+// passwordHash.
+func handlePprof(mux *http.ServeMux, user, passwordHash string) {
+	for path, fn := range map[string]http.HandlerFunc{
+		"/debug/pprof/":        pprof.Index,
+		"/debug/pprof/cmdline": pprof.Cmdline,
+		"/debug/pprof/profile": pprof.Profile,
+		"/debug/pprof/symbol":  pprof.Symbol,
+		"/debug/pprof/trace":   pprof.Trace,
+	} {
+		var h http.Handler = fn
+		if user != "" {
+			h = keylightexporter.BasicAuth(user, passwordHash, h)
+		}
+
+		mux.Handle(path, h)
+	}
+}
+
+// healthHandler returns an http.Handler which reports that the exporter is
+// healthy without contacting any devices, until ctx is canceled to begin a
+// graceful shutdown. Only GET and HEAD requests are permitted.
+func healthHandler(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if ctx.Err() != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, "shutting down\n")
+			return
+		}
+
+		_, _ = io.WriteString(w, "ok\n")
+	})
+}
+
+// serverTLSConfig returns a *tls.Config which serves the certificate and key
+// stored in the files at cert and key, and reloads them on SIGHUP. If expiry is
+// not nil, it is set to the expiry time of the certificate on each load. If a
+// reload fails, the previous certificate continues to be served. If neither
+// file is set, serverTLSConfig returns nil and the exporter is served over
+// plain HTTP.
+func serverTLSConfig(cert, key string, expiry prometheus.Gauge) (*tls.Config, error) {
+	switch {
+	case cert == "" && key == "":
+		return nil, nil
+	case cert == "" || key == "":
+		return nil, errors.New("both a TLS certificate and key must be specified")
+	}
+
+	sc := &serverCert{cert: cert, key: key, expiry: expiry}
+	if err := sc.load(); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := sc.load(); err != nil {
+				log.Printf("failed to reload TLS certificate: %v", err)
+				continue
+			}
+
+			log.Printf("reloaded TLS certificate %q", cert)
+		}
+	}()
+
+	return &tls.Config{
+		GetCertificate: func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return sc.c.Load(), nil
+		},
+	}, nil
+}
+
+// A serverCert is a TLS certificate served by the exporter, which may be
+// reloaded from its files.
+type serverCert struct {
+	cert, key string
+	expiry    prometheus.Gauge
+
+	c atomic.Pointer[tls.Certificate]
+}
+
+// load loads the certificate and key from their files and reports the expiry
+// of the certificate.
+func (sc *serverCert) load() error {
+	c, err := tls.LoadX509KeyPair(sc.cert, sc.key)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	// The leaf is parsed by LoadX509KeyPair as of Go 1.23, but not before.
+	if c.Leaf == nil {
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %v", err)
+		}
+		c.Leaf = leaf
+	}
+
+	sc.c.Store(&c)
+	if sc.expiry != nil {
+		sc.expiry.Set(float64(c.Leaf.NotAfter.Unix()))
+	}
+
+	return nil
+}
+
+// loadCertPool loads a pool of certificate authorities from the PEM file at
+// path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates found in %q", path)
+	}
+
+	return pool, nil
+}
+
+// serve serves HTTP requests for srv on ln until ctx is canceled. On
+// cancelation, serve waits up to timeout for in-flight requests to complete
+// before forcibly closing any remaining connections and canceling the contexts
+// of their requests.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	// All requests derive their context from base so that any in-flight device
+	// scrapes can be aborted if the server cannot shut down gracefully.
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.BaseContext = func(_ net.Listener) context.Context { return base }
+
+	errC := make(chan error, 1)
+	go func() { errC <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errC:
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), timeout)
+	defer scancel()
+
+	if err := srv.Shutdown(sctx); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+
+		log.Printf("timed out waiting for in-flight requests after %s, forcing shutdown", timeout)
+
+		cancel()
+		if err := srv.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := <-errC; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// listen creates a net.Listener for addr, which is either a TCP address or a
+// Unix domain socket path with a "unix://" prefix. Any stale socket left at
+// the path by a previous process is removed first, and the socket is removed
+// again once the listener is closed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("refusing to replace non-socket file %q", path)
+		}
+
+		// Only remove the socket if no process is listening on it.
+		if c, err := net.Dial("unix", path); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("socket %q is already in use", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	// Listeners created by net.Listen remove their socket file when closed,
+	// which occurs on graceful shutdown.
+	return net.Listen("unix", path)
+}
+
+// accessLogWriter returns an io.Writer for the access log at path. If path is
+// "-", stderr is used. Otherwise, the file is reopened on SIGHUP so that it can
+// be rotated by an external tool.
+func accessLogWriter(path string) (io.Writer, error) {
+	if path == "-" {
+		return os.Stderr, nil
+	}
+
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := f.Reopen(); err != nil {
+				log.Printf("failed to reopen access log: %v", err)
+			}
+		}
+	}()
+
+	return f, nil
+}
+
+// namedTargets loads the named targets configured by the YAML file at path,
+// and reloads them on SIGHUP. If a reload fails, the previous configuration
+// continues to be used.
+func namedTargets(path string) (*keylightexporter.NamedTargets, error) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := loadNamedTargets(nt, path); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := loadNamedTargets(nt, path); err != nil {
+				log.Printf("failed to reload config file: %v", err)
+				continue
+			}
+
+			log.Printf("reloaded config file %q", path)
+		}
+	}()
+
+	return nt, nil
+}
+
+// loadNamedTargets loads the named targets configured by the YAML file at path
+// into nt.
+func loadNamedTargets(nt *keylightexporter.NamedTargets, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return nt.Load(f)
+}
+
+// A reopenFile is an io.Writer for an append-only file which may be reopened,
+// such as after the file is rotated.
+type reopenFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openFile opens the file at path for appending.
+func openFile(path string) (*reopenFile, error) {
+	f := &reopenFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write implements io.Writer.
+func (f *reopenFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.Write(b)
+}
+
+// Reopen closes and reopens the file.
+func (f *reopenFile) Reopen() error {
+	nf, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f != nil {
+		_ = f.f.Close()
+	}
+	f.f = nf
+
+	return nil
+}
+
+// envPrefix is the prefix of the environment variables which set flags.
+const envPrefix = "KEYLIGHT_"
+
+// envName returns the name of the environment variable which sets the flag
+// name, such as KEYLIGHT_METRICS_ADDR for metrics.addr.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// bindEnv documents the environment variable which sets each flag in fs in
+// the flag's usage text. It must be called before fs is parsed.
+func bindEnv(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage += fmt.Sprintf(" (or $%s; the flag takes precedence)", envName(f.Name))
+	})
+}
+
+// setFromEnv sets each flag in fs which was not set on the command line from
+// its environment variable, if present, using lookup. It must be called after
+// fs is parsed.
+func setFromEnv(fs *flag.FlagSet, lookup func(key string) (string, bool)) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+
+		key := envName(f.Name)
+		v, ok := lookup(key)
+		if !ok {
+			return
+		}
+
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, key, serr)
+		}
+	})
+
+	return err
+}
+
+// parseLabels parses a comma-separated list of key=value Prometheus labels.
+func parseLabels(s string) (prometheus.Labels, error) {
+	labels := make(prometheus.Labels)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed label %q: must be key=value", kv)
+		}
+
+		k = strings.TrimSpace(k)
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		if _, ok := labels[k]; ok {
+			return nil, fmt.Errorf("duplicate label name %q", k)
+		}
+
+		labels[k] = v
+	}
+
+	return labels, nil
+}
+
+// parseProxy parses a proxy address which may be either host:port, treated as
+// an HTTP URL, or a URL with one of the specified schemes.
+func parseProxy(s string, schemes ...string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(schemes, u.Scheme) || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %q", u.Redacted())
+	}
+
+	return u, nil
 }
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLandingHandler(t *testing.T) {
+	tests := []struct {
+		name, method, path, allow string
+		code                      int
+		contains                  []string
+	}{
+		{
+			name:   "GET",
+			method: http.MethodGet,
+			path:   "/",
+			code:   http.StatusOK,
+			contains: []string{
+				"<title>Elgato Key Light exporter</title>",
+				`<form action="/metrics" method="get">`,
+				`<a href="/metrics">`,
+			},
+		},
+		{
+			name:   "HEAD",
+			method: http.MethodHead,
+			path:   "/",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "escaped target",
+			method: http.MethodGet,
+			path:   "/?target=" + url.QueryEscape(`"><script>alert(1)</script>`),
+			code:   http.StatusOK,
+			contains: []string{
+				`value="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;"`,
+			},
+		},
+		{
+			name:   "not found",
+			method: http.MethodGet,
+			path:   "/foo",
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "POST",
+			method: http.MethodPost,
+			path:   "/",
+			allow:  "GET, HEAD",
+			code:   http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			landingHandler("/metrics").ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if diff := cmp.Diff(tt.code, w.Code); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.allow, w.Header().Get("Allow")); diff != "" {
+				t.Fatalf("unexpected Allow header (-want +got):\n%s", diff)
+			}
+
+			body := w.Body.String()
+			for _, c := range tt.contains {
+				if !strings.Contains(body, c) {
+					t.Errorf("body does not contain %q:\n%s", c, body)
+				}
+			}
+			if strings.Contains(body, "<script>") {
+				t.Fatalf("body contains unescaped script:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestHandlePprof(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("metrics"))
+	}))
+	handlePprof(mux, "", "")
+	mux.Handle("/", landingHandler("/metrics"))
+
+	tests := []struct {
+		name, path string
+		code       int
+		contains   string
+	}{
+		{
+			name:     "index",
+			path:     "/debug/pprof/",
+			code:     http.StatusOK,
+			contains: "goroutine",
+		},
+		{
+			name:     "profile",
+			path:     "/debug/pprof/heap?debug=1",
+			code:     http.StatusOK,
+			contains: "heap profile",
+		},
+		{
+			name:     "metrics",
+			path:     "/metrics",
+			code:     http.StatusOK,
+			contains: "metrics",
+		},
+		{
+			name:     "landing",
+			path:     "/",
+			code:     http.StatusOK,
+			contains: "<title>Elgato Key Light exporter</title>",
+		},
+		{
+			name: "not found",
+			path: "/debug",
+			code: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if diff := cmp.Diff(tt.code, w.Code); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+
+			if body := w.Body.String(); !strings.Contains(body, tt.contains) {
+				t.Fatalf("body does not contain %q:\n%s", tt.contains, body)
+			}
+		})
+	}
+}
+
+func TestHandlePprofBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	handlePprof(mux, "prometheus", string(hash))
+
+	tests := []struct {
+		name, path string
+		user, pass string
+		code       int
+	}{
+		{
+			name: "unauthenticated",
+			path: "/debug/pprof/",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "unauthenticated cmdline",
+			path: "/debug/pprof/cmdline",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong password",
+			path: "/debug/pprof/",
+			user: "prometheus",
+			pass: "guess",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "authenticated",
+			path: "/debug/pprof/",
+			user: "prometheus",
+			pass: "secret",
+			code: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if diff := cmp.Diff(tt.code, w.Code); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := healthHandler(ctx)
+
+	check := func(method string, code int, allow, body string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/healthz", nil))
+
+		if diff := cmp.Diff(code, w.Code); diff != "" {
+			t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(allow, w.Header().Get("Allow")); diff != "" {
+			t.Fatalf("unexpected Allow header (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(body, w.Body.String()); diff != "" {
+			t.Fatalf("unexpected body (-want +got):\n%s", diff)
+		}
+	}
+
+	check(http.MethodGet, http.StatusOK, "", "ok\n")
+	check(http.MethodPost, http.StatusMethodNotAllowed, "GET, HEAD", "method not allowed\n")
+
+	// Report unhealthy once shutdown begins.
+	cancel()
+	check(http.MethodGet, http.StatusServiceUnavailable, "", "shutting down\n")
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	var (
+		started = make(chan struct{})
+		aborted = make(chan struct{})
+	)
+
+	// Emulate a scrape of an unresponsive device which only completes once its
+	// request context is canceled.
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-r.Context().Done()
+			close(aborted)
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const timeout = 100 * time.Millisecond
+
+	errC := make(chan error, 1)
+	go func() { errC <- serve(ctx, srv, ln, timeout) }()
+
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+		if err == nil {
+			_ = res.Body.Close()
+		}
+	}()
+
+	<-started
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Fatalf("failed to serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for forced shutdown")
+	}
+
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("server shut down after %s, before drain timeout of %s", elapsed, timeout)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request was not aborted")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	// Unix socket paths are limited in length, so avoid a long t.TempDir path.
+	dir, err := os.MkdirTemp("", "keylight")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "keylight.sock")
+
+	// Leave a stale socket behind, as if a previous process had crashed.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	// A second exporter must not remove the socket which is in use.
+	if _, err := listen("unix://" + path); err == nil {
+		t.Fatal("expected an error listening on a socket in use, but none occurred")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("keylight_up 1\n"))
+	})}
+
+	errC := make(chan error, 1)
+	go func() { errC <- serve(ctx, srv, ln, time.Second) }()
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+
+	res, err := c.Get("http://keylight/metrics")
+	if err != nil {
+		t.Fatalf("failed to perform HTTP request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if diff := cmp.Diff(http.StatusOK, res.StatusCode); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+
+	cancel()
+	if err := <-errC; err != nil {
+		t.Fatalf("failed to serve: %v", err)
+	}
+
+	// The socket is removed on graceful shutdown.
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket was not removed on shutdown: %v", err)
+	}
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keylight.sock")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	if _, err := listen("unix://" + path); err == nil {
+		t.Fatal("expected an error replacing a regular file, but none occurred")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("regular file was removed: %v", err)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	cert, key := testKeyPair(t)
+
+	tests := []struct {
+		name      string
+		cert, key string
+		ok, tls   bool
+	}{
+		{
+			name: "plain HTTP",
+			ok:   true,
+		},
+		{
+			name: "no key",
+			cert: cert,
+		},
+		{
+			name: "no certificate",
+			key:  key,
+		},
+		{
+			name: "missing files",
+			cert: filepath.Join(t.TempDir(), "cert.pem"),
+			key:  filepath.Join(t.TempDir(), "key.pem"),
+		},
+		{
+			name: "OK",
+			cert: cert,
+			key:  key,
+			ok:   true,
+			tls:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := serverTLSConfig(tt.cert, tt.key, nil)
+			if tt.ok && err != nil {
+				t.Fatalf("failed to configure TLS: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+
+			if diff := cmp.Diff(tt.tls, cfg != nil); diff != "" {
+				t.Fatalf("unexpected TLS configuration (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServerTLSConfigExpiry(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	// Certificates only encode their validity to the second.
+	first := time.Now().Add(1 * time.Hour).Truncate(time.Second)
+	writeKeyPair(t, cert, key, first)
+
+	expiry := prometheus.NewGauge(prometheus.GaugeOpts{Name: "expiry"})
+	cfg, err := serverTLSConfig(cert, key, expiry)
+	if err != nil {
+		t.Fatalf("failed to configure TLS: %v", err)
+	}
+
+	check := func(want time.Time) {
+		t.Helper()
+
+		if diff := cmp.Diff(float64(want.Unix()), gaugeValue(t, expiry)); diff != "" {
+			t.Fatalf("unexpected certificate expiry (-want +got):\n%s", diff)
+		}
+
+		c, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("failed to get certificate: %v", err)
+		}
+
+		if diff := cmp.Diff(want.Unix(), c.Leaf.NotAfter.Unix()); diff != "" {
+			t.Fatalf("unexpected served certificate expiry (-want +got):\n%s", diff)
+		}
+	}
+
+	check(first)
+
+	// The certificate and its expiry are reloaded on SIGHUP.
+	second := first.Add(24 * time.Hour)
+	writeKeyPair(t, cert, key, second)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("failed to send SIGHUP: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gaugeValue(t, expiry) != float64(second.Unix()) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for certificate to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	check(second)
+}
+
+func TestLoadCertPool(t *testing.T) {
+	cert, key := testKeyPair(t)
+
+	if _, err := loadCertPool(cert); err != nil {
+		t.Fatalf("failed to load certificate pool: %v", err)
+	}
+
+	// The key file is PEM, but contains no certificates.
+	for _, path := range []string{key, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := loadCertPool(path); err == nil {
+			t.Fatalf("expected an error for %q, but none occurred", path)
+		}
+	}
+}
+
+func TestNamedTargetsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(s string) {
+		t.Helper()
+
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+	}
+
+	if _, err := namedTargets(path); err == nil {
+		t.Fatal("expected an error for a missing config file, but none occurred")
+	}
+
+	write("targets:\n  office:\n    address: foo\n")
+	nt, err := namedTargets(path)
+	if err != nil {
+		t.Fatalf("failed to load config file: %v", err)
+	}
+
+	h := keylightexporter.NewHandler(
+		prometheus.NewPedanticRegistry(),
+		&keylightexporter.FakeFetcher{},
+		keylightexporter.WithNamedTargets(nt),
+	)
+
+	code := func(name string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?target="+name, nil))
+		return w.Code
+	}
+
+	if diff := cmp.Diff(http.StatusOK, code("office")); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+
+	// The config file is reloaded on SIGHUP.
+	write("targets:\n  desk:\n    address: bar\n")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("failed to send SIGHUP: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for code("desk") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for config file to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if diff := cmp.Diff(http.StatusNotFound, code("office")); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+}
+
+// gaugeValue returns the current value of g.
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatalf("failed to write gauge: %v", err)
+	}
+
+	return m.GetGauge().GetValue()
+}
+
+// testKeyPair writes a self-signed certificate and its private key to PEM
+// files and returns their paths.
+func testKeyPair(t *testing.T) (cert, key string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair(t, cert, key, time.Now().Add(1*time.Hour))
+
+	return cert, key
+}
+
+// writeKeyPair writes a self-signed certificate which expires at notAfter and
+// its private key to PEM files at cert and key.
+func writeKeyPair(t *testing.T, cert, key string, notAfter time.Time) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	for _, f := range []struct {
+		path string
+		b    *pem.Block
+	}{
+		{path: cert, b: &pem.Block{Type: "CERTIFICATE", Bytes: der}},
+		{path: key, b: &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}},
+	} {
+		if err := os.WriteFile(f.path, pem.EncodeToMemory(f.b), 0o600); err != nil {
+			t.Fatalf("failed to write PEM file: %v", err)
+		}
+	}
+}
+
+func TestSetFromEnv(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		addr, path string
+		debug      bool
+		ok         bool
+	}{
+		{
+			name: "defaults",
+			addr: ":9288",
+			path: "/metrics",
+			ok:   true,
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"KEYLIGHT_METRICS_ADDR": ":9999",
+				"KEYLIGHT_DEBUG":        "true",
+			},
+			addr:  ":9999",
+			path:  "/metrics",
+			debug: true,
+			ok:    true,
+		},
+		{
+			name: "flag takes precedence",
+			args: []string{"-metrics.addr", ":8888"},
+			env: map[string]string{
+				"KEYLIGHT_METRICS_ADDR": ":9999",
+				"KEYLIGHT_METRICS_PATH": "/probe",
+			},
+			addr: ":8888",
+			path: "/probe",
+			ok:   true,
+		},
+		{
+			name: "invalid environment",
+			env:  map[string]string{"KEYLIGHT_DEBUG": "maybe"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			var (
+				addr  = fs.String("metrics.addr", ":9288", "")
+				path  = fs.String("metrics.path", "/metrics", "")
+				debug = fs.Bool("debug", false, "")
+			)
+
+			bindEnv(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatalf("failed to parse flags: %v", err)
+			}
+
+			err := setFromEnv(fs, func(key string) (string, bool) {
+				v, ok := tt.env[key]
+				return v, ok
+			})
+			if tt.ok && err != nil {
+				t.Fatalf("failed to set flags from environment: %v", err)
+			}
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+
+				return
+			}
+
+			if diff := cmp.Diff([]any{tt.addr, tt.path, tt.debug}, []any{*addr, *path, *debug}); diff != "" {
+				t.Fatalf("unexpected flag values (-want +got):\n%s", diff)
+			}
+
+			if u := fs.Lookup("metrics.addr").Usage; !strings.Contains(u, "$KEYLIGHT_METRICS_ADDR") {
+				t.Fatalf("usage does not document environment variable: %q", u)
+			}
+		})
+	}
+}
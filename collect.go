@@ -0,0 +1,110 @@
+package keylightexporter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mdlayher/metricslite"
+)
+
+// collectParam is the query parameter which selects the collectors gathered by
+// a single scrape, as in the node_exporter.
+const collectParam = "collect[]"
+
+// collectors maps the name of each collector which may be selected using
+// collectParam to the device metrics it gathers. Metrics which describe the
+// scrape itself, such as keylight_up, are always gathered.
+var collectors = map[string][]string{
+	"device": {
+		klInfo, klLights, klDeviceHTTPProtoInfo, klWiFiSignalDBM, klDeviceBootTimeSeconds,
+		klFirmwareBuildNumber,
+	},
+	"on":         {klLightOn},
+	"brightness": {klLightBrightnessPercent, klLightBrightnessRatio},
+	"temperature": {
+		klLightColorTemperatureKelvin, klLightColorTemperatureMireds,
+		klLightTemperatureMinKelvin, klLightTemperatureMaxKelvin,
+	},
+	"power": {klLightPowerWatts},
+	"drift": {klLightDrift},
+}
+
+// requestCollect parses the collectors selected by the query parameters of r,
+// such as "collect[]=on&collect[]=brightness", and returns the set of device
+// metrics which should be excluded from the scrape, or nil if no collectors
+// are selected.
+func requestCollect(r *http.Request) (map[string]struct{}, error) {
+	return excludeCollectors(r.URL.Query()[collectParam])
+}
+
+// excludeCollectors returns the set of device metrics which are excluded when
+// only the collectors in names are selected, or nil if names is empty.
+func excludeCollectors(names []string) (map[string]struct{}, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	selected := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if _, ok := collectors[name]; !ok {
+			return nil, fmt.Errorf("unknown collector %q, must be one of: %s",
+				name, strings.Join(collectorNames(), ", "))
+		}
+
+		selected[name] = struct{}{}
+	}
+
+	exclude := make(map[string]struct{})
+	for name, metrics := range collectors {
+		if _, ok := selected[name]; ok {
+			continue
+		}
+		for _, m := range metrics {
+			exclude[m] = struct{}{}
+		}
+	}
+
+	return exclude, nil
+}
+
+// collectorNames returns the sorted names of all of the collectors.
+func collectorNames() []string {
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+var _ metricslite.Interface = &filteredMetrics{}
+
+// A filteredMetrics is a metricslite.Interface which does not register the
+// const gauges named in exclude, so that they are omitted from each scrape.
+type filteredMetrics struct {
+	metricslite.Interface
+	exclude map[string]struct{}
+}
+
+// filterMetrics wraps mm so that the const gauges named in exclude are not
+// registered. If exclude is nil, mm is returned unmodified.
+func filterMetrics(mm metricslite.Interface, exclude map[string]struct{}) metricslite.Interface {
+	if exclude == nil {
+		return mm
+	}
+
+	return &filteredMetrics{Interface: mm, exclude: exclude}
+}
+
+// ConstGauge implements metricslite.Interface.
+func (m *filteredMetrics) ConstGauge(name, help string, labelNames ...string) {
+	if _, ok := m.exclude[name]; ok {
+		return
+	}
+
+	m.Interface.ConstGauge(name, help, labelNames...)
+}
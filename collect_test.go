@@ -0,0 +1,85 @@
+package keylightexporter_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandlerCollect(t *testing.T) {
+	srv := testServer(t, testDataFetcher())
+
+	tests := []struct {
+		name, query string
+		code        int
+		lines       []string
+	}{
+		{
+			name:  "single",
+			query: "?target=foo&collect[]=on",
+			code:  http.StatusOK,
+			lines: []string{
+				`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+				`keylight_light_on{light="light1",name="test",serial="1111"} 0`,
+				`keylight_up{serial="1111",target="http://foo:9123"} 1`,
+			},
+		},
+		{
+			name:  "multiple",
+			query: "?target=foo&collect[]=on&collect[]=brightness&collect[]=on",
+			code:  http.StatusOK,
+			lines: []string{
+				`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+				`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+				`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+				`keylight_light_on{light="light1",name="test",serial="1111"} 0`,
+				`keylight_up{serial="1111",target="http://foo:9123"} 1`,
+			},
+		},
+		{
+			name:  "device",
+			query: "probe/foo?collect[]=device",
+			code:  http.StatusOK,
+			lines: []string{
+				`keylight_firmware_build_number{serial="1111"} 192`,
+				`keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`,
+				`keylight_lights{serial="1111"} 2`,
+				`keylight_up{serial="1111",target="http://foo:9123"} 1`,
+			},
+		},
+		{
+			name:  "unknown",
+			query: "?target=foo&collect[]=on&collect[]=color",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "empty",
+			query: "?target=foo&collect[]=",
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/" + tt.query)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+
+			if tt.code != http.StatusOK {
+				_ = res.Body.Close()
+				if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+					t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			if diff := cmp.Diff(tt.lines, deviceLines(testBody(t, res))); diff != "" {
+				t.Fatalf("unexpected device series (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
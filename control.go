@@ -0,0 +1,239 @@
+package keylightexporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/keylight"
+)
+
+const (
+	// controlPath is the HTTP path which controls devices when control is
+	// enabled.
+	controlPath = "/control"
+
+	// The ranges of brightness and color temperature accepted by devices.
+	minBrightness  = 3
+	maxBrightness  = 100
+	minTemperature = 2900
+	maxTemperature = 7000
+)
+
+// A controlRequest is a request to change the state of the lights on a
+// device. Nil fields are left unchanged.
+type controlRequest struct {
+	Target      string `json:"target"`
+	Light       string `json:"light"`
+	On          *bool  `json:"on"`
+	Brightness  *int   `json:"brightness"`
+	Temperature *int   `json:"temperature"`
+}
+
+// A controlLight is the state of a single light returned by the control
+// endpoint.
+type controlLight struct {
+	Light       string `json:"light"`
+	On          bool   `json:"on"`
+	Brightness  int    `json:"brightness"`
+	Temperature int    `json:"temperature"`
+}
+
+// A controller changes the state of the lights on devices, using the same
+// clients and transport as the default HTTP fetcher.
+type controller struct {
+	f *httpFetcher
+}
+
+// serveControl applies the control request r using c, and serves the
+// resulting state of the device's lights as JSON.
+func (h *handler) serveControl(w http.ResponseWriter, r *http.Request, c *controller) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, r, "method not allowed", "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := parseControlRequest(r)
+	if err != nil {
+		httpError(w, r, fmt.Sprintf("malformed control request: %v", err), "", http.StatusBadRequest)
+		return
+	}
+
+	// Targets are resolved and authorized exactly as they are for scrapes.
+	addrs, _, ok := h.resolveTargets(w, r, req.Target)
+	if !ok {
+		return
+	}
+	if len(addrs) != 1 {
+		httpError(w, r, "control requests must specify a single target", req.Target, http.StatusBadRequest)
+		return
+	}
+	addr := addrs[0]
+
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r, h.timeout))
+	defer cancel()
+
+	if !h.allowed(ctx, w, r, addrs) {
+		return
+	}
+
+	ls, err := c.control(ctx, addr, req)
+	if err != nil {
+		var lerr *lightError
+		if errors.As(err, &lerr) {
+			httpError(w, r, err.Error(), addr, http.StatusBadRequest)
+			return
+		}
+
+		h.ll.Warn("failed to control device", "target", addr, "err", err)
+		httpError(w, r, "failed to control device", addr, http.StatusBadGateway)
+		return
+	}
+
+	out := make([]controlLight, 0, len(ls))
+	for i, l := range ls {
+		out = append(out, controlLight{
+			Light:       "light" + strconv.Itoa(i),
+			On:          l.On,
+			Brightness:  l.Brightness,
+			Temperature: l.Temperature,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Lights []controlLight `json:"lights"`
+	}{Lights: out})
+}
+
+// control applies req to the lights on the device at addr, and returns the
+// resulting state of the lights.
+func (c *controller) control(ctx context.Context, addr string, req *controlRequest) ([]*keylight.Light, error) {
+	dc, err := c.f.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.f.authenticate(ctx, dc, addr); err != nil {
+		return nil, err
+	}
+
+	kc := dc.c
+
+	ls, err := kc.Lights(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch lights: %w", err)
+	}
+
+	// Apply the request to a single light if specified, or all lights
+	// otherwise.
+	set := ls
+	if req.Light != "" {
+		i, err := strconv.Atoi(strings.TrimPrefix(req.Light, "light"))
+		if err != nil || i < 0 || i >= len(ls) {
+			return nil, &lightError{light: req.Light}
+		}
+
+		set = ls[i : i+1]
+	}
+
+	for _, l := range set {
+		if req.On != nil {
+			l.On = *req.On
+		}
+		if req.Brightness != nil {
+			l.Brightness = *req.Brightness
+		}
+		if req.Temperature != nil {
+			l.Temperature = *req.Temperature
+		}
+	}
+
+	if err := kc.SetLights(ctx, ls); err != nil {
+		return nil, fmt.Errorf("failed to set lights: %w", err)
+	}
+
+	// Report the state of the lights as applied by the device.
+	ls, err = kc.Lights(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch lights: %w", err)
+	}
+
+	return ls, nil
+}
+
+// A lightError is returned when a control request specifies a light which is
+// not present on the device.
+type lightError struct {
+	light string
+}
+
+// Error implements error.
+func (e *lightError) Error() string {
+	return fmt.Sprintf("light %q does not exist", e.light)
+}
+
+// parseControlRequest parses and validates a control request from the JSON
+// body of r if it has a JSON content type, or from its query parameters
+// otherwise.
+func parseControlRequest(r *http.Request) (*controlRequest, error) {
+	var req controlRequest
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		d := json.NewDecoder(io.LimitReader(r.Body, 4096))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&req); err != nil {
+			return nil, fmt.Errorf("failed to decode JSON: %v", err)
+		}
+	} else {
+		q := r.URL.Query()
+		req.Target = q.Get("target")
+		req.Light = q.Get("light")
+
+		if s := q.Get("on"); s != "" {
+			on, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid on value %q", s)
+			}
+			req.On = &on
+		}
+
+		for _, p := range []struct {
+			name string
+			v    **int
+		}{
+			{name: "brightness", v: &req.Brightness},
+			{name: "temperature", v: &req.Temperature},
+		} {
+			s := q.Get(p.name)
+			if s == "" {
+				continue
+			}
+
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value %q", p.name, s)
+			}
+			*p.v = &v
+		}
+	}
+
+	switch {
+	case req.Target == "":
+		return nil, errors.New("missing target")
+	case req.On == nil && req.Brightness == nil && req.Temperature == nil:
+		return nil, errors.New("at least one of on, brightness, or temperature must be set")
+	case req.Brightness != nil && (*req.Brightness < minBrightness || *req.Brightness > maxBrightness):
+		return nil, fmt.Errorf("brightness %d out of range %d-%d", *req.Brightness, minBrightness, maxBrightness)
+	case req.Temperature != nil && (*req.Temperature < minTemperature || *req.Temperature > maxTemperature):
+		return nil, fmt.Errorf("temperature %d out of range %d-%dK", *req.Temperature, minTemperature, maxTemperature)
+	}
+
+	return &req, nil
+}
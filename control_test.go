@@ -0,0 +1,431 @@
+package keylightexporter_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerControl(t *testing.T) {
+	type light struct {
+		Light       string `json:"light"`
+		On          bool   `json:"on"`
+		Brightness  int    `json:"brightness"`
+		Temperature int    `json:"temperature"`
+	}
+
+	// target is replaced by the address of the fake device in each test.
+	const target = "TARGET"
+
+	tests := []struct {
+		name        string
+		query       url.Values
+		body        string
+		code        int
+		lights      []light
+		deviceCalls int
+	}{
+		{
+			name:  "no target",
+			query: url.Values{"on": {"true"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "no changes",
+			query: url.Values{"target": {target}, "light": {"light0"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "bad on",
+			query: url.Values{"target": {target}, "on": {"maybe"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "brightness too low",
+			query: url.Values{"target": {target}, "brightness": {"2"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "brightness too high",
+			query: url.Values{"target": {target}, "brightness": {"101"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "temperature too low",
+			query: url.Values{"target": {target}, "temperature": {"2800"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "temperature too high",
+			query: url.Values{"target": {target}, "temperature": {"7100"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:        "no such light",
+			query:       url.Values{"target": {target}, "light": {"light2"}, "on": {"true"}},
+			code:        http.StatusBadRequest,
+			deviceCalls: 1,
+		},
+		{
+			name: "bad JSON",
+			body: `{"target":`,
+			code: http.StatusBadRequest,
+		},
+		{
+			name:  "OK query single light",
+			query: url.Values{"target": {target}, "light": {"light1"}, "on": {"true"}, "brightness": {"50"}},
+			code:  http.StatusOK,
+			lights: []light{
+				{Light: "light0", On: true, Brightness: 20, Temperature: 4200},
+				{Light: "light1", On: true, Brightness: 50, Temperature: 4200},
+			},
+			deviceCalls: 3,
+		},
+		{
+			name:  "OK query all lights",
+			query: url.Values{"target": {target}, "on": {"false"}},
+			code:  http.StatusOK,
+			lights: []light{
+				{Light: "light0", Brightness: 20, Temperature: 4200},
+				{Light: "light1", Brightness: 10, Temperature: 4200},
+			},
+			deviceCalls: 3,
+		},
+		{
+			name: "OK JSON",
+			body: `{"target":"` + target + `","light":"light0","brightness":100,"temperature":2900}`,
+			code: http.StatusOK,
+			lights: []light{
+				{Light: "light0", On: true, Brightness: 100, Temperature: 2900},
+				{Light: "light1", Brightness: 10, Temperature: 4200},
+			},
+			deviceCalls: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device, calls := testControlDevice(t)
+
+			srv := testServer(t, testDataFetcher(), keylightexporter.WithControl(true))
+
+			var (
+				req *http.Request
+				err error
+			)
+
+			if tt.body != "" {
+				body := strings.ReplaceAll(tt.body, target, device.URL)
+				req, err = http.NewRequest(http.MethodPost, srv.URL+"/control", strings.NewReader(body))
+				if err == nil {
+					req.Header.Set("Content-Type", "application/json")
+				}
+			} else {
+				q := strings.ReplaceAll(tt.query.Encode(), target, url.QueryEscape(device.URL))
+				req, err = http.NewRequest(http.MethodPost, srv.URL+"/control?"+q, nil)
+			}
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.deviceCalls, calls()); diff != "" {
+				t.Fatalf("unexpected number of device requests (-want +got):\n%s", diff)
+			}
+
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+
+			var out struct {
+				Lights []light `json:"lights"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+				t.Fatalf("failed to decode JSON: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.lights, out.Lights); diff != "" {
+				t.Fatalf("unexpected lights (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerControlErrorJSON(t *testing.T) {
+	device, _ := testControlDevice(t)
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithControl(true))
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		code   int
+		target string
+	}{
+		{
+			name:  "malformed request",
+			query: url.Values{"target": {device.URL}, "brightness": {"2"}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:   "unknown light",
+			query:  url.Values{"target": {device.URL}, "light": {"light5"}, "on": {"true"}},
+			code:   http.StatusBadRequest,
+			target: device.URL,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/control?"+tt.query.Encode(), nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+			req.Header.Set("Accept", "application/json")
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("application/json", res.Header.Get("Content-Type")); diff != "" {
+				t.Fatalf("unexpected Content-Type (-want +got):\n%s", diff)
+			}
+
+			var out struct {
+				Error  string `json:"error"`
+				Target string `json:"target"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+				t.Fatalf("failed to decode JSON: %v", err)
+			}
+
+			if out.Error == "" {
+				t.Fatal("error message was empty")
+			}
+			if diff := cmp.Diff(tt.target, out.Target); diff != "" {
+				t.Fatalf("unexpected target (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerControlTargets(t *testing.T) {
+	device, _ := testControlDevice(t)
+
+	// Record the User-Agent of each request made to the device.
+	var (
+		mu     sync.Mutex
+		agents []string
+	)
+
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+
+		device.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(front.Close)
+
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader(`
+targets:
+  office:
+    address: ` + front.URL + `
+  garage:
+    address: 192.0.2.1
+`)); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	srv := testServer(t, testDataFetcher(),
+		keylightexporter.WithControl(true),
+		keylightexporter.WithNamedTargets(nt),
+		keylightexporter.WithAllowedTargets([]string{"127.0.0.1"}),
+	)
+
+	tests := []struct {
+		name, target string
+		code         int
+	}{
+		{
+			name:   "named",
+			target: "office",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "address",
+			target: front.URL,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "not permitted",
+			target: "garage",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "multiple",
+			target: "office,garage",
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{"target": {tt.target}, "on": {"true"}}
+			res, err := http.Post(srv.URL+"/control?"+q.Encode(), "", nil)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			_ = res.Body.Close()
+
+			if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(agents) == 0 {
+		t.Fatal("device was not controlled")
+	}
+	for _, ua := range agents {
+		if !strings.HasPrefix(ua, "keylight_exporter/") {
+			t.Fatalf("unexpected User-Agent: %q", ua)
+		}
+	}
+}
+
+func TestHandlerControlDisabled(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []keylightexporter.Option
+		method string
+		code   int
+		allow  string
+	}{
+		{
+			name:   "disabled",
+			method: http.MethodPost,
+			code:   http.StatusMethodNotAllowed,
+			allow:  "GET, HEAD",
+		},
+		{
+			name:   "explicitly disabled",
+			opts:   []keylightexporter.Option{keylightexporter.WithControl(false)},
+			method: http.MethodPost,
+			code:   http.StatusMethodNotAllowed,
+			allow:  "GET, HEAD",
+		},
+		{
+			name:   "enabled GET",
+			opts:   []keylightexporter.Option{keylightexporter.WithControl(true)},
+			method: http.MethodGet,
+			code:   http.StatusMethodNotAllowed,
+			allow:  "POST",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := keylightexporter.NewHandler(prometheus.NewPedanticRegistry(), testDataFetcher(), tt.opts...)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, "/control?target=foo&on=true", nil))
+
+			if diff := cmp.Diff(tt.code, w.Code); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.allow, w.Header().Get("Allow")); diff != "" {
+				t.Fatalf("unexpected Allow header (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// testControlDevice creates an HTTP server which emulates the Key Light API
+// for a device with two lights whose state may be changed. It returns a
+// function which reports the number of requests made to the lights endpoint.
+func testControlDevice(t *testing.T) (*httptest.Server, func() int) {
+	t.Helper()
+
+	type apiLight struct {
+		On          int `json:"on"`
+		Brightness  int `json:"brightness"`
+		Temperature int `json:"temperature"`
+	}
+
+	var (
+		mu    sync.Mutex
+		calls int
+
+		// Both lights are 4200K in the device's own units.
+		lights = []apiLight{
+			{On: 1, Brightness: 20, Temperature: 280},
+			{On: 0, Brightness: 10, Temperature: 280},
+		}
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/elgato/lights" {
+			http.NotFound(w, r)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+
+		if r.Method == http.MethodPut {
+			var body struct {
+				Lights []apiLight `json:"lights"`
+			}
+			b, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(b, &body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			lights = body.Lights
+		}
+
+		_ = json.NewEncoder(w).Encode(struct {
+			NumberOfLights int        `json:"numberOfLights"`
+			Lights         []apiLight `json:"lights"`
+		}{
+			NumberOfLights: len(lights),
+			Lights:         lights,
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
@@ -0,0 +1,126 @@
+package keylightexporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	// debugRawPath is the HTTP path which serves raw device responses when
+	// debugging is enabled.
+	debugRawPath = "/debug/raw"
+
+	// maxRawBody is the maximum number of bytes retained for each raw device
+	// response.
+	maxRawBody = 64 * 1024
+)
+
+// A rawStore retains the most recent raw HTTP response bodies returned by each
+// device, for debugging.
+type rawStore struct {
+	// port is the default port of targets which do not specify one.
+	port string
+
+	mu     sync.Mutex
+	bodies map[string]map[string][]byte
+}
+
+// newRawStore creates an empty rawStore which serves the raw responses for
+// targets using port by default.
+func newRawStore(port string) *rawStore {
+	return &rawStore{
+		port:   port,
+		bodies: make(map[string]map[string][]byte),
+	}
+}
+
+// store retains the response body b for the request to path on the device at
+// addr.
+func (s *rawStore) store(addr, path string, b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, ok := s.bodies[addr]
+	if !ok {
+		paths = make(map[string][]byte)
+		s.bodies[addr] = paths
+	}
+
+	paths[path] = b
+}
+
+// ServeHTTP implements http.Handler, serving the raw responses for the device
+// specified by the target query parameter.
+func (s *rawStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		httpError(w, r, "missing target parameter", "", http.StatusBadRequest)
+		return
+	}
+
+	addr, err := buildAddr(target, s.port)
+	if err != nil {
+		httpError(
+			w, r,
+			fmt.Sprintf("malformed target parameter: %v", err),
+			target,
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, ok := s.bodies[addr]
+	if !ok {
+		httpError(w, r, fmt.Sprintf("no raw responses for %q", addr), addr, http.StatusNotFound)
+		return
+	}
+
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// The responses may not be well-formed, so they are served verbatim as
+	// plain text.
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "GET %s\n%s\n\n", k, paths[k])
+	}
+}
+
+var _ io.ReadCloser = &captureBody{}
+
+// A captureBody is an io.ReadCloser which retains up to maxRawBody bytes read
+// from an HTTP response body, and passes them to done on Close.
+type captureBody struct {
+	rc   io.ReadCloser
+	buf  bytes.Buffer
+	done func(b []byte)
+}
+
+// Read implements io.Reader.
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if rem := maxRawBody - b.buf.Len(); rem > 0 {
+		if rem > n {
+			rem = n
+		}
+		_, _ = b.buf.Write(p[:rem])
+	}
+
+	return n, err
+}
+
+// Close implements io.Closer.
+func (b *captureBody) Close() error {
+	b.done(b.buf.Bytes())
+	return b.rc.Close()
+}
@@ -0,0 +1,54 @@
+package keylightexporter_test
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerDebugRaw(t *testing.T) {
+	device := testDevice(t, nil)
+	srv := testServer(t, nil, keylightexporter.WithDebug())
+
+	get := func(t *testing.T) (int, string) {
+		t.Helper()
+
+		res, err := http.Get(srv.URL + "/debug/raw?target=" + url.QueryEscape(device.URL))
+		if err != nil {
+			t.Fatalf("failed to perform HTTP request: %v", err)
+		}
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("failed to read HTTP body: %v", err)
+		}
+
+		return res.StatusCode, string(b)
+	}
+
+	// Nothing is retained until the device is scraped.
+	if code, _ := get(t); code != http.StatusNotFound {
+		t.Fatalf("expected HTTP 404 before scrape, but got: %d", code)
+	}
+
+	_ = testBody(t, testGet(t, srv, device.URL))
+
+	code, body := get(t)
+	if diff := cmp.Diff(http.StatusOK, code); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+
+	want := "GET /elgato/accessory-info\n" +
+		`{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}` + "\n\n" +
+		"GET /elgato/lights\n" +
+		`{"numberOfLights":1,"lights":[{"on":1,"brightness":20,"temperature":280}]}` + "\n\n"
+
+	if diff := cmp.Diff(want, body); diff != "" {
+		t.Fatalf("unexpected raw responses (-want +got):\n%s", diff)
+	}
+}
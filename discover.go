@@ -0,0 +1,309 @@
+package keylightexporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// discoverPath is the HTTP path which serves discovered devices when
+	// discovery is enabled.
+	discoverPath = "/discover"
+
+	// elgatoService is the DNS-SD service advertised by Key Light devices.
+	elgatoService = "_elg._tcp.local."
+
+	// defaultDiscoverTimeout is the default duration of each discovery when
+	// the context has no deadline.
+	defaultDiscoverTimeout = 2 * time.Second
+)
+
+// mdnsAddr is the IPv4 mDNS multicast group and port.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// A Discoverer discovers Key Light devices on the local network using
+// multicast DNS.
+type Discoverer struct {
+	// addr is the address queries are sent to, overridden in tests.
+	addr *net.UDPAddr
+}
+
+// NewDiscoverer creates a Discoverer which browses the local network for Key
+// Light devices.
+func NewDiscoverer() *Discoverer {
+	return &Discoverer{addr: mdnsAddr}
+}
+
+// Discover browses the local network for Key Light devices until ctx is
+// canceled or its deadline is exceeded, and returns the addresses of the
+// devices which responded, suitable for use as the "target" query parameter.
+// If ctx has no deadline, a default of 2 seconds is used. If no devices
+// respond, Discover returns an empty slice and no error.
+func (d *Discoverer) Discover(ctx context.Context) ([]string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDiscoverTimeout)
+		defer cancel()
+	}
+
+	q, err := query()
+	if err != nil {
+		return nil, err
+	}
+
+	// Send a one-shot query from an ephemeral port so that devices respond
+	// directly to this socket rather than to the multicast group.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for mDNS responses: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.SetReadDeadline(time.Now())
+	}()
+
+	if _, err := conn.WriteToUDP(q, d.addr); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+
+	rs := newResponses()
+	b := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Discovery is complete.
+				return rs.addrs(), nil
+			}
+
+			return nil, fmt.Errorf("failed to read mDNS response: %v", err)
+		}
+
+		// Ignore any malformed or unrelated messages.
+		_ = rs.parse(b[:n])
+	}
+}
+
+// query builds an mDNS query for Key Light devices.
+func query() ([]byte, error) {
+	name, err := dnsmessage.NewName(elgatoService)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	return msg.Pack()
+}
+
+// responses accumulates the DNS-SD records for Key Light devices from mDNS
+// responses.
+type responses struct {
+	instances map[string]struct{}
+	srvs      map[string]dnsmessage.SRVResource
+	ips       map[string]net.IP
+}
+
+// newResponses creates an empty responses.
+func newResponses() *responses {
+	return &responses{
+		instances: make(map[string]struct{}),
+		srvs:      make(map[string]dnsmessage.SRVResource),
+		ips:       make(map[string]net.IP),
+	}
+}
+
+// parse parses the records in the mDNS response b.
+func (rs *responses) parse(b []byte) error {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		return err
+	}
+	if !msg.Header.Response {
+		return errors.New("not an mDNS response")
+	}
+
+	// Devices typically send their SRV and A records as additional records.
+	records := append(msg.Answers, msg.Additionals...)
+	for _, r := range records {
+		name := strings.ToLower(r.Header.Name.String())
+
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == elgatoService {
+				rs.instances[strings.ToLower(body.PTR.String())] = struct{}{}
+			}
+		case *dnsmessage.SRVResource:
+			rs.srvs[name] = *body
+		case *dnsmessage.AResource:
+			rs.ips[name] = net.IP(body.A[:])
+		}
+	}
+
+	return nil
+}
+
+// addrs returns the sorted addresses of each discovered device.
+func (rs *responses) addrs() []string {
+	addrs := make([]string, 0, len(rs.instances))
+	for inst := range rs.instances {
+		srv, ok := rs.srvs[inst]
+		if !ok {
+			// The device did not report where it can be reached.
+			continue
+		}
+
+		target := strings.ToLower(srv.Target.String())
+		host := strings.TrimSuffix(target, ".")
+		if ip, ok := rs.ips[target]; ok {
+			host = ip.String()
+		}
+
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+
+	sort.Strings(addrs)
+	return addrs
+}
+
+// A discoveredDevice is a device returned by the discovery endpoint.
+type discoveredDevice struct {
+	Name    string `json:"name"`
+	Serial  string `json:"serial"`
+	Address string `json:"address"`
+}
+
+// serveDiscover serves a JSON list of the devices found using d. The name and
+// serial of each device are fetched using the handler's Fetcher, and are left
+// empty if the device cannot be reached.
+func (h *handler) serveDiscover(w http.ResponseWriter, r *http.Request, d *Discoverer) {
+	addrs, err := d.Discover(r.Context())
+	if err != nil {
+		h.ll.Warn("failed to discover devices", "err", err)
+		httpError(w, r, "failed to discover devices", "", http.StatusInternalServerError)
+		return
+	}
+
+	// Discovery runs until its deadline, so identify the devices using a
+	// separate deadline.
+	ictx, icancel := context.WithTimeout(r.Context(), scrapeTimeout(r, h.timeout))
+	defer icancel()
+
+	var (
+		wg      sync.WaitGroup
+		devices = make([]discoveredDevice, 0, len(addrs))
+	)
+
+	for _, a := range addrs {
+		addr, err := buildAddr(a, h.port)
+		if err != nil || (h.allowlist != nil && !h.allowlist.allowed(ictx, addr)) {
+			continue
+		}
+
+		// devices has sufficient capacity for all addresses, so dev remains
+		// valid as further devices are appended.
+		devices = append(devices, discoveredDevice{Address: a})
+		dev := &devices[len(devices)-1]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data, err := h.f.Fetch(ictx, addr)
+			if err != nil {
+				h.ll.Warn("failed to identify discovered device", "target", addr, "err", err)
+				return
+			}
+
+			dev.Name = data.Device.DisplayName
+			dev.Serial = data.Device.SerialNumber
+		}()
+	}
+
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(devices)
+}
+
+// serveDiscovered discovers the devices on the local network using half of
+// the scrape timeout determined from the configured timeout, and serves the
+// metrics of each device which may be scraped using the remainder, attaching
+// labels to each series and omitting the metrics in exclude.
+func (h *handler) serveDiscovered(
+	w http.ResponseWriter,
+	r *http.Request,
+	configured time.Duration,
+	labels prometheus.Labels,
+	exclude map[string]struct{},
+) {
+	timeout := scrapeTimeout(r, configured)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	dctx, dcancel := context.WithTimeout(ctx, timeout/2)
+	defer dcancel()
+
+	var addrs []string
+	if h.poller != nil {
+		// Serve the devices found by the most recent background poll
+		// rather than waiting for discovery.
+		h.mu.Lock()
+		addrs = h.discovered
+		h.mu.Unlock()
+	} else {
+		var err error
+		addrs, err = h.discoverTargets(dctx, ctx)
+		if err != nil {
+			h.ll.Warn("failed to discover devices", "err", err)
+			httpError(w, r, "failed to discover devices", "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.serveTargets(ctx, w, r, timeout, addrs, labels, exclude, nil)
+}
+
+// discoverTargets discovers the devices on the local network using dctx, and
+// returns the sorted addresses of those which may be scraped, checking the
+// allowlist using ctx.
+func (h *handler) discoverTargets(dctx, ctx context.Context) ([]string, error) {
+	found, err := h.autoDiscover.Discover(dctx)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(found))
+	for _, a := range found {
+		addr, err := buildAddr(a, h.port)
+		if err != nil || (h.allowlist != nil && !h.allowlist.allowed(ctx, addr)) {
+			continue
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+	return addrs, nil
+}
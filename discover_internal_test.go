@@ -0,0 +1,259 @@
+package keylightexporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDiscovererNoDevices(t *testing.T) {
+	// Nothing responds on this socket.
+	d := &Discoverer{addr: testResponder(t, nil)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	addrs, err := d.Discover(ctx)
+	if err != nil {
+		t.Fatalf("failed to discover: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{}, addrs); diff != "" {
+		t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerDiscover(t *testing.T) {
+	d := &Discoverer{addr: testResponder(t, testAnnouncement(t))}
+
+	f := discoverFetcher(func(_ context.Context, addr string) (*Data, error) {
+		if addr != "http://192.0.2.10:9123" {
+			return nil, errors.New("device unreachable")
+		}
+
+		return &Data{Device: &keylight.Device{
+			DisplayName:  "office",
+			SerialNumber: "1111",
+		}}, nil
+	})
+
+	h := NewHandler(prometheus.NewPedanticRegistry(), f, WithDiscoverer(d))
+
+	// Bound the duration of discovery.
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, discoverPath, nil).WithContext(ctx))
+
+	if diff := cmp.Diff(http.StatusOK, w.Code); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+
+	var got []discoveredDevice
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+
+	want := []discoveredDevice{
+		{
+			Name:    "office",
+			Serial:  "1111",
+			Address: "192.0.2.10:9123",
+		},
+		{
+			// This device cannot be reached to fetch its name and serial.
+			Address: "keylight-2.local:9123",
+		},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected discovered devices (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerAutoDiscover(t *testing.T) {
+	d := &Discoverer{addr: testResponder(t, testAnnouncement(t))}
+
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+
+	f := discoverFetcher(func(_ context.Context, addr string) (*Data, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched = append(fetched, addr)
+
+		if addr != "http://192.0.2.10:9123" {
+			return nil, errors.New("device unreachable")
+		}
+
+		return &Data{Device: &keylight.Device{
+			DisplayName:  "office",
+			SerialNumber: "1111",
+		}}, nil
+	})
+
+	h := NewHandler(prometheus.NewPedanticRegistry(), f,
+		WithDiscoverer(d),
+		WithAutoDiscover(true),
+		// Bound the duration of discovery to half of the timeout.
+		WithTimeout(500*time.Millisecond),
+	)
+
+	scrape := func(target string) (string, []string) {
+		t.Helper()
+
+		mu.Lock()
+		fetched = nil
+		mu.Unlock()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics"+target, nil))
+
+		if diff := cmp.Diff(http.StatusOK, w.Code); diff != "" {
+			t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(fetched)
+
+		return w.Body.String(), fetched
+	}
+
+	// Every discovered device is scraped, and the unreachable device is
+	// reported as down without failing the scrape.
+	body, addrs := scrape("")
+
+	want := []string{"http://192.0.2.10:9123", "http://keylight-2.local:9123"}
+	if diff := cmp.Diff(want, addrs); diff != "" {
+		t.Fatalf("unexpected fetched devices (-want +got):\n%s", diff)
+	}
+
+	for _, s := range []string{
+		`keylight_up{serial="1111",target="http://192.0.2.10:9123"} 1`,
+		`keylight_up{serial="",target="http://keylight-2.local:9123"} 0`,
+		`keylight_info{address="http://192.0.2.10:9123",firmware="",firmware_build="",hardware_board_type="",model="unknown",name="office",product="",serial="1111"} 1`,
+	} {
+		if !strings.Contains(body, s+"\n") {
+			t.Errorf("series was not found: %s", s)
+		}
+	}
+
+	// An explicit target is scraped alone.
+	_, addrs = scrape("?target=192.0.2.20")
+	if diff := cmp.Diff([]string{"http://192.0.2.20:9123"}, addrs); diff != "" {
+		t.Fatalf("unexpected fetched devices (-want +got):\n%s", diff)
+	}
+}
+
+type discoverFetcher func(ctx context.Context, addr string) (*Data, error)
+
+func (f discoverFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	return f(ctx, addr)
+}
+
+// testResponder starts a fake mDNS responder which replies to each query
+// with res, and returns its address. If res is nil, queries are ignored.
+func testResponder(t *testing.T, res []byte) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			_, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if res != nil {
+				_, _ = conn.WriteToUDP(res, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// testAnnouncement builds an mDNS response which announces two Key Light
+// devices, only one of which reports its IPv4 address, and an unrelated
+// service.
+func testAnnouncement(t *testing.T) []byte {
+	t.Helper()
+
+	name := func(s string) dnsmessage.Name {
+		n, err := dnsmessage.NewName(s)
+		if err != nil {
+			t.Fatalf("failed to create name: %v", err)
+		}
+		return n
+	}
+
+	hdr := func(s string, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{
+			Name:  name(s),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+			TTL:   120,
+		}
+	}
+
+	ptr := func(service, instance string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: hdr(service, dnsmessage.TypePTR),
+			Body:   &dnsmessage.PTRResource{PTR: name(instance)},
+		}
+	}
+
+	srv := func(instance, target string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: hdr(instance, dnsmessage.TypeSRV),
+			Body:   &dnsmessage.SRVResource{Target: name(target), Port: 9123},
+		}
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{
+			ptr(elgatoService, "Elgato Key Light 1._elg._tcp.local."),
+			ptr(elgatoService, "Elgato Key Light 2._elg._tcp.local."),
+			ptr("_http._tcp.local.", "printer._http._tcp.local."),
+		},
+		Additionals: []dnsmessage.Resource{
+			srv("Elgato Key Light 1._elg._tcp.local.", "keylight-1.local."),
+			srv("Elgato Key Light 2._elg._tcp.local.", "keylight-2.local."),
+			srv("printer._http._tcp.local.", "printer.local."),
+			{
+				Header: hdr("keylight-1.local.", dnsmessage.TypeA),
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+			},
+		},
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack message: %v", err)
+	}
+
+	return b
+}
@@ -0,0 +1,143 @@
+package keylightexporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// defaultDNSCacheTTL is the default duration for which resolved addresses are
+// cached by a dnsCache.
+const defaultDNSCacheTTL = 30 * time.Second
+
+// A dnsCache dials devices by hostname, caching the addresses resolved for
+// each hostname for a fixed duration so that repeated scrapes of a device do
+// not depend on a fresh DNS lookup every time.
+type dnsCache struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+// A dnsEntry stores the cached addresses for a single hostname.
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// newDNSCache creates a dnsCache which caches resolved addresses for ttl. If
+// ttl is not positive, a default of 30 seconds is used.
+func newDNSCache(ttl time.Duration) *dnsCache {
+	if ttl <= 0 {
+		ttl = defaultDNSCacheTTL
+	}
+
+	var d net.Dialer
+	return &dnsCache{
+		ttl: ttl,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		dial:    d.DialContext,
+		now:     time.Now,
+		entries: make(map[string]dnsEntry),
+	}
+}
+
+// DialContext dials addr using network, resolving its host using the cache
+// where possible. If no cached address can be dialed, the cached addresses are
+// discarded and the host is resolved again in case they are out of date.
+func (c *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return c.dial(ctx, network, addr)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		// Nothing to resolve.
+		return c.dial(ctx, network, addr)
+	}
+
+	addrs, ok := c.cached(host)
+	if !ok {
+		if addrs, err = c.resolve(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := c.dialAll(ctx, network, addrs, port)
+	if err == nil || !ok {
+		return conn, err
+	}
+
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+
+	if addrs, err = c.resolve(ctx, host); err != nil {
+		return nil, err
+	}
+
+	return c.dialAll(ctx, network, addrs, port)
+}
+
+// cached returns the unexpired cached addresses for host, if any.
+func (c *dnsCache) cached(host string) ([]netip.Addr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[host]
+	if !ok || !c.now().Before(e.expires) {
+		return nil, false
+	}
+
+	return e.addrs, true
+}
+
+// resolve performs a live lookup of host and caches the result, evicting any
+// other expired entries.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[host] = dnsEntry{addrs: addrs, expires: now.Add(c.ttl)}
+	return addrs, nil
+}
+
+// dialAll dials each of addrs on port in order, returning the first successful
+// connection or the error from the first address if none succeed.
+func (c *dnsCache) dialAll(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	var first error
+	for _, ip := range addrs {
+		conn, err := c.dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+
+	return nil, fmt.Errorf("failed to dial resolved addresses: %w", first)
+}
@@ -0,0 +1,121 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDNSCache(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		now     = time.Unix(0, 0)
+		lookups int
+		dials   []string
+
+		// The address returned by each lookup, and whether it accepts
+		// connections.
+		resolved = netip.MustParseAddr("192.0.2.1")
+		up       = map[string]bool{"192.0.2.1:9123": true}
+	)
+
+	c := newDNSCache(0)
+	c.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	c.lookup = func(_ context.Context, host string) ([]netip.Addr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		lookups++
+		if host == "missing" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		return []netip.Addr{resolved}, nil
+	}
+	c.dial = func(_ context.Context, _, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		dials = append(dials, addr)
+		if !up[addr] {
+			return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+		}
+
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return c1, nil
+	}
+
+	dial := func(addr string, ok bool) {
+		t.Helper()
+
+		conn, err := c.DialContext(context.Background(), "tcp", addr)
+		if ok && err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		if !ok {
+			if err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+			return
+		}
+		_ = conn.Close()
+	}
+
+	check := func(wantLookups int, wantDials []string) {
+		t.Helper()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if diff := cmp.Diff(wantLookups, lookups); diff != "" {
+			t.Fatalf("unexpected number of lookups (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantDials, dials); diff != "" {
+			t.Fatalf("unexpected dials (-want +got):\n%s", diff)
+		}
+		dials = nil
+	}
+
+	// Repeated dials within the TTL reuse the resolved address.
+	dial("keylight:9123", true)
+	dial("keylight:9123", true)
+	check(1, []string{"192.0.2.1:9123", "192.0.2.1:9123"})
+
+	// IP addresses are dialed directly.
+	dial("192.0.2.1:9123", true)
+	check(1, []string{"192.0.2.1:9123"})
+
+	// Once the TTL expires, the hostname is resolved again.
+	mu.Lock()
+	now = now.Add(defaultDNSCacheTTL)
+	mu.Unlock()
+
+	dial("keylight:9123", true)
+	check(2, []string{"192.0.2.1:9123"})
+
+	// The device moves, so the cached address fails and a live lookup finds
+	// its new address.
+	mu.Lock()
+	resolved = netip.MustParseAddr("192.0.2.2")
+	up = map[string]bool{"192.0.2.2:9123": true}
+	mu.Unlock()
+
+	dial("keylight:9123", true)
+	check(3, []string{"192.0.2.1:9123", "192.0.2.2:9123"})
+
+	// Lookup failures are not cached.
+	dial("missing:9123", false)
+	dial("missing:9123", false)
+	check(5, nil)
+}
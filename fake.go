@@ -0,0 +1,69 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mdlayher/keylight"
+)
+
+var _ Fetcher = &FakeFetcher{}
+
+// A FakeFetcher is a Fetcher which returns deterministic Data for any target
+// without contacting a device, so that the exporter can be run for demos and
+// testing without any physical Key Light devices.
+type FakeFetcher struct {
+	// Lights is the number of lights reported by each device.
+	Lights int
+
+	// Brightness and Temperature are the brightness percentage and color
+	// temperature in Kelvin reported for each light. All lights are reported
+	// as turned on.
+	Brightness  int
+	Temperature int
+
+	// FailTarget optionally names a target whose fetches always fail, so that
+	// error handling can be exercised. It matches either the target's host or
+	// its full device URL.
+	FailTarget string
+}
+
+// errFakeFailure is returned by FakeFetcher for its FailTarget.
+var errFakeFailure = errors.New("simulated failure")
+
+// Fetch implements Fetcher.
+func (f *FakeFetcher) Fetch(_ context.Context, addr string) (*Data, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device URL: %q", addr)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if f.FailTarget != "" && (strings.EqualFold(f.FailTarget, host) || f.FailTarget == addr) {
+		return nil, fmt.Errorf("failed to fetch device: %w", errFakeFailure)
+	}
+
+	ls := make([]*keylight.Light, 0, f.Lights)
+	for i := 0; i < f.Lights; i++ {
+		ls = append(ls, &keylight.Light{
+			On:          true,
+			Brightness:  f.Brightness,
+			Temperature: f.Temperature,
+		})
+	}
+
+	// Derive the serial from the host so that multiple fake targets may be
+	// scraped together without producing duplicate series.
+	return &Data{
+		Device: &keylight.Device{
+			ProductName:     "Elgato Key Light",
+			FirmwareVersion: "1.0.0",
+			DisplayName:     "fake",
+			SerialNumber:    "FAKE-" + host,
+		},
+		Lights: ls,
+	}, nil
+}
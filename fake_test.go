@@ -0,0 +1,53 @@
+package keylightexporter_test
+
+import (
+	"testing"
+
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestFakeFetcher(t *testing.T) {
+	f := &keylightexporter.FakeFetcher{
+		Lights:      2,
+		Brightness:  50,
+		Temperature: 4500,
+		FailTarget:  "broken",
+	}
+
+	b := testBody(t, testHandler(t, f, "foo,bar,broken"))
+
+	// Each fake target reports its own serial, and only the failed target is
+	// reported as down.
+	if !matchDevice(t, b, []string{
+		`keylight_up{serial="FAKE-bar",target="http://bar:9123"} 1`,
+		`keylight_up{serial="FAKE-foo",target="http://foo:9123"} 1`,
+		`keylight_up{serial="",target="http://broken:9123"} 0`,
+		`keylight_info{address="http://bar:9123",firmware="1.0.0",firmware_build="",hardware_board_type="",model="keylight",name="fake",product="Elgato Key Light",serial="FAKE-bar"} 1`,
+		`keylight_lights{serial="FAKE-bar"} 2`,
+		`keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="",hardware_board_type="",model="keylight",name="fake",product="Elgato Key Light",serial="FAKE-foo"} 1`,
+		`keylight_lights{serial="FAKE-foo"} 2`,
+		`keylight_light_on{light="light0",name="fake",serial="FAKE-bar"} 1`,
+		`keylight_light_on{light="light1",name="fake",serial="FAKE-bar"} 1`,
+		`keylight_light_on{light="light0",name="fake",serial="FAKE-foo"} 1`,
+		`keylight_light_on{light="light1",name="fake",serial="FAKE-foo"} 1`,
+		`keylight_light_brightness_percent{light="light0",name="fake",serial="FAKE-bar"} 50`,
+		`keylight_light_brightness_percent{light="light1",name="fake",serial="FAKE-bar"} 50`,
+		`keylight_light_brightness_percent{light="light0",name="fake",serial="FAKE-foo"} 50`,
+		`keylight_light_brightness_percent{light="light1",name="fake",serial="FAKE-foo"} 50`,
+		`keylight_light_brightness_ratio{light="light0",name="fake",serial="FAKE-bar"} 0.5`,
+		`keylight_light_brightness_ratio{light="light1",name="fake",serial="FAKE-bar"} 0.5`,
+		`keylight_light_brightness_ratio{light="light0",name="fake",serial="FAKE-foo"} 0.5`,
+		`keylight_light_brightness_ratio{light="light1",name="fake",serial="FAKE-foo"} 0.5`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="fake",serial="FAKE-bar"} 4500`,
+		`keylight_light_color_temperature_kelvin{light="light1",name="fake",serial="FAKE-bar"} 4500`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="fake",serial="FAKE-foo"} 4500`,
+		`keylight_light_color_temperature_kelvin{light="light1",name="fake",serial="FAKE-foo"} 4500`,
+		`keylight_light_color_temperature_mireds{light="light0",name="fake",serial="FAKE-bar"} 222.22222222222223`,
+		`keylight_light_color_temperature_mireds{light="light1",name="fake",serial="FAKE-bar"} 222.22222222222223`,
+		`keylight_light_color_temperature_mireds{light="light0",name="fake",serial="FAKE-foo"} 222.22222222222223`,
+		`keylight_light_color_temperature_mireds{light="light1",name="fake",serial="FAKE-foo"} 222.22222222222223`,
+		`keylight_scrape_errors_total{reason="other"} 1`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
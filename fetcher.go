@@ -0,0 +1,894 @@
+package keylightexporter
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/keylight"
+)
+
+// A Fetcher can fetch Data about a Key Light device from addr.
+//
+// Fetch returns an error if the device's information cannot be fetched. If the
+// information is fetched but the device's lights cannot be, Fetch should
+// instead return the partial Data with LightsErr set, so that the device's
+// information is still exported.
+type Fetcher interface {
+	Fetch(ctx context.Context, addr string) (*Data, error)
+}
+
+// Data contains information which is used to export Prometheus metrics.
+type Data struct {
+	Device *keylight.Device
+	Lights []*keylight.Light
+
+	// Proto is the HTTP protocol version negotiated with the device, such
+	// as "HTTP/1.1". It is optional and may be left empty.
+	Proto string
+
+	// Timestamp is the time at which the device took its reading, if the
+	// device reports it. It is optional and may be left zero.
+	Timestamp time.Time
+
+	// WiFiRSSI is the signal strength in dBm of the device's WiFi connection,
+	// if the device reports it. It is optional and may be left zero.
+	WiFiRSSI int
+
+	// BootTime is the time at which the device last booted, if the device
+	// reports it. It is optional and may be left zero.
+	BootTime time.Time
+
+	// TemperatureMin and TemperatureMax are the minimum and maximum color
+	// temperatures in Kelvin supported by the device's lights, if the device
+	// reports them. They are optional and may be left zero.
+	TemperatureMin int
+	TemperatureMax int
+
+	// ConnectDuration and TransferDuration are the total time spent
+	// establishing connections to the device and transferring data once
+	// connected, if the Fetcher measures them. They are optional and may be
+	// left zero.
+	ConnectDuration  time.Duration
+	TransferDuration time.Duration
+
+	// CachedAt is the time at which the Data was stored by a CachingFetcher.
+	// It is zero if the Data was not cached.
+	CachedAt time.Time
+
+	// PolledAt is the time at which the Data was fetched by a background
+	// poll. It is zero if the Data was not polled.
+	PolledAt time.Time
+
+	// StaleErr is non-nil if the device could not be fetched and the Data was
+	// instead served from a CachingFetcher configured with a stale fallback,
+	// in which case the device is reported as down. It is optional and may
+	// be left nil.
+	StaleErr error
+
+	// LightsErr is non-nil if the device's information was fetched but its
+	// lights could not be, in which case Lights is empty. It is optional and
+	// may be left nil.
+	LightsErr error
+}
+
+// An AuthHook performs any authentication required by the device at addr
+// before its data is fetched. Requests should be made using c, which retains
+// any cookies set by the device, such as a session token, and sends them with
+// all subsequent requests to the device for the current fetch.
+type AuthHook func(ctx context.Context, c *http.Client, addr string) error
+
+// clientIdleTimeout is the duration after which a cached client for a device
+// which is no longer scraped is evicted.
+const clientIdleTimeout = 5 * time.Minute
+
+// clientMaxFailures is the number of consecutive failed fetches after which a
+// cached client for a device is evicted, so that the next fetch uses a new
+// client and connections.
+const clientMaxFailures = 3
+
+// defaultConnectTimeout is the default maximum duration of each TCP connection
+// attempt to a device.
+const defaultConnectTimeout = 2 * time.Second
+
+// defaultMaxBodySize is the default maximum size in bytes of each HTTP response
+// body read from a device.
+const defaultMaxBodySize = 256 << 10
+
+// Defaults for reusing HTTP connections to devices, which close idle
+// connections after a short time.
+const (
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleConnTimeout     = 5 * time.Second
+	defaultKeepAlive           = 15 * time.Second
+)
+
+// A TransportConfig tunes the reuse of HTTP connections to devices by the
+// default HTTP fetcher. Zero values use defaults tuned for Key Light devices.
+//
+// The client for each device is reused across fetches, but all clients share
+// a single pool of connections which is governed by these settings. A client
+// which is reused after its device's connections have idled beyond
+// IdleConnTimeout establishes a new connection. A client which fails to fetch
+// data from its device 3 consecutive times is replaced, and idle connections
+// are closed.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is the maximum number of idle connections retained
+	// for each device. The default is 2.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is the duration after which an idle connection to a
+	// device is closed. It should be shorter than the time after which the
+	// device closes idle connections itself, so that a connection which was
+	// already dropped by the device is never used. The default is 5 seconds.
+	IdleConnTimeout time.Duration
+
+	// KeepAlive is the interval between TCP keep-alive probes on connections
+	// to devices. If negative, keep-alive probes are disabled. The default is
+	// 15 seconds.
+	KeepAlive time.Duration
+
+	// DisableKeepAlives disables the reuse of connections entirely, so that
+	// each request to a device uses a new connection.
+	DisableKeepAlives bool
+}
+
+// An httpFetcher uses a *keylight.Client to implement Fetcher.
+type httpFetcher struct {
+	c          *http.Client
+	concurrent bool
+	auth       AuthHook
+	wifi       bool
+	limits     bool
+
+	// raw retains raw device responses if debugging is enabled.
+	raw *rawStore
+
+	// spacer delays consecutive requests to each device, if configured.
+	spacer *requestSpacer
+
+	// clients stores a *deviceClient for each device address, reused
+	// across fetches when no AuthHook is configured.
+	clients sync.Map
+
+	// now determines when clients were last used, for eviction.
+	now func() time.Time
+}
+
+// A deviceClient is a client for a single device, reused across fetches.
+type deviceClient struct {
+	c  *keylight.Client
+	hc *http.Client
+	rt *recordTransport
+
+	// lastUsed is the UNIX time in nanoseconds of the most recent fetch.
+	lastUsed atomic.Int64
+
+	// failures is the number of consecutive failed fetches.
+	failures atomic.Int32
+}
+
+// NewHTTPFetcher returns a Fetcher which fetches data from devices over HTTP
+// using c, so that its transport, timeouts, and dialer may be customized. If c
+// is nil, the same client is used as the default HTTP fetcher of NewHandler,
+// whose requests are bounded only by the context passed to Fetch. The
+// *http.Client is the only configuration accepted by keylight.NewClient, so
+// c is passed to the keylight.Client for each device.
+//
+// Options which configure the default HTTP fetcher have no effect on the
+// returned Fetcher.
+func NewHTTPFetcher(c *http.Client) Fetcher {
+	f := newHTTPFetcher(&config{})
+	if c != nil {
+		f.c = c
+	}
+
+	return f
+}
+
+// newHTTPFetcher creates an httpFetcher which communicates with devices using
+// the transport settings specified by cfg.
+func newHTTPFetcher(cfg *config) *httpFetcher {
+	// The scrape timeout is the only deadline for each fetch, so that a
+	// configured timeout may allow slow devices more time to respond.
+	f := &httpFetcher{
+		c:          &http.Client{},
+		concurrent: cfg.concurrentFetch,
+		auth:       cfg.authHook,
+		wifi:       cfg.wifiSignal,
+		limits:     cfg.tempLimits,
+		now:        cfg.now(),
+	}
+
+	if cfg.debug {
+		f.raw = newRawStore(cfg.port())
+	}
+	if cfg.minReqInterval > 0 {
+		f.spacer = newRequestSpacer(cfg.minReqInterval)
+		f.spacer.now = cfg.now()
+	}
+
+	connectTimeout := cfg.connectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	tc := cfg.transport
+	if tc.MaxIdleConnsPerHost <= 0 {
+		tc.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if tc.IdleConnTimeout <= 0 {
+		tc.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if tc.KeepAlive == 0 {
+		tc.KeepAlive = defaultKeepAlive
+	}
+
+	// Bound each connection attempt separately from the overall timeout so
+	// that an unreachable device fails quickly.
+	d := &net.Dialer{Timeout: connectTimeout, KeepAlive: tc.KeepAlive}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = d.DialContext
+	t.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	t.IdleConnTimeout = tc.IdleConnTimeout
+	t.DisableKeepAlives = tc.DisableKeepAlives
+	// Devices are only reached through an explicitly configured proxy, as
+	// proxies set by the environment are unlikely to reach the local network.
+	t.Proxy = nil
+	switch {
+	case cfg.connectProxy != nil:
+		// The proxy resolves device hostnames, so the DNS cache is not used.
+		t.DialContext = connectDialer(cfg.connectProxy, d)
+	case cfg.proxy != nil:
+		// As above.
+		t.Proxy = http.ProxyURL(cfg.proxy)
+	case cfg.dnsCache:
+		c := newDNSCache(cfg.dnsCacheTTL)
+		c.dial = d.DialContext
+		c.now = cfg.now()
+		t.DialContext = c.DialContext
+	}
+	if tlsConfig := deviceTLSConfig(cfg); tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig
+	}
+
+	maxBodySize := cfg.maxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+
+	f.c.Transport = &limitTransport{rt: t, max: maxBodySize}
+
+	prefix := strings.Trim(cfg.basePath, "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	if prefix != "" || cfg.forceScheme != "" {
+		f.c.Transport = &rewriteTransport{
+			rt:     f.c.Transport,
+			scheme: strings.ToLower(cfg.forceScheme),
+			prefix: prefix,
+		}
+	}
+
+	return f
+}
+
+// deviceTLSConfig returns the TLS configuration for HTTPS connections to
+// devices specified by cfg, or nil if the defaults should be used.
+func deviceTLSConfig(cfg *config) *tls.Config {
+	if cfg.tlsConfig == nil && cfg.skipVerify == nil && cfg.rootCAs == nil {
+		return nil
+	}
+
+	tc := &tls.Config{}
+	if cfg.tlsConfig != nil {
+		tc = cfg.tlsConfig.Clone()
+	}
+	if cfg.skipVerify != nil {
+		tc.InsecureSkipVerify = *cfg.skipVerify
+	}
+	if cfg.rootCAs != nil {
+		tc.RootCAs = cfg.rootCAs
+	}
+
+	return tc
+}
+
+// Fetch implements Fetcher.
+func (f *httpFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	dc, err := f.client(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := f.fetch(ctx, addr, dc)
+	if f.auth == nil {
+		f.heal(addr, dc, err)
+	}
+
+	return d, err
+}
+
+// heal records the result err of a fetch from the device at addr using its
+// cached client dc. Once dc fails clientMaxFailures consecutive times, it is
+// evicted and idle connections are closed, so that connections which went
+// stale, such as when the device rebooted or its address was reassigned, are
+// not reused. Connections are pooled by all clients, so idle connections to
+// other devices are also closed and re-established when next needed.
+func (f *httpFetcher) heal(addr string, dc *deviceClient, err error) {
+	switch {
+	case err == nil:
+		dc.failures.Store(0)
+		return
+	case errors.Is(err, context.Canceled):
+		// The caller gave up, which says nothing about the connections.
+		return
+	}
+
+	if dc.failures.Add(1) < clientMaxFailures {
+		return
+	}
+
+	// Concurrent fetches may fail using the same client, but only the first
+	// to evict it closes the connections.
+	if f.clients.CompareAndDelete(addr, dc) {
+		dc.hc.CloseIdleConnections()
+	}
+}
+
+// fetch fetches data from the device at addr using dc.
+func (f *httpFetcher) fetch(ctx context.Context, addr string, dc *deviceClient) (*Data, error) {
+	// Measure all requests made for this fetch alone, even if the device's
+	// client is shared with concurrent fetches.
+	var timings fetchTimings
+	ctx = context.WithValue(ctx, timingsKey{}, &timings)
+
+	var ib *infoBody
+	if f.wifi {
+		// The accessory information of newer firmware includes WiFi details
+		// which are not parsed by keylight.Device, so its body is retained
+		// rather than fetched again.
+		ib = &infoBody{}
+		ctx = context.WithValue(ctx, infoBodyKey{}, ib)
+	}
+
+	if err := f.authenticate(ctx, dc, addr); err != nil {
+		return nil, err
+	}
+
+	c, hc, rt := dc.c, dc.hc, dc.rt
+
+	var (
+		d  *keylight.Device
+		ls []*keylight.Light
+	)
+
+	info := func(ctx context.Context) error {
+		var err error
+		if d, err = c.AccessoryInfo(ctx); err != nil {
+			return fmt.Errorf("failed to fetch device: %w", err)
+		}
+
+		return nil
+	}
+
+	lights := func(ctx context.Context) error {
+		var err error
+		if ls, err = c.Lights(ctx); err != nil {
+			return fmt.Errorf("failed to fetch lights: %w", err)
+		}
+
+		return nil
+	}
+
+	var lerr error
+	if f.concurrent {
+		// Fetch both concurrently. A failure to fetch the device information
+		// cancels the fetch of the lights, but not vice versa, because the
+		// information is exported regardless of the lights.
+		lctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lerr = lights(lctx)
+		}()
+
+		err := info(ctx)
+		if err != nil {
+			cancel()
+		}
+		wg.Wait()
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := info(ctx); err != nil {
+			return nil, err
+		}
+		lerr = lights(ctx)
+	}
+
+	var tmin, tmax int
+	if needSerial := d.SerialNumber == ""; needSerial || f.limits {
+		// Some devices do not report a serial number in their accessory info,
+		// but may report one in their settings. This is best effort: devices
+		// without a serial number or temperature limits were previously
+		// scraped successfully, so failure to fetch the settings is not
+		// treated as an error.
+		if s, err := fetchSettings(ctx, hc, addr); err == nil {
+			if needSerial {
+				d.SerialNumber = s.SerialNumber
+			}
+			if f.limits {
+				tmin, tmax = s.temperatureLimits()
+			}
+		}
+	}
+
+	var rssi int
+	if f.wifi {
+		// This is best effort: devices which do not report a signal are
+		// still scraped.
+		rssi, _ = wifiRSSI(ib.bytes())
+	}
+
+	connect, transfer := timings.durations()
+
+	return &Data{
+		Device:           d,
+		Lights:           ls,
+		Proto:            rt.Proto(),
+		WiFiRSSI:         rssi,
+		TemperatureMin:   tmin,
+		TemperatureMax:   tmax,
+		ConnectDuration:  connect,
+		TransferDuration: transfer,
+		LightsErr:        lerr,
+	}, nil
+}
+
+// authenticate performs the AuthHook for the device at addr using dc, if
+// configured.
+func (f *httpFetcher) authenticate(ctx context.Context, dc *deviceClient, addr string) error {
+	if f.auth == nil {
+		return nil
+	}
+
+	// Retain any cookies set during authentication for the client alone,
+	// which is never reused when an AuthHook is configured.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create cookie jar: %v", err)
+	}
+	dc.hc.Jar = jar
+
+	if err := f.auth(ctx, dc.hc, addr); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	return nil
+}
+
+// client returns a client for the device at addr. Clients are cached and
+// reused across fetches unless an AuthHook is configured, in which case each
+// fetch uses a new client so that cookies are not shared between fetches.
+// Cached clients which have not been used recently are evicted.
+func (f *httpFetcher) client(addr string) (*deviceClient, error) {
+	now := f.now().UnixNano()
+
+	if f.auth == nil {
+		if v, ok := f.clients.Load(addr); ok {
+			dc := v.(*deviceClient)
+			dc.lastUsed.Store(now)
+			return dc, nil
+		}
+	}
+
+	// Record details of the HTTP responses for this client alone by using a
+	// shallow copy of the shared client, which shares its connection pool.
+	rt := &recordTransport{rt: f.c.Transport}
+	if f.raw != nil {
+		rt.body = func(path string, b []byte) { f.raw.store(addr, path, b) }
+	}
+	hc := *f.c
+	hc.Transport = rt
+	if f.spacer != nil {
+		// Delay requests before they are recorded, so that the delay is not
+		// attributed to the connection or transfer.
+		hc.Transport = &spacingTransport{rt: rt, s: f.spacer}
+	}
+
+	c, err := keylight.NewClient(addr, &hc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	dc := &deviceClient{c: c, hc: &hc, rt: rt}
+	dc.lastUsed.Store(now)
+	if f.auth != nil {
+		return dc, nil
+	}
+
+	// Evict clients for devices which are no longer scraped before caching
+	// the new client.
+	f.clients.Range(func(k, v any) bool {
+		if now-v.(*deviceClient).lastUsed.Load() > int64(clientIdleTimeout) {
+			f.clients.Delete(k)
+		}
+		return true
+	})
+
+	v, _ := f.clients.LoadOrStore(addr, dc)
+	return v.(*deviceClient), nil
+}
+
+// A recordTransport is an http.RoundTripper which records details about the
+// HTTP responses returned by its underlying http.RoundTripper.
+type recordTransport struct {
+	rt http.RoundTripper
+
+	// body, if not nil, is invoked with the raw body of each response once
+	// the body is closed.
+	body func(path string, b []byte)
+
+	mu    sync.Mutex
+	proto string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *recordTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt := t.rt
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	if r.Header.Get("User-Agent") == "" {
+		// Clone the request rather than modifying the caller's headers.
+		r = r.Clone(r.Context())
+		r.Header.Set("User-Agent", userAgent)
+	}
+
+	var (
+		start      = time.Now()
+		gotConn    atomic.Int64
+		timings, _ = r.Context().Value(timingsKey{}).(*fetchTimings)
+	)
+
+	if timings != nil {
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+			GotConn: func(_ httptrace.GotConnInfo) { gotConn.Store(time.Now().UnixNano()) },
+		}))
+	}
+
+	res, err := rt.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if timings != nil {
+		// If the underlying http.RoundTripper does not report connections,
+		// all of the time is attributed to the transfer.
+		connected := start
+		if ns := gotConn.Load(); ns != 0 {
+			connected = time.Unix(0, ns)
+		}
+
+		// The transfer is complete once the body is closed.
+		res.Body = &timingBody{
+			rc: res.Body,
+			done: func() {
+				timings.add(connected.Sub(start), time.Since(connected))
+			},
+		}
+	}
+
+	if ib, _ := r.Context().Value(infoBodyKey{}).(*infoBody); ib != nil && r.URL.Path == "/elgato/accessory-info" {
+		res.Body = &captureBody{rc: res.Body, done: ib.set}
+	}
+
+	if t.body != nil {
+		path := r.URL.Path
+		res.Body = &captureBody{
+			rc:   res.Body,
+			done: func(b []byte) { t.body(path, b) },
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.proto = res.Proto
+	return res, nil
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// http.RoundTripper, if supported.
+func (t *recordTransport) CloseIdleConnections() {
+	rt := t.rt
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	closeIdleConnections(rt)
+}
+
+// closeIdleConnections closes the idle connections of rt, if supported.
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// timingsKey is the context key for the *fetchTimings of a fetch.
+type timingsKey struct{}
+
+// A fetchTimings accumulates the time spent establishing connections and
+// transferring data for each request made during a single fetch.
+type fetchTimings struct {
+	mu                sync.Mutex
+	connect, transfer time.Duration
+}
+
+// add records the connect and transfer durations of a single request.
+func (t *fetchTimings) add(connect, transfer time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.connect += connect
+	t.transfer += transfer
+}
+
+// durations returns the total connect and transfer durations.
+func (t *fetchTimings) durations() (connect, transfer time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.connect, t.transfer
+}
+
+// infoBodyKey is the context key for the *infoBody of a fetch.
+type infoBodyKey struct{}
+
+// An infoBody retains the raw accessory information returned during a single
+// fetch.
+type infoBody struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+// set records the raw accessory information b.
+func (ib *infoBody) set(b []byte) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	ib.b = b
+}
+
+// bytes returns the raw accessory information, or nil if none was returned.
+func (ib *infoBody) bytes() []byte {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	return ib.b
+}
+
+var _ io.ReadCloser = &timingBody{}
+
+// A timingBody is an io.ReadCloser which invokes done once it is closed.
+type timingBody struct {
+	rc   io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+// Read implements io.Reader.
+func (b *timingBody) Read(p []byte) (int, error) { return b.rc.Read(p) }
+
+// Close implements io.Closer.
+func (b *timingBody) Close() error {
+	b.once.Do(b.done)
+	return b.rc.Close()
+}
+
+// A rewriteTransport is an http.RoundTripper which rewrites the URL of each
+// request before it is sent by its underlying http.RoundTripper, so that
+// devices may be reached through a reverse proxy which serves the device API
+// with a different scheme or under a path prefix.
+type rewriteTransport struct {
+	rt     http.RoundTripper
+	scheme string
+	prefix string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given.
+	r = r.Clone(r.Context())
+	if t.scheme != "" {
+		r.URL.Scheme = t.scheme
+	}
+	if t.prefix != "" {
+		r.URL.Path = t.prefix + r.URL.Path
+		r.URL.RawPath = ""
+	}
+
+	return t.rt.RoundTrip(r)
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// http.RoundTripper, if supported.
+func (t *rewriteTransport) CloseIdleConnections() { closeIdleConnections(t.rt) }
+
+// errBodyTooLarge is returned when an HTTP response body from a device exceeds
+// the maximum size.
+var errBodyTooLarge = errors.New("response body too large")
+
+// A limitTransport is an http.RoundTripper which bounds the size of the
+// response bodies returned by its underlying http.RoundTripper, so that a
+// misbehaving device cannot exhaust the exporter's memory.
+type limitTransport struct {
+	rt  http.RoundTripper
+	max int64
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.rt.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.ContentLength > t.max {
+		// Don't bother reading a body which is known to be too large.
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("%w: Content-Length %d exceeds maximum of %d bytes",
+			errBodyTooLarge, res.ContentLength, t.max)
+	}
+
+	// Read at most one byte beyond the limit to detect bodies which exceed it.
+	res.Body = &limitBody{
+		rc:  res.Body,
+		r:   io.LimitReader(res.Body, t.max+1),
+		max: t.max,
+	}
+
+	return res, nil
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// http.RoundTripper, if supported.
+func (t *limitTransport) CloseIdleConnections() { closeIdleConnections(t.rt) }
+
+var _ io.ReadCloser = &limitBody{}
+
+// A limitBody is an io.ReadCloser which returns an error once more than max
+// bytes are read.
+type limitBody struct {
+	rc   io.ReadCloser
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+// Read implements io.Reader.
+func (b *limitBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.read > b.max {
+		// Only return the bytes within the limit.
+		n = max(0, n-int(b.read-b.max))
+		return n, fmt.Errorf("%w: exceeds maximum of %d bytes", errBodyTooLarge, b.max)
+	}
+
+	return n, err
+}
+
+// Close implements io.Closer.
+func (b *limitBody) Close() error { return b.rc.Close() }
+
+// Proto returns the HTTP protocol version of the most recent response.
+func (t *recordTransport) Proto() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.proto
+}
+
+// lightSettings is the light settings of a device.
+type lightSettings struct {
+	SerialNumber string `json:"serialNumber"`
+
+	// The temperature limits are reported in the units of the Elgato API
+	// rather than Kelvin.
+	TemperatureMin int `json:"temperatureMin"`
+	TemperatureMax int `json:"temperatureMax"`
+}
+
+// temperatureLimits returns the minimum and maximum color temperatures in
+// Kelvin reported by s, or zero if s does not report both limits.
+func (s *lightSettings) temperatureLimits() (min, max int) {
+	if s.TemperatureMin <= 0 || s.TemperatureMax <= 0 {
+		return 0, 0
+	}
+
+	// The largest API value is the warmest, and therefore minimum, color
+	// temperature.
+	return apiKelvin(s.TemperatureMax), apiKelvin(s.TemperatureMin)
+}
+
+// apiKelvin converts an Elgato API color temperature to Kelvin, using the same
+// conversion as the keylight package uses for light temperatures so that the
+// limits are comparable with them.
+func apiKelvin(v int) int {
+	kelvin := 9900 - int(math.Round(float64(v)*20.35))
+	r := kelvin % 50
+	if r > 25 {
+		return kelvin + 50 - r
+	}
+
+	return kelvin - r
+}
+
+// fetchSettings fetches a device's light settings from its settings endpoint
+// at addr, using c.
+func fetchSettings(ctx context.Context, c *http.Client, addr string) (*lightSettings, error) {
+	var s lightSettings
+	if err := getJSON(ctx, c, addr+"/elgato/lights/settings", &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// wifiRSSI parses the signal strength of a device's WiFi connection from the
+// raw accessory information b.
+func wifiRSSI(b []byte) (int, error) {
+	var info struct {
+		WiFi struct {
+			RSSI int `json:"rssi"`
+		} `json:"wifi-info"`
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return 0, err
+	}
+
+	return info.WiFi.RSSI, nil
+}
+
+// getJSON fetches the JSON object at url using c and decodes it into out.
+func getJSON(ctx context.Context, c *http.Client, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("device returned HTTP %d", res.StatusCode)
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
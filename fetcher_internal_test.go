@@ -0,0 +1,246 @@
+package keylightexporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHTTPFetcherClientCache(t *testing.T) {
+	c := newFakeClock(time.Unix(1000, 0))
+	f := newHTTPFetcher(&config{clock: c})
+
+	client := func(addr string) *deviceClient {
+		t.Helper()
+
+		dc, err := f.client(addr)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+
+		return dc
+	}
+
+	foo := client("http://foo:9123")
+	if foo != client("http://foo:9123") {
+		t.Fatal("client was not reused")
+	}
+
+	// Idle clients are evicted when another client is created.
+	c.Add(2 * clientIdleTimeout)
+	_ = client("http://bar:9123")
+
+	if _, ok := f.clients.Load("http://foo:9123"); ok {
+		t.Fatal("idle client was not evicted")
+	}
+	if _, ok := f.clients.Load("http://bar:9123"); !ok {
+		t.Fatal("active client was evicted")
+	}
+}
+
+func TestHTTPFetcherClientHeal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/elgato/accessory-info":
+			_, _ = io.WriteString(w, `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}`)
+		case "/elgato/lights":
+			_, _ = io.WriteString(w, `{"numberOfLights":1,"lights":[{"on":1,"brightness":20,"temperature":280}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	st := &staleTransport{rt: srv.Client().Transport}
+	f := newHTTPFetcher(&config{})
+	f.c.Transport = &limitTransport{rt: st, max: defaultMaxBodySize}
+
+	fetch := func(ok bool) *deviceClient {
+		t.Helper()
+
+		_, err := f.Fetch(context.Background(), srv.URL)
+		if ok && err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+		if !ok && err == nil {
+			t.Fatal("expected an error, but none occurred")
+		}
+
+		v, ok := f.clients.Load(srv.URL)
+		if !ok {
+			return nil
+		}
+
+		return v.(*deviceClient)
+	}
+
+	dc := fetch(true)
+
+	// The connections go stale, so each fetch fails until they are closed.
+	st.setStale()
+	for i := 0; i < clientMaxFailures-1; i++ {
+		if fetch(false) != dc {
+			t.Fatal("client was evicted before reaching the failure limit")
+		}
+	}
+	if fetch(false) != nil {
+		t.Fatal("client was not evicted after reaching the failure limit")
+	}
+	if diff := cmp.Diff(1, st.closedCount()); diff != "" {
+		t.Fatalf("unexpected number of idle connection closures (-want +got):\n%s", diff)
+	}
+
+	// A new client succeeds using new connections.
+	if next := fetch(true); next == nil || next == dc {
+		t.Fatal("a new client was not created")
+	}
+}
+
+// A staleTransport is an http.RoundTripper whose requests fail once its
+// connections go stale, until its idle connections are closed.
+type staleTransport struct {
+	rt http.RoundTripper
+
+	mu     sync.Mutex
+	stale  bool
+	closed int
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *staleTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	stale := t.stale
+	t.mu.Unlock()
+
+	if stale {
+		return nil, syscall.ECONNRESET
+	}
+
+	return t.rt.RoundTrip(r)
+}
+
+// CloseIdleConnections replaces the stale connections.
+func (t *staleTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stale = false
+	t.closed++
+}
+
+func (t *staleTransport) setStale() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stale = true
+}
+
+func (t *staleTransport) closedCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+func TestHTTPFetcherTransportConfig(t *testing.T) {
+	type settings struct {
+		MaxIdleConnsPerHost int
+		IdleConnTimeout     time.Duration
+		DisableKeepAlives   bool
+	}
+
+	tests := []struct {
+		name string
+		tc   TransportConfig
+		want settings
+	}{
+		{
+			name: "defaults",
+			want: settings{
+				MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+				IdleConnTimeout:     defaultIdleConnTimeout,
+			},
+		},
+		{
+			name: "configured",
+			tc: TransportConfig{
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     1 * time.Second,
+				DisableKeepAlives:   true,
+			},
+			want: settings{
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     1 * time.Second,
+				DisableKeepAlives:   true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			WithTransportConfig(tt.tc)(&cfg)
+
+			f := newHTTPFetcher(&cfg)
+			tr := f.c.Transport.(*limitTransport).rt.(*http.Transport)
+
+			got := settings{
+				MaxIdleConnsPerHost: tr.MaxIdleConnsPerHost,
+				IdleConnTimeout:     tr.IdleConnTimeout,
+				DisableKeepAlives:   tr.DisableKeepAlives,
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("unexpected transport settings (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func BenchmarkHTTPFetcherFetch(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/elgato/accessory-info":
+			_, _ = io.WriteString(w, `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}`)
+		case "/elgato/lights":
+			_, _ = io.WriteString(w, `{"numberOfLights":1,"lights":[{"on":1,"brightness":20,"temperature":280}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		auth AuthHook
+	}{
+		{
+			name: "cached client",
+		},
+		{
+			// An AuthHook requires a new client for each fetch.
+			name: "new client",
+			auth: func(_ context.Context, _ *http.Client, _ string) error { return nil },
+		},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			f := newHTTPFetcher(&config{authHook: tt.auth})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Fetch(context.Background(), srv.URL); err != nil {
+					b.Fatalf("failed to fetch: %v", err)
+				}
+			}
+		})
+	}
+}
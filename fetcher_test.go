@@ -0,0 +1,950 @@
+package keylightexporter_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerHTTPProto(t *testing.T) {
+	// httptest.Server always speaks HTTP/1.1, so emulate a device which only
+	// speaks HTTP/1.0 using a raw TCP listener.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	bodies := map[string]string{
+		"/elgato/accessory-info": `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}`,
+		"/elgato/lights":         `{"numberOfLights":0,"lights":[]}`,
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				r, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+
+				body := bodies[r.URL.Path]
+				_, _ = fmt.Fprintf(c,
+					"HTTP/1.0 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
+					len(body), body,
+				)
+			}()
+		}
+	}()
+
+	b := testBody(t, testHandler(t, nil, ln.Addr().String()))
+
+	const proto = `keylight_device_http_proto_info{proto="HTTP/1.0",serial="1111"} 1`
+	if !bytes.Contains(b, []byte(proto)) {
+		t.Fatalf("HTTP protocol metric was not found: %s", proto)
+	}
+
+	if !matchDevice(t, b, []string{
+		proto,
+		upMetric(true, "http://"+ln.Addr().String()),
+		`keylight_info{address="` + "http://" + ln.Addr().String() + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="1111"} 1`,
+		`keylight_lights{serial="1111"} 0`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
+
+func TestHandlerSettingsSerialFallback(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/elgato/accessory-info", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, `{"displayName":"test","firmwareVersion":"1.0.0"}`)
+	})
+	mux.HandleFunc("/elgato/lights/settings", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, `{"serialNumber":"2222"}`)
+	})
+	mux.HandleFunc("/elgato/lights", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, `{"numberOfLights":0,"lights":[]}`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	b := testBody(t, testHandler(t, nil, srv.URL))
+
+	if !matchDevice(t, b, []string{
+		`keylight_up{serial="2222",target="` + srv.URL + `"} 1`,
+		`keylight_info{address="` + srv.URL + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="2222"} 1`,
+		`keylight_lights{serial="2222"} 0`,
+		`keylight_device_http_proto_info{proto="HTTP/1.1",serial="2222"} 1`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
+
+func TestHandlerPartialFetch(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []keylightexporter.Option
+	}{
+		{name: "sequential"},
+		{
+			name: "concurrent",
+			opts: []keylightexporter.Option{keylightexporter.WithConcurrentFetch()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/elgato/accessory-info", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}`)
+			})
+			mux.HandleFunc("/elgato/lights", func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			})
+
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			b := testBody(t, testHandler(t, nil, srv.URL, tt.opts...))
+
+			// The device information is exported even though the lights
+			// could not be fetched, but the device is reported as down.
+			if !matchDevice(t, b, []string{
+				`keylight_up{serial="1111",target="` + srv.URL + `"} 0`,
+				`keylight_info{address="` + srv.URL + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="1111"} 1`,
+				`keylight_device_http_proto_info{proto="HTTP/1.1",serial="1111"} 1`,
+				`keylight_scrape_errors_total{reason="other"} 1`,
+			}) {
+				t.Fatal("failed to match Prometheus metrics")
+			}
+		})
+	}
+}
+
+func TestHandlerWiFiSignal(t *testing.T) {
+	tests := []struct {
+		name, info string
+		rssi       string
+	}{
+		{
+			name: "reported",
+			info: `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111","wifi-info":{"ssid":"test","frequencyMHz":2400,"rssi":-48}}`,
+			rssi: `keylight_wifi_signal_dbm{serial="1111"} -48`,
+		},
+		{
+			name: "not reported",
+			info: `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var infos atomic.Int32
+			mux := http.NewServeMux()
+			mux.HandleFunc("/elgato/accessory-info", func(w http.ResponseWriter, _ *http.Request) {
+				infos.Add(1)
+				_, _ = io.WriteString(w, tt.info)
+			})
+			mux.HandleFunc("/elgato/lights", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, `{"numberOfLights":0,"lights":[]}`)
+			})
+
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			b := testBody(t, testHandler(t, nil, srv.URL, keylightexporter.WithWiFiSignal()))
+
+			metrics := []string{
+				upMetric(true, srv.URL),
+				`keylight_info{address="` + srv.URL + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="1111"} 1`,
+				`keylight_lights{serial="1111"} 0`,
+				`keylight_device_http_proto_info{proto="HTTP/1.1",serial="1111"} 1`,
+			}
+			if tt.rssi != "" {
+				if !bytes.Contains(b, []byte(tt.rssi)) {
+					t.Fatalf("WiFi signal metric was not found: %s", tt.rssi)
+				}
+
+				metrics = append(metrics, tt.rssi)
+			}
+
+			// The series is omitted entirely when no signal is reported.
+			if !matchDevice(t, b, metrics) {
+				t.Fatal("failed to match Prometheus metrics")
+			}
+
+			// The signal is parsed from the accessory information which was
+			// already fetched.
+			if diff := cmp.Diff(int32(1), infos.Load()); diff != "" {
+				t.Fatalf("unexpected number of accessory information requests (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerTemperatureLimits(t *testing.T) {
+	tests := []struct {
+		name, settings string
+		limits         []string
+	}{
+		{
+			name:     "reported",
+			settings: `{"powerOnTemperature":213,"temperatureMin":143,"temperatureMax":344}`,
+			limits: []string{
+				`keylight_light_temperature_min_kelvin{serial="1111"} 2900`,
+				`keylight_light_temperature_max_kelvin{serial="1111"} 7000`,
+			},
+		},
+		{
+			name:     "not reported",
+			settings: `{"powerOnTemperature":213}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/elgato/accessory-info", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}`)
+			})
+			mux.HandleFunc("/elgato/lights", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, `{"numberOfLights":0,"lights":[]}`)
+			})
+			mux.HandleFunc("/elgato/lights/settings", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, tt.settings)
+			})
+
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			b := testBody(t, testHandler(t, nil, srv.URL, keylightexporter.WithTemperatureLimits()))
+
+			// The series are omitted entirely when no limits are reported.
+			if !matchDevice(t, b, append([]string{
+				upMetric(true, srv.URL),
+				`keylight_info{address="` + srv.URL + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="1111"} 1`,
+				`keylight_lights{serial="1111"} 0`,
+				`keylight_device_http_proto_info{proto="HTTP/1.1",serial="1111"} 1`,
+			}, tt.limits...)) {
+				t.Fatal("failed to match Prometheus metrics")
+			}
+		})
+	}
+}
+
+func TestNewHTTPFetcher(t *testing.T) {
+	// Serve device requests from memory using a custom transport, so that no
+	// socket is required to reach the device.
+	var hosts []string
+	device := testDeviceHandler(func(r *http.Request) {
+		hosts = append(hosts, r.Host)
+	})
+
+	c := &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			w := httptest.NewRecorder()
+			device.ServeHTTP(w, r)
+			return w.Result(), nil
+		}),
+	}
+
+	f := keylightexporter.NewHTTPFetcher(c)
+
+	d, err := f.Fetch(context.Background(), "http://foo:9123")
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+
+	if diff := cmp.Diff("1111", d.Device.SerialNumber); diff != "" {
+		t.Fatalf("unexpected serial (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(1, len(d.Lights)); diff != "" {
+		t.Fatalf("unexpected number of lights (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"foo:9123", "foo:9123"}, hosts); diff != "" {
+		t.Fatalf("unexpected device requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewHTTPFetcherDefault(t *testing.T) {
+	device := testDevice(t, nil)
+
+	b := testBody(t, testHandler(t, keylightexporter.NewHTTPFetcher(nil), device.URL))
+
+	if !matchDevice(t, b, []string{
+		upMetric(true, device.URL),
+		`keylight_info{address="` + device.URL + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="1111"} 1`,
+		`keylight_lights{serial="1111"} 1`,
+		`keylight_device_http_proto_info{proto="HTTP/1.1",serial="1111"} 1`,
+		`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+		`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+		`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
+
+func TestHandlerUserAgent(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		agents []string
+	)
+
+	device := httptest.NewServer(testDeviceHandler(func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		agents = append(agents, r.UserAgent())
+	}))
+	defer device.Close()
+
+	_ = testBody(t, testHandler(t, nil, device.URL))
+
+	// The User-Agent uses the same version as the build information.
+	want := "keylight_exporter/" + strings.Fields(keylightexporter.Version())[1]
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff([]string{want, want}, agents); diff != "" {
+		t.Fatalf("unexpected User-Agent headers (-want +got):\n%s", diff)
+	}
+}
+
+func TestHTTPFetcherTimings(t *testing.T) {
+	const (
+		dialDelay    = 100 * time.Millisecond
+		requestDelay = 50 * time.Millisecond
+	)
+
+	// Delay both the connection to the device and each of its responses, so
+	// that the time spent connecting and transferring can be told apart.
+	device := httptest.NewServer(testDeviceHandler(func(_ *http.Request) {
+		time.Sleep(requestDelay)
+	}))
+	defer device.Close()
+
+	var dialer net.Dialer
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				time.Sleep(dialDelay)
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	d, err := keylightexporter.NewHTTPFetcher(c).Fetch(context.Background(), device.URL)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+
+	// The device information and lights are fetched over a single connection.
+	if d.ConnectDuration < dialDelay {
+		t.Fatalf("connect duration %s is less than dial delay %s", d.ConnectDuration, dialDelay)
+	}
+	if d.TransferDuration < 2*requestDelay {
+		t.Fatalf("transfer duration %s is less than request delays %s", d.TransferDuration, 2*requestDelay)
+	}
+
+	b := testBody(t, testHandler(t, keylightexporter.NewHTTPFetcher(c), device.URL))
+
+	for _, m := range []string{
+		`keylight_scrape_connect_seconds{serial="1111"} `,
+		`keylight_scrape_transfer_seconds{serial="1111"} `,
+	} {
+		if !bytes.Contains(b, []byte(m)) {
+			t.Fatalf("timing metric was not found: %s", m)
+		}
+	}
+}
+
+// A roundTripperFunc adapts a function into an http.RoundTripper.
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return fn(r) }
+
+func TestHandlerDNSCache(t *testing.T) {
+	device := testDevice(t, nil)
+
+	// Scrape the device by hostname so that it must be resolved.
+	u, err := url.Parse(device.URL)
+	if err != nil {
+		t.Fatalf("failed to parse URL: %v", err)
+	}
+	u.Host = net.JoinHostPort("localhost", u.Port())
+
+	srv := testServer(t, nil, keylightexporter.WithDNSCache(time.Minute))
+	for i := 0; i < 2; i++ {
+		b := testBody(t, testGet(t, srv, u.String()))
+
+		up := upMetric(true, u.String())
+		if !bytes.Contains(b, []byte(up)) {
+			t.Fatalf("up metric was not found: %s", up)
+		}
+	}
+}
+
+func TestHandlerSlowDevice(t *testing.T) {
+	// The device takes longer to respond than the timeout of the keylight
+	// client's default HTTP client.
+	device := testDevice(t, func(r *http.Request) {
+		if r.URL.Path == "/elgato/accessory-info" {
+			time.Sleep(2500 * time.Millisecond)
+		}
+	})
+
+	srv := testServer(t, nil, keylightexporter.WithTimeout(10*time.Second))
+
+	c := &http.Client{Timeout: 15 * time.Second}
+	res, err := c.Get(srv.URL + "?target=" + url.QueryEscape(device.URL))
+	if err != nil {
+		t.Fatalf("failed to perform HTTP request: %v", err)
+	}
+
+	b := testBody(t, res)
+	if up := upMetric(true, device.URL); !bytes.Contains(b, []byte(up)) {
+		t.Fatalf("up metric was not found: %s\n%s", up, b)
+	}
+}
+
+func TestHandlerConnectTimeout(t *testing.T) {
+	const connectTimeout = 100 * time.Millisecond
+
+	srv := testServer(t, nil,
+		keylightexporter.WithTimeout(5*time.Second),
+		keylightexporter.WithConnectTimeout(connectTimeout),
+	)
+
+	// Connections to this non-routable address are typically dropped rather
+	// than refused, so only the connect timeout bounds the scrape.
+	start := time.Now()
+	b := testBody(t, testGet(t, srv, "10.255.255.1"))
+	elapsed := time.Since(start)
+
+	up := `keylight_up{serial="",target="http://10.255.255.1:9123"} 0`
+	if !bytes.Contains(b, []byte(up)) {
+		t.Fatalf("up metric was not found: %s", up)
+	}
+
+	if elapsed > 10*connectTimeout {
+		t.Fatalf("scrape took %s, expected it to fail within the connect timeout of %s", elapsed, connectTimeout)
+	}
+}
+
+func TestHandlerMaxBodySize(t *testing.T) {
+	const limit = 1024
+
+	tests := []struct {
+		name string
+		// chunked omits the Content-Length so the body must be read to
+		// detect that it is too large.
+		chunked bool
+	}{
+		{name: "Content-Length"},
+		{name: "chunked", chunked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				// A valid JSON document which is larger than the limit.
+				body := `{"displayName":"` + strings.Repeat("a", 4*limit) + `","serialNumber":"1111"}`
+				if !tt.chunked {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				}
+
+				// Stream the body in pieces.
+				for i := 0; i < len(body); i += limit / 4 {
+					_, _ = io.WriteString(w, body[i:min(len(body), i+limit/4)])
+					w.(http.Flusher).Flush()
+				}
+			}))
+			defer srv.Close()
+
+			b := testBody(t, testHandler(t, nil, srv.URL, keylightexporter.WithMaxBodySize(limit)))
+
+			for _, s := range []string{
+				upMetric(false, srv.URL),
+				`keylight_scrape_errors_total{reason="body_too_large"} 1`,
+			} {
+				if !bytes.Contains(b, []byte(s+"\n")) {
+					t.Fatalf("series was not found: %s", s)
+				}
+			}
+		})
+	}
+
+	// Bodies within the limit are read normally.
+	device := httptest.NewServer(testDeviceHandler(nil))
+	defer device.Close()
+
+	b := testBody(t, testHandler(t, nil, device.URL, keylightexporter.WithMaxBodySize(limit)))
+	if up := upMetric(true, device.URL); !bytes.Contains(b, []byte(up)) {
+		t.Fatalf("up metric was not found: %s", up)
+	}
+}
+
+func TestHandlerMinRequestInterval(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+
+	device := httptest.NewServer(testDeviceHandler(func(_ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+	}))
+	defer device.Close()
+
+	b := testBody(t, testHandler(t, nil, device.URL,
+		keylightexporter.WithTimeout(5*time.Second),
+		keylightexporter.WithMinRequestInterval(interval),
+	))
+	if up := upMetric(true, device.URL); !bytes.Contains(b, []byte(up)) {
+		t.Fatalf("up metric was not found: %s", up)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The device information and lights are requested separately.
+	if len(times) != 2 {
+		t.Fatalf("expected 2 requests, but got %d", len(times))
+	}
+	if gap := times[1].Sub(times[0]); gap < interval {
+		t.Fatalf("requests were spaced by %s, expected at least %s", gap, interval)
+	}
+}
+
+func TestHandlerTLSServerName(t *testing.T) {
+	// The device certificate is only valid for a hostname, but the device is
+	// addressed by IP.
+	const name = "keylight.example"
+	cert := testCertificate(t, name, time.Now().Add(1*time.Hour))
+
+	device := httptest.NewUnstartedServer(testDeviceHandler(nil))
+	device.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	device.StartTLS()
+	defer device.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	tests := []struct {
+		name       string
+		serverName string
+		ok         bool
+	}{
+		{
+			name: "no server name",
+		},
+		{
+			name:       "server name",
+			serverName: name,
+			ok:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBody(t, testHandler(t, nil, device.URL, keylightexporter.WithTLSConfig(&tls.Config{
+				RootCAs:    roots,
+				ServerName: tt.serverName,
+			})))
+
+			if up := upMetric(tt.ok, device.URL); !bytes.Contains(b, []byte(up)) {
+				t.Fatalf("up metric was not found: %s", up)
+			}
+		})
+	}
+}
+
+func TestHandlerBasePath(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+
+	// The device API is only served under a prefix, as by a reverse proxy.
+	mux := http.NewServeMux()
+	mux.Handle("/keylight/", http.StripPrefix("/keylight", testDeviceHandler(nil)))
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+
+		mux.ServeHTTP(w, r)
+	})
+
+	tests := []struct {
+		name   string
+		tls    bool
+		prefix string
+		opts   []keylightexporter.Option
+		ok     bool
+	}{
+		{
+			name:   "no prefix",
+			prefix: "",
+		},
+		{
+			name:   "prefix",
+			prefix: "/keylight",
+			ok:     true,
+		},
+		{
+			name:   "prefix slashes",
+			prefix: "keylight/",
+			ok:     true,
+		},
+		{
+			name:   "force HTTPS",
+			tls:    true,
+			prefix: "/keylight",
+			opts: []keylightexporter.Option{
+				keylightexporter.WithForceScheme("https"),
+				keylightexporter.WithInsecureSkipVerify(true),
+			},
+			ok: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+
+			device := httptest.NewUnstartedServer(h)
+			if tt.tls {
+				device.StartTLS()
+			} else {
+				device.Start()
+			}
+			defer device.Close()
+
+			// The target always uses HTTP, so a forced scheme is required to
+			// reach a TLS device.
+			target := strings.Replace(device.URL, "https://", "http://", 1)
+
+			opts := append([]keylightexporter.Option{keylightexporter.WithBasePath(tt.prefix)}, tt.opts...)
+			b := testBody(t, testHandler(t, nil, target, opts...))
+
+			// Device addresses are reported as specified by the target.
+			if up := upMetric(tt.ok, target); !bytes.Contains(b, []byte(up+"\n")) {
+				t.Fatalf("up metric was not found: %s\n%s", up, b)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(paths) == 0 {
+				t.Fatal("no requests reached the device")
+			}
+			for _, p := range paths {
+				if want := "/keylight/elgato/"; tt.ok && !strings.HasPrefix(p, want) {
+					t.Fatalf("request path %q does not have prefix %q", p, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerInsecureSkipVerify(t *testing.T) {
+	// The device uses a self-signed certificate which is not trusted by
+	// default.
+	device := httptest.NewTLSServer(testDeviceHandler(nil))
+	defer device.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(device.Certificate())
+
+	tests := []struct {
+		name string
+		opts []keylightexporter.Option
+		ok   bool
+	}{
+		{
+			name: "verify",
+		},
+		{
+			name: "skip verify",
+			opts: []keylightexporter.Option{keylightexporter.WithInsecureSkipVerify(true)},
+			ok:   true,
+		},
+		{
+			name: "root CAs",
+			opts: []keylightexporter.Option{keylightexporter.WithRootCAs(roots)},
+			ok:   true,
+		},
+		{
+			name: "overrides TLS config",
+			opts: []keylightexporter.Option{
+				keylightexporter.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+				keylightexporter.WithInsecureSkipVerify(false),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBody(t, testHandler(t, nil, device.URL, tt.opts...))
+
+			if up := upMetric(tt.ok, device.URL); !bytes.Contains(b, []byte(up)) {
+				t.Fatalf("up metric was not found: %s", up)
+			}
+		})
+	}
+}
+
+// testCertificate generates a self-signed TLS certificate valid for the DNS
+// name until notAfter.
+func testCertificate(t *testing.T, name string, notAfter time.Time) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestHandlerConcurrentFetch(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	started := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(started)
+	}()
+
+	// Each device request blocks until both requests have started, so the
+	// scrape can only succeed if the requests are issued concurrently.
+	device := testDevice(t, func(r *http.Request) {
+		if r.URL.Path != "/elgato/accessory-info" && r.URL.Path != "/elgato/lights" {
+			return
+		}
+
+		wg.Done()
+		select {
+		case <-started:
+		case <-time.After(1 * time.Second):
+			panicf("timed out waiting for concurrent request to %q", r.URL.Path)
+		}
+	})
+
+	b := testBody(t, testHandler(t, nil, device.URL, keylightexporter.WithConcurrentFetch()))
+
+	if !matchDevice(t, b, []string{
+		upMetric(true, device.URL),
+		`keylight_info{address="` + device.URL + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="1111"} 1`,
+		`keylight_lights{serial="1111"} 1`,
+		`keylight_device_http_proto_info{proto="HTTP/1.1",serial="1111"} 1`,
+		`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+		`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+		`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
+
+func TestHandlerConcurrentFetchInFlight(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []keylightexporter.Option
+		peak int
+	}{
+		{
+			name: "sequential",
+			peak: 1,
+		},
+		{
+			name: "concurrent",
+			opts: []keylightexporter.Option{keylightexporter.WithConcurrentFetch()},
+			peak: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu           sync.Mutex
+				active, peak int
+
+				both = make(chan struct{})
+			)
+
+			// Track the number of device requests in flight. When fetching
+			// concurrently, each request blocks until both are in flight, so
+			// that they overlap however the requests are scheduled.
+			device := testDevice(t, func(r *http.Request) {
+				if r.URL.Path != "/elgato/accessory-info" && r.URL.Path != "/elgato/lights" {
+					return
+				}
+
+				mu.Lock()
+				active++
+				if active > peak {
+					peak = active
+				}
+				if active == 2 {
+					close(both)
+				}
+				mu.Unlock()
+
+				defer func() {
+					mu.Lock()
+					defer mu.Unlock()
+					active--
+				}()
+
+				if tt.peak < 2 {
+					return
+				}
+
+				select {
+				case <-both:
+				case <-time.After(1 * time.Second):
+					panicf("timed out waiting for concurrent request to %q", r.URL.Path)
+				}
+			})
+
+			srv := testServer(t, nil, tt.opts...)
+			b := testBody(t, testGet(t, srv, device.URL))
+			if up := upMetric(true, device.URL); !bytes.Contains(b, []byte(up)) {
+				t.Fatalf("up metric was not found: %s", up)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if diff := cmp.Diff(tt.peak, peak); diff != "" {
+				t.Fatalf("unexpected peak device requests in flight (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerAuthHook(t *testing.T) {
+	const session = "abc123"
+
+	device := testDeviceHandler(nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: session})
+			return
+		}
+
+		if c, err := r.Cookie("session"); err != nil || c.Value != session {
+			http.Error(w, "missing session", http.StatusUnauthorized)
+			return
+		}
+
+		device.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	login := func(ctx context.Context, c *http.Client, addr string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr+"/login", nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+
+		return res.Body.Close()
+	}
+
+	tests := []struct {
+		name string
+		opts []keylightexporter.Option
+		ok   bool
+	}{
+		{
+			name: "no hook",
+		},
+		{
+			name: "hook",
+			opts: []keylightexporter.Option{keylightexporter.WithAuthHook(login)},
+			ok:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBody(t, testHandler(t, nil, srv.URL, tt.opts...))
+
+			if up := upMetric(tt.ok, srv.URL); !bytes.Contains(b, []byte(up)) {
+				t.Fatalf("up metric was not found: %s", up)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package keylightexporter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	_ prometheus.Gatherer = &labelGatherer{}
+	_ prometheus.Gatherer = &timestampGatherer{}
+)
+
+// A labelGatherer is a prometheus.Gatherer which attaches a fixed set of
+// labels to every metric gathered by an underlying prometheus.Gatherer.
+type labelGatherer struct {
+	g      prometheus.Gatherer
+	labels prometheus.Labels
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *labelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.g.Gather()
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.Label = addLabels(m.Label, g.labels)
+		}
+	}
+
+	return mfs, err
+}
+
+// addLabels adds labels to the label pairs in lps, sorted by name. Labels which
+// are already present in lps take precedence, like Prometheus external labels.
+func addLabels(lps []*dto.LabelPair, labels prometheus.Labels) []*dto.LabelPair {
+	present := make(map[string]struct{}, len(lps))
+	for _, lp := range lps {
+		present[lp.GetName()] = struct{}{}
+	}
+
+	for k, v := range labels {
+		if _, ok := present[k]; ok {
+			continue
+		}
+
+		k, v := k, v
+		lps = append(lps, &dto.LabelPair{Name: &k, Value: &v})
+	}
+
+	sort.Slice(lps, func(i, j int) bool {
+		return lps[i].GetName() < lps[j].GetName()
+	})
+
+	return lps
+}
+
+// A timestampGatherer is a prometheus.Gatherer which applies an explicit
+// timestamp to every metric gathered by an underlying prometheus.Gatherer.
+type timestampGatherer struct {
+	g         prometheus.Gatherer
+	timestamp func() time.Time
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *timestampGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.g.Gather()
+
+	ts := g.timestamp()
+	if ts.IsZero() {
+		// No timestamp available, use the scrape time.
+		return mfs, err
+	}
+
+	ms := ts.UnixMilli()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.TimestampMs = &ms
+		}
+	}
+
+	return mfs, err
+}
@@ -0,0 +1,154 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerExternalLabels(t *testing.T) {
+	srv := testServer(t, testDataFetcher(),
+		keylightexporter.WithDebug(),
+		keylightexporter.WithExternalLabels(prometheus.Labels{
+			"exporter": "office",
+			// Existing labels must not be overwritten.
+			"serial": "bad",
+		}),
+	)
+
+	// The debug counter appears after the first request completes.
+	_ = testBody(t, testGet(t, srv, "foo"))
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	const series = `keylight_exporter_series_emitted_total{exporter="office",serial="1111"} 16`
+	if !bytes.Contains(b, []byte(series)) {
+		t.Fatalf("exporter series with external labels was not found: %s", series)
+	}
+
+	match := []string{
+		`keylight_up{exporter="office",serial="1111",target="http://foo:9123"} 1`,
+		`keylight_info{address="http://foo:9123",exporter="office",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`,
+		`keylight_firmware_build_number{exporter="office",serial="1111"} 192`,
+		`keylight_lights{exporter="office",serial="1111"} 2`,
+		`keylight_light_on{exporter="office",light="light0",name="test",serial="1111"} 1`,
+		`keylight_light_brightness_percent{exporter="office",light="light0",name="test",serial="1111"} 20`,
+		`keylight_light_brightness_ratio{exporter="office",light="light0",name="test",serial="1111"} 0.2`,
+		`keylight_light_color_temperature_kelvin{exporter="office",light="light0",name="test",serial="1111"} 4200`,
+		`keylight_light_color_temperature_mireds{exporter="office",light="light0",name="test",serial="1111"} 238.0952380952381`,
+		`keylight_light_on{exporter="office",light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_brightness_percent{exporter="office",light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_brightness_ratio{exporter="office",light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_color_temperature_kelvin{exporter="office",light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_color_temperature_mireds{exporter="office",light="light1",name="test",serial="1111"} 0`,
+	}
+
+	if !matchDevice(t, b, match) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
+
+func TestHandlerRequestLabels(t *testing.T) {
+	srv := testServer(t, testDataFetcher(),
+		keylightexporter.WithExternalLabels(prometheus.Labels{"room": "default"}),
+	)
+
+	tests := []struct {
+		name, query string
+		code        int
+		series      string
+	}{
+		{
+			name:   "OK",
+			query:  "?target=foo&label_room=office&label_floor=2",
+			code:   http.StatusOK,
+			series: `keylight_light_on{floor="2",light="light0",name="test",room="office",serial="1111"} 1`,
+		},
+		{
+			name:   "existing label",
+			query:  "?target=foo&label_serial=bad",
+			code:   http.StatusOK,
+			series: `keylight_light_on{light="light0",name="test",room="default",serial="1111"} 1`,
+		},
+		{
+			name:  "invalid name",
+			query: "?target=foo&label_1room=office",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "reserved name",
+			query: "?target=foo&label___name__=office",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "duplicate",
+			query: "?target=foo&label_room=office&label_room=kitchen",
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Get(srv.URL + tt.query)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+
+			if tt.code != http.StatusOK {
+				_ = res.Body.Close()
+				if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+					t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			if b := testBody(t, res); !bytes.Contains(b, []byte(tt.series+"\n")) {
+				t.Fatalf("series with request labels was not found: %s", tt.series)
+			}
+		})
+	}
+}
+
+func TestHandlerDeviceTimestamps(t *testing.T) {
+	ts := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			d := testData()
+			d.Timestamp = ts
+			return d, nil
+		},
+	}, keylightexporter.WithDeviceTimestamps())
+
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	if !matchDevice(t, b, []string{
+		`keylight_up{serial="1111",target="http://foo:9123"} 1 1577836800000`,
+		`keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1 1577836800000`,
+		`keylight_firmware_build_number{serial="1111"} 192 1577836800000`,
+		`keylight_lights{serial="1111"} 2 1577836800000`,
+		`keylight_light_on{light="light0",name="test",serial="1111"} 1 1577836800000`,
+		`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20 1577836800000`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2 1577836800000`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200 1577836800000`,
+		`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381 1577836800000`,
+		`keylight_light_on{light="light1",name="test",serial="1111"} 0 1577836800000`,
+		`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0 1577836800000`,
+		`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0 1577836800000`,
+		`keylight_light_color_temperature_kelvin{light="light1",name="test",serial="1111"} 0 1577836800000`,
+		`keylight_light_color_temperature_mireds{light="light1",name="test",serial="1111"} 0 1577836800000`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+
+	// Exporter metrics are unaffected by device timestamps.
+	const count = "keylight_exporter_brightness_distribution_count 1\n"
+	if !bytes.Contains(b, []byte(count)) {
+		t.Fatalf("exporter series without timestamp was not found: %s", count)
+	}
+}
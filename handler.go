@@ -2,18 +2,30 @@ package keylightexporter
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/mdlayher/keylight"
 	"github.com/mdlayher/metricslite"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -21,11 +33,64 @@ const (
 	// devices.
 	keylightPort = "9123"
 
+	// defaultTimeout is the default timeout for each scrape when neither the
+	// handler nor Prometheus specify one.
+	defaultTimeout = 5 * time.Second
+
+	// defaultTargetConcurrency is the default number of devices which may be
+	// fetched concurrently by a single request.
+	defaultTargetConcurrency = 8
+
+	// defaultMaxTargetsPerRequest is the default maximum number of
+	// comma-separated targets which may be specified by a single request.
+	defaultMaxTargetsPerRequest = 100
+
+	// probePath is the prefix of HTTP paths which specify the target as a
+	// path segment rather than a query parameter.
+	probePath = "/probe/"
+
 	// Prometheus metric names.
+	klUp                          = "keylight_up"
 	klInfo                        = "keylight_info"
+	klScrapeDurationSeconds       = "keylight_scrape_duration_seconds"
+	klDeviceHTTPProtoInfo         = "keylight_device_http_proto_info"
+	klWiFiSignalDBM               = "keylight_wifi_signal_dbm"
+	klDeviceBootTimeSeconds       = "keylight_device_boot_time_seconds"
+	klFirmwareBuildNumber         = "keylight_firmware_build_number"
+	klLights                      = "keylight_lights"
+	klScrapeConnectSeconds        = "keylight_scrape_connect_seconds"
+	klScrapeTransferSeconds       = "keylight_scrape_transfer_seconds"
+	klCacheAgeSeconds             = "keylight_cache_age_seconds"
+	klDataStale                   = "keylight_data_stale"
+	klLightTemperatureMinKelvin   = "keylight_light_temperature_min_kelvin"
+	klLightTemperatureMaxKelvin   = "keylight_light_temperature_max_kelvin"
 	klLightOn                     = "keylight_light_on"
 	klLightBrightnessPercent      = "keylight_light_brightness_percent"
+	klLightBrightnessRatio        = "keylight_light_brightness_ratio"
 	klLightColorTemperatureKelvin = "keylight_light_color_temperature_kelvin"
+	klLightColorTemperatureMireds = "keylight_light_color_temperature_mireds"
+	klLightPowerWatts             = "keylight_light_power_watts"
+	klLightDrift                  = "keylight_light_drift"
+	klCircuitOpen                 = "keylight_circuit_open"
+	klScrapeConsecutiveFailures   = "keylight_scrape_consecutive_failures"
+	klLastSuccessTimestampSeconds = "keylight_last_success_timestamp_seconds"
+
+	// Exporter metric names.
+	kleBuildInfo                    = "keylight_exporter_build_info"
+	kleBrightnessDistribution       = "keylight_exporter_brightness_distribution"
+	kleLabelValuesSanitizedTotal    = "keylight_exporter_label_values_sanitized_total"
+	kleHighCardinalityWarningsTotal = "keylight_exporter_high_cardinality_warnings_total"
+	kleRequestsTotal                = "keylight_exporter_requests_total"
+	kleRequestsInFlight             = "keylight_exporter_requests_in_flight"
+	kleScrapeTimeoutSeconds         = "keylight_exporter_scrape_timeout_seconds"
+	kleScrapeRetriesTotal           = "keylight_exporter_scrape_retries_total"
+	kleSampleAgeSeconds             = "keylight_exporter_sample_age_seconds"
+
+	// Exporter debugging metric names.
+	kleSeriesEmittedTotal = "keylight_exporter_series_emitted_total"
+
+	// Scrape error metric names.
+	klScrapeErrorsTotal = "keylight_scrape_errors_total"
 )
 
 var _ http.Handler = &handler{}
@@ -35,9 +100,113 @@ var _ http.Handler = &handler{}
 type handler struct {
 	f Fetcher
 
-	mu      sync.Mutex
-	mm      metricslite.Interface
-	metrics http.Handler
+	// reg and mm are shared by all targets for exporter-level metrics.
+	reg *prometheus.Registry
+	mm  metricslite.Interface
+
+	// raw serves raw device responses for debugging, if available.
+	raw http.Handler
+
+	// control changes the state of device lights, if enabled.
+	control *controller
+
+	// ns is the namespace of all metric names.
+	ns string
+
+	// discoverer finds devices on the local network, if enabled.
+	discoverer *Discoverer
+
+	// autoDiscover finds the devices scraped by requests which specify no
+	// target, if enabled.
+	autoDiscover *Discoverer
+
+	// targets stores a *target for each device address which has been
+	// scraped.
+	targets sync.Map
+
+	ll *slog.Logger
+
+	timeout          time.Duration
+	port             string
+	concurrency      int
+	maxTargets       int
+	sem              chan struct{}
+	changedOnly      bool
+	deviceTimestamps bool
+	maxWatts         float64
+	externalLabels   prometheus.Labels
+
+	brightness      prometheus.Histogram
+	labelsSanitized metricslite.Counter
+	scrapeErrors    metricslite.Counter
+
+	// Optional authentication of requests.
+	auth *basicAuth
+
+	// Optional restriction of the devices which may be scraped.
+	allowlist *targetAllowlist
+
+	// Optional cardinality tracking.
+	cardinality *cardinalityTracker
+
+	// Optional resolution of named targets.
+	names *NamedTargets
+
+	// Optional circuit breaker for repeatedly failing devices.
+	breaker *circuitFetcher
+
+	// Optional background polling of devices. mu protects discovered, the
+	// devices found by the most recent poll if automatic discovery is
+	// enabled.
+	poller     *pollingFetcher
+	mu         sync.Mutex
+	discovered []string
+
+	// now reports the current time, and is shared with each time-dependent
+	// Fetcher.
+	now func() time.Time
+
+	// successMu protects successes, the time of the most recent successful
+	// fetch of each device by serial.
+	successMu sync.Mutex
+	successes map[string]time.Time
+
+	// Optional debugging metrics.
+	seriesEmitted metricslite.Counter
+}
+
+// A target holds the state retained between scrapes of a single device
+// address.
+type target struct {
+	mu sync.Mutex
+
+	// lights stores the last emitted state of each light when only changed
+	// lights are emitted.
+	lights []keylight.Light
+
+	// failures is the number of consecutive scrapes for which the device has
+	// been down.
+	failures int
+
+	// serial is the serial number of the device most recently fetched
+	// successfully from the address, if any.
+	serial string
+}
+
+// changed reports which of the lights in d have changed since the last call
+// to changed, and records their current state. The caller must hold t.mu.
+func (t *target) changed(d *Data) []bool {
+	changed := make([]bool, len(d.Lights))
+	for i, l := range d.Lights {
+		changed[i] = i >= len(t.lights) || t.lights[i] != *l
+	}
+
+	t.lights = make([]keylight.Light, 0, len(d.Lights))
+	for _, l := range d.Lights {
+		t.lights = append(t.lights, *l)
+	}
+
+	return changed
 }
 
 // NewHandler returns an http.Handler that serves Prometheus metrics for Key
@@ -47,31 +216,424 @@ type handler struct {
 //
 // Each HTTP request must contain a "target" query parameter which indicates the
 // network address of the device which should be scraped for metrics. If no port
-// is specified, the Key Light device default of 9123 will be used.
-func NewHandler(reg *prometheus.Registry, f Fetcher) http.Handler {
+// is specified, the Key Light device default of 9123 will be used. Multiple
+// comma-separated devices may be specified to scrape them concurrently in a
+// single request, in which case each device's up metric reports whether it was
+// fetched successfully. Alternatively, the target may be specified as a path
+// segment, such as "/probe/192.168.1.5:9123", which behaves identically.
+//
+// By default, all device metrics are gathered. A request may instead select
+// which metrics are gathered using one or more "collect[]" query parameters,
+// such as "collect[]=on&collect[]=brightness". The collectors are "device",
+// "on", "brightness", "temperature", "power", and "drift". Metrics which
+// describe the scrape itself, such as keylight_up, are always gathered.
+//
+// The handler also serves a JSON summary of the device specified by the
+// "target" query parameter at "/inventory", and the normalized addresses of
+// the devices which would be scraped for the "target" query parameter at
+// "/validate", without contacting any devices.
+//
+// Options may be specified to further configure the handler and the default
+// HTTP fetcher. If debugging is enabled with the default HTTP fetcher, the
+// handler also serves the most recent raw responses from the device specified
+// by the "target" query parameter at "/debug/raw". If discovery is enabled,
+// the handler serves a JSON list of the devices on the local network at
+// "/discover". If auto discovery is enabled, requests which specify no target
+// scrape all of the devices on the local network. If named targets or
+// discovery are enabled, the handler serves the known targets in the JSON
+// format of Prometheus HTTP service discovery at "/targets". If control is
+// enabled, the handler changes the state of the lights on devices in response
+// to POST requests at "/control".
+func NewHandler(reg *prometheus.Registry, f Fetcher, opts ...Option) http.Handler {
+	var cfg config
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	var (
+		raw  http.Handler
+		ctrl *controller
+	)
 	if f == nil {
-		f = httpFetcher{}
+		hf := newHTTPFetcher(&cfg)
+		if hf.raw != nil {
+			raw = hf.raw
+		}
+		if cfg.control {
+			ctrl = &controller{f: hf}
+		}
+
+		f = hf
+	} else if cfg.control {
+		ctrl = &controller{f: newHTTPFetcher(&cfg)}
+	}
+
+	var retry *retryFetcher
+	if cfg.retryAttempts > 1 {
+		retry = newRetryFetcher(f, cfg.retryAttempts, cfg.retryBackoff)
+		f = retry
+	}
+
+	// Retried fetches count as a single failure, and cached data is served
+	// regardless of the circuit breaker.
+	var breaker *circuitFetcher
+	if cfg.circuitBreaker {
+		breaker = newCircuitFetcher(f, cfg.circuitFailures, cfg.circuitCooldown)
+		breaker.now = cfg.now()
+		f = breaker
+	}
+
+	// Cached failures are not counted again by the circuit breaker.
+	if cfg.negativeCacheTTL > 0 {
+		c := newNegativeCacheFetcher(f, cfg.negativeCacheTTL)
+		c.now = cfg.now()
+		f = c
+	}
+
+	if cfg.singleFlight {
+		f = newSingleFlightFetcher(f)
+	}
+
+	if cfg.cacheTTL > 0 {
+		c := NewStaleCachingFetcher(f, cfg.cacheTTL, cfg.cacheStale)
+		c.fallback = cfg.staleFallback
+		c.now = cfg.now()
+		f = c
+	}
+
+	ll := cfg.logger
+	if ll == nil {
+		ll = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	concurrency := cfg.targetConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultTargetConcurrency
+	}
+
+	maxTargets := cfg.maxTargets
+	if maxTargets <= 0 {
+		maxTargets = defaultMaxTargetsPerRequest
+	}
+
+	ns := cfg.namespace
+	if ns == "" {
+		ns = defaultNamespace
+	}
+
+	mm := withNamespace(metricslite.NewPrometheus(reg), ns)
+
+	h := &handler{
+		f:                f,
+		reg:              reg,
+		mm:               mm,
+		raw:              raw,
+		control:          ctrl,
+		ns:               ns,
+		discoverer:       cfg.discoverer,
+		ll:               ll,
+		timeout:          cfg.timeout,
+		port:             cfg.port(),
+		concurrency:      concurrency,
+		maxTargets:       maxTargets,
+		changedOnly:      cfg.changedOnly,
+		maxWatts:         cfg.maxWatts,
+		deviceTimestamps: cfg.deviceTimestamps,
+		externalLabels:   cfg.externalLabels,
+		breaker:          breaker,
+		names:            cfg.namedTargets,
+		now:              cfg.now(),
+		successes:        make(map[string]time.Time),
+
+		brightness: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    metricName(ns, kleBrightnessDistribution),
+			Help:    "The distribution of brightness percentages of all lights which are turned on.",
+			Buckets: prometheus.LinearBuckets(10, 10, 10),
+		}),
+	}
+
+	bi := readBuildInfo()
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: metricName(ns, kleBuildInfo),
+		Help: "Metadata about the build of the Elgato Key Light exporter.",
+		ConstLabels: prometheus.Labels{
+			"version":   bi.version,
+			"commit":    bi.commit,
+			"goversion": bi.goversion,
+		},
+	})
+	buildInfo.Set(1)
+
+	reg.MustRegister(buildInfo, h.brightness)
+
+	h.labelsSanitized = mm.Counter(
+		kleLabelValuesSanitizedTotal,
+		"The total number of device label values which were modified to remove invalid UTF-8 or control characters.",
+	)
+
+	h.scrapeErrors = mm.Counter(
+		klScrapeErrorsTotal,
+		"The total number of failures to fetch data from Elgato Key Light devices, partitioned by reason (timeout, connection, parse, circuit_open, body_too_large, or other).",
+		"reason",
+	)
+
+	if retry != nil {
+		retry.retries = mm.Counter(
+			kleScrapeRetriesTotal,
+			"The total number of times a failed fetch from an Elgato Key Light device was retried, partitioned by target.",
+			"target",
+		)
+	}
+
+	if cfg.debug {
+		h.seriesEmitted = mm.Counter(
+			kleSeriesEmittedTotal,
+			"The total number of metric series emitted for a given device, for debugging cardinality.",
+			"serial",
+		)
+	}
+
+	if cfg.basicAuthUser != "" {
+		h.auth = newBasicAuth(cfg.basicAuthUser, cfg.basicAuthHash)
+	}
+
+	if cfg.maxConcurrency > 0 {
+		h.sem = make(chan struct{}, cfg.maxConcurrency)
+	}
+
+	if cfg.autoDiscover {
+		h.autoDiscover = cfg.discoverer
+		if h.autoDiscover == nil {
+			h.autoDiscover = NewDiscoverer()
+		}
+	}
+
+	if len(cfg.allowedTargets) > 0 {
+		h.allowlist = newTargetAllowlist(cfg.allowedTargets)
+	}
+
+	if cfg.cardinalityLimit > 0 {
+		h.cardinality = newCardinalityTracker(cfg.cardinalityLimit, mm.Counter(
+			kleHighCardinalityWarningsTotal,
+			"The total number of scrapes which emitted new series beyond the configured cardinality limit.",
+		))
+	}
+
+	if cfg.pollInterval > 0 {
+		timeout := cfg.timeout
+		if timeout <= 0 {
+			timeout = min(defaultTimeout, cfg.pollInterval)
+		}
+
+		h.poller = newPollingFetcher(h.f, cfg.pollInterval, timeout)
+		h.poller.targets = h.pollTargets
+		h.poller.now = h.now
+		h.f = h.poller
+
+		// Samples are timestamped with the time of the poll which gathered
+		// them, rather than the time they are served.
+		h.deviceTimestamps = true
+
+		go h.poller.run(cfg.pollCtx)
 	}
 
-	mm := metricslite.NewPrometheus(reg)
+	// Instrument all requests to the handler, regardless of target.
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName(ns, kleRequestsTotal),
+		Help: "The total number of HTTP requests served by the Elgato Key Light exporter, partitioned by status code.",
+	}, []string{"code"})
+
+	inFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: metricName(ns, kleRequestsInFlight),
+		Help: "The number of HTTP requests currently being served by the Elgato Key Light exporter.",
+	})
+
+	reg.MustRegister(requests, inFlight)
+
+	var out http.Handler = promhttp.InstrumentHandlerInFlight(
+		inFlight,
+		promhttp.InstrumentHandlerCounter(requests, h),
+	)
+
+	if cfg.logger != nil {
+		out = logRequests(cfg.logger, out)
+	}
+
+	if cfg.accessLog != nil {
+		return newAccessLog(cfg.accessLog).wrap(out)
+	}
+
+	return out
+}
+
+// pollTargets returns the addresses of the configured and discovered devices
+// which are polled in the background.
+func (h *handler) pollTargets(ctx context.Context) []string {
+	var addrs []string
+	if h.names != nil {
+		addrs = append(addrs, h.names.addrs(h.port)...)
+	}
+
+	if h.autoDiscover != nil {
+		dctx, cancel := context.WithTimeout(ctx, h.poller.timeout/2)
+		defer cancel()
+
+		found, err := h.discoverTargets(dctx, ctx)
+		if err != nil {
+			// Continue polling the previously discovered devices.
+			h.ll.Warn("failed to discover devices", "err", err)
+
+			h.mu.Lock()
+			found = h.discovered
+			h.mu.Unlock()
+		}
+
+		h.mu.Lock()
+		h.discovered = found
+		h.mu.Unlock()
+
+		addrs = append(addrs, found...)
+	}
+
+	return addrs
+}
+
+// target returns the state for the device at addr, creating it if necessary.
+func (h *handler) target(addr string) *target {
+	if t, ok := h.targets.Load(addr); ok {
+		return t.(*target)
+	}
+
+	v, _ := h.targets.LoadOrStore(addr, &target{})
+	return v.(*target)
+}
+
+// lastSerial returns the serial number of the device most recently fetched
+// successfully from addr, or the empty string if there is none.
+func (h *handler) lastSerial(addr string) string {
+	t := h.target(addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.serial
+}
+
+// registerDeviceMetrics registers the const metrics for a single device
+// with mm.
+func registerDeviceMetrics(mm metricslite.Interface) {
+	mm.ConstGauge(
+		klUp,
+		"Reports whether all data was successfully fetched from an Elgato Key Light device (0: down, 1: up). The device is identified by its target address and its most recently fetched serial, which is empty if the device has never been fetched successfully.",
+		"serial", "target",
+	)
 
 	mm.ConstGauge(
 		klInfo,
-		"Metadata about an Elgato Key Light device.",
-		"firmware", "name", "serial",
+		"Metadata about an Elgato Key Light device. The device is identified by serial, while address is the target from which its data was fetched. The model is normalized from the product name or hardware board type, or is unknown if neither is recognized.",
+		"address", "firmware", "firmware_build", "hardware_board_type", "model", "name", "product", "serial",
+	)
+
+	mm.ConstGauge(
+		klScrapeDurationSeconds,
+		"The time in seconds taken to fetch data from an Elgato Key Light device.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klDeviceHTTPProtoInfo,
+		"The HTTP protocol version negotiated with an Elgato Key Light device.",
+		"proto", "serial",
+	)
+
+	mm.ConstGauge(
+		klWiFiSignalDBM,
+		"The signal strength in dBm of the WiFi connection of an Elgato Key Light device.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klDeviceBootTimeSeconds,
+		"The time at which an Elgato Key Light device last booted, in seconds since the UNIX epoch.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klFirmwareBuildNumber,
+		"The firmware build number of an Elgato Key Light device, for comparing firmware across devices.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klScrapeConnectSeconds,
+		"The time in seconds spent establishing connections to an Elgato Key Light device during a scrape.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klScrapeTransferSeconds,
+		"The time in seconds spent transferring data from an Elgato Key Light device once connected during a scrape.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klLightTemperatureMinKelvin,
+		"The minimum color temperature in Kelvin supported by the lights of an Elgato Key Light device, as reported by its light settings.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klLightTemperatureMaxKelvin,
+		"The maximum color temperature in Kelvin supported by the lights of an Elgato Key Light device, as reported by its light settings.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klCacheAgeSeconds,
+		"The age in seconds of the cached data for an Elgato Key Light device, if the data was served from a cache.",
+		"serial",
+	)
+
+	mm.ConstGauge(
+		klDataStale,
+		"Reports whether the cached data for an Elgato Key Light device was served because the device could not be fetched (0: fresh, 1: stale), if the data was served from a cache.",
+		"serial",
 	)
 
-	labels := []string{"light", "serial"}
+	mm.ConstGauge(
+		klCircuitOpen,
+		"Reports whether the circuit breaker for a target is open, so that it is reported as down without being fetched (0: closed, 1: open).",
+		"target",
+	)
+
+	mm.ConstGauge(
+		klScrapeConsecutiveFailures,
+		"The number of consecutive scrapes for which a target has been reported as down, reset to 0 when it is scraped successfully.",
+		"target",
+	)
+
+	mm.ConstGauge(
+		klLights,
+		"The number of lights reported by an Elgato Key Light device.",
+		"serial",
+	)
+
+	labels := []string{"light", "name", "serial"}
 
 	mm.ConstGauge(
 		klLightOn,
-		"Reports whether a given light on a device is turned on (0: off, 1: on).",
+		"Reports whether a given light on a device is turned on (0: off, 1: on), regardless of its brightness.",
 		labels...,
 	)
 
 	mm.ConstGauge(
 		klLightBrightnessPercent,
-		"The brightness percentage of a given light on a device.",
+		"The brightness of a given light on a device, as a percentage from 0 to 100. Devices accept brightness levels from 3 to 100.",
+		labels...,
+	)
+
+	mm.ConstGauge(
+		klLightBrightnessRatio,
+		"The brightness of a given light on a device, as a ratio from 0 to 1.",
 		labels...,
 	)
 
@@ -80,176 +642,1397 @@ func NewHandler(reg *prometheus.Registry, f Fetcher) http.Handler {
 		// the physical temperature of the device, which does not seem to be
 		// exposed by the API.
 		klLightColorTemperatureKelvin,
-		"The color temperature in Kelvin of a given light on a device.",
+		"The color temperature in Kelvin of a given light on a device, typically from 2900 to 7000.",
 		labels...,
 	)
 
-	return &handler{
-		f:       f,
-		mm:      mm,
-		metrics: promhttp.HandlerFor(reg, promhttp.HandlerOpts{}),
-	}
-}
+	mm.ConstGauge(
+		klLightColorTemperatureMireds,
+		"The color temperature in mireds of a given light on a device, typically from about 143 to 345. A light which reports no color temperature is reported as 0.",
+		labels...,
+	)
 
-// A Fetcher can fetch Data about a Key Light device from addr.
-type Fetcher interface {
-	Fetch(ctx context.Context, addr string) (*Data, error)
-}
+	mm.ConstGauge(
+		// Devices do not report their power draw, so this is only exported
+		// when an estimate is configured.
+		klLightPowerWatts,
+		"An estimate of the power draw in watts of a given light on a device, calculated from its brightness and a configured maximum power. This is not measured by the device.",
+		labels...,
+	)
 
-// Data contains information which is used to export Prometheus metrics.
-type Data struct {
-	Device *keylight.Device
-	Lights []*keylight.Light
+	mm.ConstGauge(
+		// Only exported for named targets with a configured baseline.
+		klLightDrift,
+		"Reports whether the settings of a given light on a device differ from the configured baseline (0: matches, 1: differs).",
+		labels...,
+	)
 }
 
-// An httpFetcher uses a *keylight.Client to implement Fetcher.
-type httpFetcher struct{}
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		// Panics indicate a programming error or malformed Data from a
+		// Fetcher, so report them without aborting the response.
+		v := recover()
+		if v == nil {
+			return
+		}
+		if v == http.ErrAbortHandler {
+			panic(v)
+		}
+
+		h.ll.Error("recovered from panic while serving request",
+			"path", r.URL.Path, "target", r.URL.Query().Get("target"), "panic", v)
+		httpError(w, r, "internal error while serving request", r.URL.Query().Get("target"), http.StatusInternalServerError)
+	}()
 
-// Fetch implements Fetcher.
-func (httpFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
-	c, err := keylight.NewClient(addr, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create client: %v", err)
+	// Authenticate before inspecting the request any further so that
+	// unauthenticated callers cannot probe devices.
+	if h.auth != nil && !h.auth.authorize(w, r) {
+		return
 	}
 
-	d, err := c.AccessoryInfo(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch device: %v", err)
+	if r.URL.Path == controlPath && h.control != nil {
+		h.serveControl(w, r, h.control)
+		return
 	}
 
-	ls, err := c.Lights(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch lights: %v", err)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, r, "method not allowed", "", http.StatusMethodNotAllowed)
+		return
 	}
 
-	return &Data{
-		Device: d,
-		Lights: ls,
-	}, nil
-}
+	if r.URL.Path == inventoryPath {
+		h.serveInventory(w, r)
+		return
+	}
 
-// ServeHTTP implements http.Handler.
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	if r.URL.Path == validatePath {
+		h.serveValidate(w, r)
+		return
+	}
 
-	// Prometheus is configured to send a target parameter with each scrape
-	// request. This determines which device should be scraped for metrics.
-	target := r.URL.Query().Get("target")
-	if target == "" {
-		http.Error(w, "missing target parameter", http.StatusBadRequest)
+	if r.URL.Path == debugRawPath && h.raw != nil {
+		h.raw.ServeHTTP(w, r)
 		return
 	}
 
-	addr, err := buildAddr(target)
-	if err != nil {
-		http.Error(
-			w,
-			fmt.Sprintf("malformed target parameter: %v", err),
-			http.StatusBadRequest,
-		)
+	if r.URL.Path == discoverPath && h.discoverer != nil {
+		h.serveDiscover(w, r, h.discoverer)
+		return
+	}
+
+	if r.URL.Path == sdPath && h.sdEnabled() {
+		h.serveSD(w, r)
 		return
 	}
 
-	d, err := h.f.Fetch(ctx, addr)
+	labels, err := requestLabels(r)
 	if err != nil {
-		http.Error(
-			w,
-			fmt.Sprintf("failed to fetch Key Light data from %q: %v", addr, err),
-			http.StatusInternalServerError,
-		)
+		httpError(w, r, err.Error(), r.URL.Query().Get("target"), http.StatusBadRequest)
 		return
 	}
 
-	// Ensure that concurrent requests for metrics for multiple devices are
-	// serialized so the metrics do not get mismatched. This is necessary
-	// because we are sharing the metrics handler for multiple requests rather
-	// than creating a new one on each request.
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	exclude, err := requestCollect(r)
+	if err != nil {
+		httpError(w, r, err.Error(), r.URL.Query().Get("target"), http.StatusBadRequest)
+		return
+	}
 
-	h.mm.OnConstScrape(scrapeDevice(d))
-	h.metrics.ServeHTTP(w, r)
-}
+	// A module selects the metrics, labels, and timeout of the scrape, with
+	// any specified by the request taking precedence.
+	mod, err := h.requestModule(r)
+	if err != nil {
+		httpError(w, r, err.Error(), r.URL.Query().Get("target"), http.StatusBadRequest)
+		return
+	}
+	if exclude == nil {
+		exclude = mod.exclude()
+	}
+	for k, v := range mod.Labels {
+		if _, ok := labels[k]; ok {
+			continue
+		}
+		if labels == nil {
+			labels = make(prometheus.Labels)
+		}
+		labels[k] = v
+	}
 
-// buildAddr builds a well-formed HTTP endpoint address from s.
-func buildAddr(s string) (string, error) {
-	if !strings.Contains(s, "://") {
-		// Assume that if no scheme is provided, this is host or host:port.
-		return buildHostPort(s)
+	timeout := h.timeout
+	if mod.Timeout > 0 {
+		timeout = mod.Timeout
 	}
 
-	u, err := url.Parse(s)
+	// Prometheus is configured to send a target parameter with each scrape
+	// request. This determines which devices should be scraped for metrics,
+	// and may specify multiple comma-separated devices.
+	target, err := requestTarget(r)
+	if errors.Is(err, errMissingTarget) && h.autoDiscover != nil {
+		// Scrape every device on the local network instead.
+		h.serveDiscovered(w, r, timeout, labels, exclude)
+		return
+	}
 	if err != nil {
-		return "", err
+		httpError(w, r, err.Error(), r.URL.Query().Get("target"), http.StatusBadRequest)
+		return
 	}
 
-	// Trim trailing slash for consistency.
-	if u.Path == "/" {
-		u.Path = ""
+	addrs, named, ok := h.resolveTargets(w, r, target)
+	if !ok {
+		return
 	}
 
-	// Only allow HTTP(S) with non-empty host and empty path.
-	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
-		return "", fmt.Errorf("invalid device URL: %q", u)
+	timeout = scrapeTimeout(r, timeout)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if !h.allowed(ctx, w, r, addrs) {
+		return
 	}
 
-	return u.String(), nil
+	h.serveTargets(ctx, w, r, timeout, addrs, labels, exclude, named)
 }
 
-// buildHostPort builds a well-formed HTTP endpoint from a string with no
-// URL scheme.
-func buildHostPort(s string) (string, error) {
-	host, port, err := net.SplitHostPort(s)
-	if err != nil {
-		// Assume no port was provided and use the default.
-		host = s
-		port = keylightPort
+// moduleParam is the query parameter which selects a module configured by the
+// named targets, as in the blackbox_exporter.
+const moduleParam = "module"
+
+// requestModule returns the module selected by the query parameters of r, or
+// the zero module, which changes nothing, if none is selected.
+func (h *handler) requestModule(r *http.Request) (module, error) {
+	name := r.URL.Query().Get(moduleParam)
+	if name == "" {
+		return module{}, nil
 	}
 
-	// Assume HTTP if no scheme provided and verify this URL is well formed
-	// by verifying it again.
-	s = (&url.URL{
-		Scheme: "http",
-		Host:   net.JoinHostPort(host, port),
-	}).String()
+	if h.names != nil {
+		if m, ok := h.names.module(name); ok {
+			return m, nil
+		}
+	}
 
-	return buildAddr(s)
+	return module{}, fmt.Errorf("unknown module %q", name)
 }
 
-// scrapeDevice gathers metrics for a single device's data.
-func scrapeDevice(d *Data) metricslite.ScrapeFunc {
-	serial := d.Device.SerialNumber
-
-	return func(metrics map[string]func(value float64, labels ...string)) error {
+// resolveTargets resolves the comma-separated targets in target to device
+// addresses, using the named targets if configured, and the configuration of
+// each named target. If target cannot be resolved, resolveTargets replies to
+// r with an error and returns false.
+func (h *handler) resolveTargets(
+	w http.ResponseWriter,
+	r *http.Request,
+	target string,
+) ([]string, map[string]namedTarget, bool) {
+	// Reject excessive targets before resolving any of them.
+	if n := strings.Count(target, ",") + 1; n > h.maxTargets {
+		httpError(
+			w, r,
+			fmt.Sprintf("too many targets: %d exceeds the maximum of %d", n, h.maxTargets),
+			target,
+			http.StatusBadRequest,
+		)
+		return nil, nil, false
+	}
+
+	var (
+		addrs []string
+		named map[string]namedTarget
+		err   error
+	)
+	if h.names != nil {
+		addrs, named, err = h.names.resolve(target, h.port)
+	} else {
+		addrs, err = buildAddrs(target, h.port)
+	}
+	if errors.Is(err, errUnknownTarget) {
+		httpError(w, r, err.Error(), target, http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		httpError(
+			w, r,
+			fmt.Sprintf("malformed target parameter: %v", err),
+			target,
+			http.StatusBadRequest,
+		)
+		return nil, nil, false
+	}
+
+	return addrs, named, true
+}
+
+// allowed reports whether all of addrs may be scraped. If not, allowed replies
+// to r with an error.
+func (h *handler) allowed(ctx context.Context, w http.ResponseWriter, r *http.Request, addrs []string) bool {
+	if h.allowlist == nil {
+		return true
+	}
+
+	for _, addr := range addrs {
+		if !h.allowlist.allowed(ctx, addr) {
+			httpError(w, r, "target is not permitted", addr, http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
+// labelPrefix is the prefix of query parameters which specify additional
+// labels for the series of a single scrape.
+const labelPrefix = "label_"
+
+// requestLabels parses the additional labels specified by the query
+// parameters of r, such as "label_room=office", or returns nil if there are
+// none.
+func requestLabels(r *http.Request) (prometheus.Labels, error) {
+	var labels prometheus.Labels
+	for k, vs := range r.URL.Query() {
+		name, ok := strings.CutPrefix(k, labelPrefix)
+		if !ok {
+			continue
+		}
+
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if len(vs) != 1 {
+			return nil, fmt.Errorf("label %q must be specified exactly once", name)
+		}
+
+		if labels == nil {
+			labels = make(prometheus.Labels)
+		}
+		labels[name] = vs[0]
+	}
+
+	return labels, nil
+}
+
+// httpError replies to r with an error message and HTTP status code. The
+// reply is plain text for compatibility with Prometheus, unless the Accept
+// header requests JSON, in which case the reply also identifies the target
+// which caused the error, if any.
+func httpError(w http.ResponseWriter, r *http.Request, msg, target string, code int) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Target string `json:"target"`
+	}{
+		Error:  msg,
+		Target: target,
+	})
+}
+
+// acceptsJSON reports whether the Accept header of r explicitly requests JSON.
+// Wildcards are not considered a request for JSON.
+func acceptsJSON(r *http.Request) bool {
+	for _, a := range r.Header.Values("Accept") {
+		for _, mt := range strings.Split(a, ",") {
+			mt, _, _ = strings.Cut(mt, ";")
+			if strings.EqualFold(strings.TrimSpace(mt), "application/json") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// serveTargets fetches data from each device in addrs and serves their
+// metrics other than those in exclude along with the exporter's own metrics,
+// attaching any labels specified by the request. The labels and baseline of
+// the named target in named for the address of each device, if any, are also
+// applied.
+func (h *handler) serveTargets(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	timeout time.Duration,
+	addrs []string,
+	labels prometheus.Labels,
+	exclude map[string]struct{},
+	named map[string]namedTarget,
+) {
+	// Targets in maintenance are never fetched.
+	var (
+		fetch       = make([]string, 0, len(addrs))
+		maintenance []string
+	)
+	for _, addr := range addrs {
+		if named[addr].Maintenance {
+			maintenance = append(maintenance, addr)
+			continue
+		}
+		fetch = append(fetch, addr)
+	}
+
+	results := h.fetch(ctx, fetch)
+
+	// Device metrics are gathered from registries owned by this request, so
+	// that concurrent requests never share device metrics state, while
+	// exporter metrics are gathered from the shared registry.
+	var (
+		gs = prometheus.Gatherers{
+			h.reg,
+			h.timeoutGatherer(timeout),
+			h.successGatherer(results),
+		}
+		reports []func()
+	)
+
+	for _, addr := range maintenance {
+		labels := prometheus.Labels{maintenanceLabel: "1"}
+		for k, v := range named[addr].Labels {
+			labels[k] = v
+		}
+
+		gs = append(gs, &labelGatherer{g: h.scrapeMaintenance(addr), labels: labels})
+	}
+
+	serials := make(map[string]struct{}, len(results))
+	for _, res := range results {
+		if serial := res.serial(); serial != "" {
+			// A device may be reachable at several addresses, such as IPv6
+			// link-local addresses on multiple interfaces, so its metrics are
+			// only served for the first of its addresses to avoid duplicate
+			// series.
+			if _, ok := serials[serial]; ok {
+				h.ll.Debug("skipping duplicate device",
+					"target", res.addr, "serial", serial)
+
+				gs = append(gs, h.scrapeDuplicate(res))
+				continue
+			}
+			serials[serial] = struct{}{}
+		}
+
+		nt := named[res.addr]
+
+		g, report := h.scrape(res, nt.Baseline, exclude)
+		if len(nt.Labels) > 0 {
+			// Labels configured for a named target take precedence over
+			// those from the request.
+			g = &labelGatherer{g: g, labels: nt.Labels}
+		}
+		gs = append(gs, g)
+		if report != nil {
+			reports = append(reports, report)
+		}
+	}
+
+	var g prometheus.Gatherer = gs
+	if len(labels) > 0 {
+		// Labels from the request are applied first, so they take
+		// precedence over external labels with the same name.
+		g = &labelGatherer{g: g, labels: labels}
+	}
+	if len(h.externalLabels) > 0 {
+		g = &labelGatherer{g: g, labels: h.externalLabels}
+	}
+
+	// Serve OpenMetrics to clients which request it using the Accept header,
+	// and the Prometheus text format otherwise. Responses are compressed
+	// with gzip for clients which accept it using the Accept-Encoding header.
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}).ServeHTTP(w, r)
+
+	// Only report the series emitted once the request completes so they are
+	// not racing with the concurrent collection of the exporter metrics
+	// themselves.
+	for _, report := range reports {
+		report()
+	}
+}
+
+// A fetchResult is the result of fetching data from the device at addr.
+type fetchResult struct {
+	addr     string
+	d        *Data
+	err      error
+	duration time.Duration
+}
+
+// serial returns the serial number of the device if it was fetched
+// successfully, or the empty string otherwise.
+func (res fetchResult) serial() string {
+	if res.err != nil || res.d == nil || res.d.Device == nil {
+		return ""
+	}
+
+	return res.d.Device.SerialNumber
+}
+
+// fetch fetches data from each device in addrs concurrently, bounded by the
+// per-request and handler-wide concurrency limits, and returns the results in
+// the same order.
+func (h *handler) fetch(ctx context.Context, addrs []string) []fetchResult {
+	var (
+		wg      sync.WaitGroup
+		sem     = semaphore.NewWeighted(int64(h.concurrency))
+		results = make([]fetchResult, len(addrs))
+	)
+
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(res *fetchResult, addr string) {
+			defer wg.Done()
+
+			// Devices which are still queued when the scrape times out are
+			// reported as down.
+			start := time.Now()
+			var (
+				d   *Data
+				err error
+			)
+			if err = sem.Acquire(ctx, 1); err == nil {
+				d, err = h.fetchDevice(ctx, addr)
+				sem.Release(1)
+			}
+			elapsed := time.Since(start)
+
+			switch {
+			case err != nil:
+				h.ll.Warn("failed to fetch data from device",
+					"target", addr, "elapsed", elapsed, "err", err)
+			case d.StaleErr != nil:
+				h.ll.Warn("failed to fetch data from device, serving cached data",
+					"target", addr, "elapsed", elapsed, "err", d.StaleErr)
+			case d.LightsErr != nil:
+				h.ll.Warn("failed to fetch lights from device",
+					"target", addr, "elapsed", elapsed, "err", d.LightsErr)
+			case len(d.Lights) == 0:
+				// The device is reported as up with no lights, which may
+				// otherwise go unnoticed.
+				h.ll.Warn("fetched no lights from device",
+					"target", addr, "elapsed", elapsed)
+			default:
+				h.ll.Debug("fetched data from device",
+					"target", addr, "elapsed", elapsed)
+			}
+
+			*res = fetchResult{
+				addr:     addr,
+				d:        d,
+				err:      err,
+				duration: elapsed,
+			}
+		}(&results[i], addr)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// fetchDevice fetches data from the device at addr, waiting for a slot if the
+// handler-wide concurrency limit is reached.
+func (h *handler) fetchDevice(ctx context.Context, addr string) (*Data, error) {
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+			defer func() { <-h.sem }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return h.f.Fetch(ctx, addr)
+}
+
+// scrape creates a Gatherer for the device metrics of the fetch result res
+// other than those in exclude, comparing its lights with baseline if not nil,
+// and returns a function which reports the series emitted for the device once
+// the metrics are gathered, if any.
+func (h *handler) scrape(
+	res fetchResult,
+	baseline *lightBaseline,
+	exclude map[string]struct{},
+) (prometheus.Gatherer, func()) {
+	reg := prometheus.NewPedanticRegistry()
+	mm := withNamespace(metricslite.NewPrometheus(reg), h.ns)
+	registerDeviceMetrics(filterMetrics(mm, exclude))
+
+	if res.err != nil {
+		// Report that the device is down rather than failing the scrape, so
+		// that Prometheus records keylight_up=0 for the target.
+		h.scrapeErrors(1, errorReason(res.err))
+
+		mm.OnConstScrape(h.targetScrape(res.addr, true, scrapeFailure(res.addr, h.lastSerial(res.addr))))
+		return reg, nil
+	}
+
+	d, sanitized := sanitizeData(res.d)
+	if sanitized > 0 {
+		h.labelsSanitized(float64(sanitized))
+	}
+
+	switch {
+	case d.StaleErr != nil:
+		// The cached data is exported, but the device is reported as down
+		// because it could not be fetched.
+		h.scrapeErrors(1, errorReason(d.StaleErr))
+	case d.LightsErr != nil:
+		// The device information is still exported, but the device is
+		// reported as down because its lights are missing.
+		h.scrapeErrors(1, errorReason(d.LightsErr))
+	}
+
+	for _, l := range d.Lights {
+		if l.On {
+			h.brightness.Observe(float64(l.Brightness))
+		}
+	}
+
+	var emit []bool
+	if h.changedOnly && d.LightsErr == nil {
+		// Retain the last emitted state when the lights are missing, so that
+		// the next complete scrape only emits lights which have changed.
+		t := h.target(res.addr)
+		t.mu.Lock()
+		emit = t.changed(d)
+		t.mu.Unlock()
+	}
+
+	var g prometheus.Gatherer = reg
+	if h.deviceTimestamps {
+		g = &timestampGatherer{
+			g:         reg,
+			timestamp: func() time.Time { return d.Timestamp },
+		}
+	}
+
+	scrape := h.targetScrape(
+		res.addr,
+		d.LightsErr != nil || d.StaleErr != nil,
+		scrapeDevice(res.addr, d, emit, res.duration, h.maxWatts, baseline, h.now),
+	)
+	if !d.PolledAt.IsZero() {
+		g = prometheus.Gatherers{g, h.sampleAgeGatherer(res.addr, d.PolledAt)}
+	}
+
+	if h.seriesEmitted == nil && h.cardinality == nil {
+		mm.OnConstScrape(recoverScrape(h.ll, res.addr, scrape))
+		return g, nil
+	}
+
+	// Observe the series emitted while serving this request.
+	var (
+		n    int
+		keys []uint64
+	)
+
+	mm.OnConstScrape(recoverScrape(h.ll, res.addr, observeSeries(scrape, func(name string, labels []string) {
+		n++
+		if h.cardinality != nil {
+			keys = append(keys, seriesKey(name, labels))
+		}
+	})))
+
+	return g, func() {
+		if h.seriesEmitted != nil {
+			h.seriesEmitted(float64(n), d.Device.SerialNumber)
+		}
+		if h.cardinality != nil {
+			if n, over := h.cardinality.observe(keys); over {
+				h.ll.Warn("device series exceed the cardinality limit",
+					"target", res.addr, "serial", d.Device.SerialNumber,
+					"limit", h.cardinality.limit, "series", n)
+			}
+		}
+	}
+}
+
+// sampleAgeGatherer creates a Gatherer which reports the age of the data for
+// the device at addr, which was polled in the background at polled. The age is
+// measured when the metrics are gathered, so it is not timestamped with the
+// time of the poll like the device's metrics.
+func (h *handler) sampleAgeGatherer(addr string, polled time.Time) prometheus.Gatherer {
+	reg := prometheus.NewPedanticRegistry()
+	mm := withNamespace(metricslite.NewPrometheus(reg), h.ns)
+
+	mm.ConstGauge(
+		kleSampleAgeSeconds,
+		"The age in seconds of the data served for a target, which was fetched by a background poll.",
+		"target",
+	)
+
+	mm.OnConstScrape(func(metrics map[string]func(value float64, labels ...string)) error {
+		metrics[kleSampleAgeSeconds](h.now().Sub(polled).Seconds(), addr)
+		return nil
+	})
+
+	return reg
+}
+
+// timeoutGatherer creates a Gatherer which reports the timeout of a single
+// scrape. It is owned by the request rather than registered with the shared
+// registry because concurrent requests may have different timeouts.
+func (h *handler) timeoutGatherer(timeout time.Duration) prometheus.Gatherer {
+	reg := prometheus.NewPedanticRegistry()
+	mm := withNamespace(metricslite.NewPrometheus(reg), h.ns)
+
+	mm.ConstGauge(
+		kleScrapeTimeoutSeconds,
+		"The effective timeout in seconds of the current scrape, which is the smaller of the configured timeout and the timeout sent by Prometheus, if any.",
+	)
+
+	mm.OnConstScrape(func(metrics map[string]func(value float64, labels ...string)) error {
+		metrics[kleScrapeTimeoutSeconds](timeout.Seconds())
+		return nil
+	})
+
+	return reg
+}
+
+// successGatherer records the time of each successful fetch in results, and
+// creates a Gatherer which reports the time of the most recent successful
+// fetch of each device in results, including those which are down for this
+// scrape but were previously fetched successfully.
+func (h *handler) successGatherer(results []fetchResult) prometheus.Gatherer {
+	reg := prometheus.NewPedanticRegistry()
+	mm := withNamespace(metricslite.NewPrometheus(reg), h.ns)
+
+	mm.ConstGauge(
+		klLastSuccessTimestampSeconds,
+		"The UNIX time in seconds at which data was most recently fetched successfully from an Elgato Key Light device, which is retained while the device is down.",
+		"serial",
+	)
+
+	now := h.now()
+	serials := make(map[string]struct{}, len(results))
+	for _, res := range results {
+		t := h.target(res.addr)
+		t.mu.Lock()
+		if serial := res.serial(); serial != "" && res.d.LightsErr == nil && res.d.StaleErr == nil {
+			t.serial = serial
+			h.recordSuccess(serial, fetchedAt(res.d, now))
+		}
+		serial := t.serial
+		t.mu.Unlock()
+
+		if serial != "" {
+			serials[serial] = struct{}{}
+		}
+	}
+
+	h.successMu.Lock()
+	successes := make(map[string]time.Time, len(serials))
+	for serial := range serials {
+		successes[serial] = h.successes[serial]
+	}
+	h.successMu.Unlock()
+
+	mm.OnConstScrape(func(metrics map[string]func(value float64, labels ...string)) error {
+		for serial, t := range successes {
+			metrics[klLastSuccessTimestampSeconds](float64(t.UnixNano())/float64(time.Second), serial)
+		}
+		return nil
+	})
+
+	return reg
+}
+
+// recordSuccess records that the device with serial was fetched successfully
+// at t, unless a later success was already recorded.
+func (h *handler) recordSuccess(serial string, t time.Time) {
+	h.successMu.Lock()
+	defer h.successMu.Unlock()
+
+	if t.After(h.successes[serial]) {
+		h.successes[serial] = t
+	}
+}
+
+// fetchedAt returns the time at which the Data d was fetched from its device,
+// which precedes now if d was cached or polled in the background.
+func fetchedAt(d *Data, now time.Time) time.Time {
+	switch {
+	case !d.CachedAt.IsZero():
+		return d.CachedAt
+	case !d.Timestamp.IsZero():
+		return d.Timestamp
+	default:
+		return now
+	}
+}
+
+// maintenanceLabel is the label attached to the series of a named target in
+// maintenance.
+const maintenanceLabel = "maintenance"
+
+// scrapeMaintenance creates a Gatherer for the device at addr, a named target
+// in maintenance, which only reports that the device is down. The device's
+// consecutive failures are not affected.
+func (h *handler) scrapeMaintenance(addr string) prometheus.Gatherer {
+	reg := prometheus.NewPedanticRegistry()
+	mm := withNamespace(metricslite.NewPrometheus(reg), h.ns)
+	registerDeviceMetrics(mm)
+
+	h.ll.Debug("skipping device in maintenance", "target", addr)
+	mm.OnConstScrape(scrapeFailure(addr, h.lastSerial(addr)))
+	return reg
+}
+
+// scrapeDuplicate creates a Gatherer for the fetch result res of a device
+// whose metrics are already served for another address, which only reports
+// the state of the target itself.
+func (h *handler) scrapeDuplicate(res fetchResult) prometheus.Gatherer {
+	reg := prometheus.NewPedanticRegistry()
+	mm := withNamespace(metricslite.NewPrometheus(reg), h.ns)
+	registerDeviceMetrics(mm)
+
+	mm.OnConstScrape(h.targetScrape(
+		res.addr,
+		res.d.LightsErr != nil || res.d.StaleErr != nil,
+		func(_ map[string]func(value float64, labels ...string)) error { return nil },
+	))
+	return reg
+}
+
+// targetScrape records whether the device at addr is down for this scrape, and
+// wraps scrape so that it also reports the number of consecutive scrapes for
+// which the device has been down, and the state of its circuit breaker, if
+// enabled.
+func (h *handler) targetScrape(addr string, down bool, scrape metricslite.ScrapeFunc) metricslite.ScrapeFunc {
+	t := h.target(addr)
+	t.mu.Lock()
+	if down {
+		t.failures++
+	} else {
+		t.failures = 0
+	}
+	failures := t.failures
+	t.mu.Unlock()
+
+	open := h.breaker != nil && h.breaker.open(addr)
+	return func(metrics map[string]func(value float64, labels ...string)) error {
+		if err := scrape(metrics); err != nil {
+			return err
+		}
+
+		metrics[klScrapeConsecutiveFailures](float64(failures), addr)
+		if h.breaker != nil {
+			metrics[klCircuitOpen](boolFloat(open), addr)
+		}
+
+		return nil
+	}
+}
+
+// recoverScrape wraps scrape so that a panic while scraping the device at addr
+// is logged using ll and returned as an error, which fails the request. Metrics
+// are gathered concurrently, so a panic which is not recovered by scrape itself
+// would otherwise crash the process.
+func recoverScrape(ll *slog.Logger, addr string, scrape metricslite.ScrapeFunc) metricslite.ScrapeFunc {
+	return func(metrics map[string]func(value float64, labels ...string)) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				ll.Error("recovered from panic while scraping device", "target", addr, "panic", v)
+				err = fmt.Errorf("panic while scraping device %q: %v", addr, v)
+			}
+		}()
+
+		return scrape(metrics)
+	}
+}
+
+// observeSeries wraps scrape so that fn is invoked with the name and label
+// values of each series emitted.
+func observeSeries(scrape metricslite.ScrapeFunc, fn func(name string, labels []string)) metricslite.ScrapeFunc {
+	return func(metrics map[string]func(value float64, labels ...string)) error {
+		observed := make(map[string]func(float64, ...string), len(metrics))
+		for name, c := range metrics {
+			name, c := name, c
+			observed[name] = func(value float64, labels ...string) {
+				fn(name, labels)
+				c(value, labels...)
+			}
+		}
+
+		return scrape(observed)
+	}
+}
+
+// scrapeTimeout determines the timeout for a scrape request using the
+// configured timeout and the timeout sent by Prometheus, if any. If both are
+// set, the smaller of the two is used.
+func scrapeTimeout(r *http.Request, configured time.Duration) time.Duration {
+	var header time.Duration
+	if s := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); s != "" {
+		// Ignore malformed or non-positive values.
+		if secs, err := strconv.ParseFloat(s, 64); err == nil && secs > 0 {
+			header = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	switch {
+	case configured > 0 && header > 0:
+		if header < configured {
+			return header
+		}
+		return configured
+	case configured > 0:
+		return configured
+	case header > 0:
+		return header
+	default:
+		return defaultTimeout
+	}
+}
+
+// buildAddr builds a well-formed HTTP endpoint address from s. The address
+// never contains credentials, a path, a query, or a fragment.
+func buildAddr(s, port string) (string, error) {
+	if !strings.Contains(s, "://") {
+		// Assume that if no scheme is provided, this is host or host:port.
+		return buildHostPort(s, port)
+	}
+
+	u, err := url.Parse(escapeZone(s))
+	if err != nil {
+		return "", err
+	}
+
+	// Trim trailing slash for consistency.
+	if u.Path == "/" {
+		u.Path = ""
+	}
+
+	// Only allow HTTP(S) with non-empty host and empty path. The URL is
+	// redacted as it may contain credentials.
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+		return "", fmt.Errorf("invalid device URL: %q", u.Redacted())
+	}
+
+	// Targets are controlled by whoever can reach the exporter, so reject
+	// components which have no meaning for a device rather than passing them
+	// along to it.
+	switch {
+	case u.User != nil:
+		return "", fmt.Errorf("invalid device URL %q: must not contain credentials", u.Redacted())
+	case u.RawQuery != "" || u.ForceQuery:
+		return "", fmt.Errorf("invalid device URL %q: must not contain a query", u.Redacted())
+	case u.Fragment != "" || strings.Contains(s, "#"):
+		return "", fmt.Errorf("invalid device URL %q: must not contain a fragment", u.Redacted())
+	}
+
+	if err := checkHost(u.Hostname()); err != nil {
+		return "", err
+	}
+
+	switch port := u.Port(); {
+	case port != "":
+		if err := checkPort(port); err != nil {
+			return "", err
+		}
+	case strings.HasSuffix(u.Host, ":"):
+		return "", fmt.Errorf("invalid device URL %q: empty port", u.Redacted())
+	}
+
+	u.Host = canonicalHost(u.Host)
+	return u.String(), nil
+}
+
+// canonicalHost returns host, an optional host:port pair, with any IPv6
+// literal in its canonical form and any hostname in lowercase so that each
+// spelling of an address refers to the same target.
+func canonicalHost(host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+	}
+
+	ip, err := netip.ParseAddr(h)
+	if err != nil {
+		// Hostnames are case-insensitive.
+		return strings.ToLower(host)
+	}
+	if !ip.Is6() {
+		return host
+	}
+	if port == "" {
+		return "[" + ip.String() + "]"
+	}
+
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// errMissingTarget is returned by requestTarget when r specifies no target.
+var errMissingTarget = errors.New("missing target parameter")
+
+// requestTarget returns the target specified by r, either as the path segment
+// following probePath, such as "/probe/192.168.1.5:9123", or as the "target"
+// query parameter.
+func requestTarget(r *http.Request) (string, error) {
+	query := r.URL.Query().Get("target")
+
+	// The path has already been percent-decoded.
+	path, ok := strings.CutPrefix(r.URL.Path, probePath)
+	if !ok || path == "" {
+		if query == "" {
+			return "", errMissingTarget
+		}
+
+		return query, nil
+	}
+
+	if query != "" {
+		return "", errors.New("target must not be specified by both path and query parameter")
+	}
+	if strings.Contains(path, "/") {
+		return "", fmt.Errorf("malformed target path %q", path)
+	}
+
+	return path, nil
+}
+
+// buildAddrs builds a sorted list of unique device addresses from a
+// comma-separated target parameter, using buildAddr for each target.
+func buildAddrs(s, port string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var addrs []string
+	for _, target := range strings.Split(s, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			return nil, errors.New("empty target")
+		}
+
+		addr, err := buildAddr(target, port)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// buildHostPort builds a well-formed HTTP endpoint from a string with no
+// URL scheme.
+func buildHostPort(s, defaultPort string) (string, error) {
+	if strings.Contains(s, "@") {
+		// Don't echo any credentials in the error.
+		return "", errors.New("invalid target: must not contain credentials")
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// Assume no port was provided and use the default. The host may be a
+		// bracketed or bare IPv6 literal.
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		port = defaultPort
+	}
+
+	if port != "" {
+		if err := checkPort(port); err != nil {
+			return "", err
+		}
+	}
+
+	if strings.Contains(host, ":") {
+		// Only IPv6 literals, optionally with a zone, may contain colons.
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid IPv6 address %q: %v", host, err)
+		}
+	}
+	if err := checkHost(host); err != nil {
+		return "", err
+	}
+
+	// Assume HTTP if no scheme provided and verify this URL is well formed
+	// by verifying it again. JoinHostPort brackets IPv6 literals, and
+	// url.URL encodes any zone as "%25".
+	s = (&url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, port),
+	}).String()
+
+	return buildAddr(s, defaultPort)
+}
+
+// checkPort verifies that port is a valid TCP port number.
+func checkPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: must be numeric", port)
+	}
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q: must be between 1 and 65535", port)
+	}
+
+	return nil
+}
+
+// maxHostLength is the maximum length of a DNS hostname.
+const maxHostLength = 253
+
+// checkHost verifies that host, with any IPv6 brackets removed, is either an
+// IP address or a DNS hostname of ASCII letters, digits, hyphens, and
+// underscores. The zone of an IPv6 address must name a network interface.
+func checkHost(host string) error {
+	if host == "" {
+		return errors.New("empty host")
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if z := ip.Zone(); ip.Is6() && z != "" && !validLabel(z, ".") {
+			return fmt.Errorf("invalid IPv6 zone %q", z)
+		}
+
+		return nil
+	}
+
+	if len(host) > maxHostLength {
+		return fmt.Errorf("invalid hostname: exceeds %d characters", maxHostLength)
+	}
+
+	// Permit a trailing dot for a fully qualified name, as is common for
+	// mDNS hostnames.
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) > 63 || !validLabel(label, "") {
+			return fmt.Errorf("invalid hostname %q", host)
+		}
+	}
+
+	return nil
+}
+
+// validLabel reports whether s is non-empty and consists only of ASCII
+// letters, digits, hyphens, underscores, and any characters in extra.
+func validLabel(s, extra string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', strings.ContainsRune(extra, c):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// escapeZone percent-encodes the zone identifier of a bracketed IPv6 literal
+// in the URL s as "%25", as required by url.Parse, if it is not already
+// encoded. For example, "http://[fe80::1%eth0]:9123" becomes
+// "http://[fe80::1%25eth0]:9123".
+func escapeZone(s string) string {
+	start, end := strings.Index(s, "["), strings.Index(s, "]")
+	if start == -1 || end < start {
+		return s
+	}
+
+	i := strings.Index(s[start:end], "%")
+	if i == -1 {
+		return s
+	}
+	i += start
+
+	if strings.HasPrefix(s[i:end], "%25") {
+		return s
+	}
+
+	return s[:i] + "%25" + s[i+1:]
+}
+
+// scrapeDevice gathers metrics for a single device's data, which took duration
+// to fetch from addr. If emit is not nil, metrics are only gathered for lights
+// whose index in emit is true. If maxWatts is positive, the power draw of each light
+// is estimated from its brightness. If baseline is not nil, each light reports
+// whether its settings differ from baseline. The age of cached data is measured
+// using now.
+func scrapeDevice(
+	addr string,
+	d *Data,
+	emit []bool,
+	duration time.Duration,
+	maxWatts float64,
+	baseline *lightBaseline,
+	now func() time.Time,
+) metricslite.ScrapeFunc {
+	serial := d.Device.SerialNumber
+
+	return func(metrics map[string]func(value float64, labels ...string)) error {
 		for name, c := range metrics {
 			switch name {
+			case klUp:
+				c(boolFloat(d.LightsErr == nil && d.StaleErr == nil), serial, addr)
 			case klInfo:
-				c(1.0, d.Device.FirmwareVersion, d.Device.DisplayName, serial)
-			case klLightOn, klLightBrightnessPercent, klLightColorTemperatureKelvin:
-				for i, l := range d.Lights {
-					light := fmt.Sprintf("light%d", i)
-
-					switch name {
-					case klLightOn:
-						c(boolFloat(l.On), light, serial)
-					case klLightBrightnessPercent:
-						c(float64(l.Brightness), light, serial)
-					case klLightColorTemperatureKelvin:
-						c(float64(l.Temperature), light, serial)
-					default:
-						panicf("keylight_exporter: unhandled light metric %q", name)
-					}
+				c(
+					1.0,
+					addr,
+					d.Device.FirmwareVersion,
+					intLabel(d.Device.FirmwareBuildNumber),
+					intLabel(d.Device.HardwareBoardType),
+					deviceModel(d.Device),
+					d.Device.DisplayName,
+					d.Device.ProductName,
+					serial,
+				)
+			case klScrapeDurationSeconds:
+				c(duration.Seconds(), serial)
+			case klDeviceHTTPProtoInfo:
+				// Only report the protocol if the Fetcher captured it.
+				if d.Proto != "" {
+					c(1.0, d.Proto, serial)
+				}
+			case klWiFiSignalDBM:
+				// Only report the signal if the device reported it.
+				if d.WiFiRSSI != 0 {
+					c(float64(d.WiFiRSSI), serial)
+				}
+			case klDeviceBootTimeSeconds:
+				// Only report the boot time if the device reported it.
+				if !d.BootTime.IsZero() {
+					c(float64(d.BootTime.Unix()), serial)
+				}
+			case klFirmwareBuildNumber:
+				// Only report the build if the device reported it.
+				if d.Device.FirmwareBuildNumber != 0 {
+					c(float64(d.Device.FirmwareBuildNumber), serial)
+				}
+			case klScrapeConnectSeconds:
+				// Only report the timings if the Fetcher measured them.
+				if d.ConnectDuration != 0 || d.TransferDuration != 0 {
+					c(d.ConnectDuration.Seconds(), serial)
+				}
+			case klScrapeTransferSeconds:
+				if d.ConnectDuration != 0 || d.TransferDuration != 0 {
+					c(d.TransferDuration.Seconds(), serial)
 				}
+			case klLightTemperatureMinKelvin:
+				// Only report the limits if the device reported them.
+				if d.TemperatureMin != 0 {
+					c(float64(d.TemperatureMin), serial)
+				}
+			case klLightTemperatureMaxKelvin:
+				if d.TemperatureMax != 0 {
+					c(float64(d.TemperatureMax), serial)
+				}
+			case klCacheAgeSeconds:
+				// Only report the age if the Data was cached.
+				if !d.CachedAt.IsZero() {
+					c(now().Sub(d.CachedAt).Seconds(), serial)
+				}
+			case klDataStale:
+				if !d.CachedAt.IsZero() {
+					c(boolFloat(d.StaleErr != nil), serial)
+				}
+			case klLights:
+				// Only report the number of lights if they were fetched.
+				if d.LightsErr == nil {
+					c(float64(len(d.Lights)), serial)
+				}
+			case klCircuitOpen, klScrapeConsecutiveFailures:
+				// Reported by the handler.
+			case klLightOn, klLightBrightnessPercent, klLightBrightnessRatio,
+				klLightColorTemperatureKelvin, klLightColorTemperatureMireds, klLightPowerWatts,
+				klLightDrift:
+				// Handled per light below.
 			default:
 				panicf("keylight_exporter: unhandled metric %q", name)
 			}
 		}
 
+		var (
+			on          = metrics[klLightOn]
+			brightness  = metrics[klLightBrightnessPercent]
+			ratio       = metrics[klLightBrightnessRatio]
+			temperature = metrics[klLightColorTemperatureKelvin]
+			mireds      = metrics[klLightColorTemperatureMireds]
+			power       = metrics[klLightPowerWatts]
+			drift       = metrics[klLightDrift]
+		)
+
+		// Metrics which are excluded by the request are not registered, so
+		// discard their values.
+		for _, c := range []*func(value float64, labels ...string){
+			&on, &brightness, &ratio, &temperature, &mireds, &power, &drift,
+		} {
+			if *c == nil {
+				*c = func(float64, ...string) {}
+			}
+		}
+
+		// Compute each light's label once and emit all of its metrics together,
+		// rather than iterating over every light for each metric.
+		for i, l := range d.Lights {
+			if emit != nil && !emit[i] {
+				continue
+			}
+
+			light := "light" + strconv.Itoa(i)
+			name := d.Device.DisplayName
+
+			on(boolFloat(l.On), light, name, serial)
+			brightness(float64(l.Brightness), light, name, serial)
+			ratio(float64(l.Brightness)/100, light, name, serial)
+			temperature(float64(l.Temperature), light, name, serial)
+			mireds(kelvinMireds(l.Temperature), light, name, serial)
+			if maxWatts > 0 {
+				power(estimatePower(l, maxWatts), light, name, serial)
+			}
+			if baseline != nil {
+				drift(boolFloat(baseline.drifted(l)), light, name, serial)
+			}
+		}
+
+		return nil
+	}
+}
+
+// estimatePower estimates the power draw in watts of l, assuming that power
+// scales linearly with brightness up to maxWatts. A light which is turned off
+// draws no power.
+func estimatePower(l *keylight.Light, maxWatts float64) float64 {
+	if !l.On {
+		return 0
+	}
+
+	return float64(l.Brightness) / 100 * maxWatts
+}
+
+// kelvinMireds converts a color temperature in Kelvin to mireds. A light which
+// reports no temperature is reported as 0 mireds rather than +Inf.
+func kelvinMireds(k int) float64 {
+	if k == 0 {
+		return 0
+	}
+
+	return 1e6 / float64(k)
+}
+
+// sanitizeData returns a copy of d whose device metadata is safe for use as
+// Prometheus label values, and the number of values which were modified.
+func sanitizeData(d *Data) (*Data, int) {
+	var (
+		dev = *d.Device
+		n   int
+	)
+
+	for _, s := range []*string{
+		&dev.DisplayName,
+		&dev.FirmwareVersion,
+		&dev.ProductName,
+		&dev.SerialNumber,
+	} {
+		if v := sanitizeLabel(*s); v != *s {
+			*s = v
+			n++
+		}
+	}
+
+	if n == 0 {
+		return d, 0
+	}
+
+	out := *d
+	out.Device = &dev
+	return &out, n
+}
+
+// sanitizeLabel replaces invalid UTF-8 in s and removes any control
+// characters.
+func sanitizeLabel(s string) string {
+	s = strings.ToValidUTF8(s, string(utf8.RuneError))
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			// Drop the rune.
+			return -1
+		}
+
+		return r
+	}, s)
+}
+
+// scrapeFailure reports that the device at addr, most recently fetched with
+// serial if known, could not be scraped.
+func scrapeFailure(addr, serial string) metricslite.ScrapeFunc {
+	return func(metrics map[string]func(value float64, labels ...string)) error {
+		// No other metrics are available for a device which is down.
+		metrics[klUp](0.0, serial, addr)
 		return nil
 	}
 }
 
+// errorReason classifies an error returned by a Fetcher as a timeout, a
+// connection failure, a failure to parse the device's response, a fetch
+// skipped by an open circuit breaker, or other.
+func errorReason(err error) string {
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, errBodyTooLarge):
+		// Checked first because HTTP clients also report it as *url.Error
+		// when the Content-Length is too large.
+		return "body_too_large"
+	}
+
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &nerr) && nerr.Timeout():
+		return "timeout"
+	}
+
+	var (
+		uerr  *url.Error
+		operr *net.OpError
+	)
+	switch {
+	case errors.As(err, &uerr), errors.As(err, &operr),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		// HTTP clients report all transport failures as *url.Error.
+		return "connection"
+	}
+
+	var (
+		serr  *json.SyntaxError
+		uterr *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &serr), errors.As(err, &uterr),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		// A JSON decoder reports empty or truncated input as EOF.
+		return "parse"
+	}
+
+	return "other"
+}
+
+// intLabel converts i to a label value, treating zero as unset because
+// older firmware may not report some numeric fields.
+func intLabel(i int) string {
+	if i == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(i)
+}
+
 // boolFloat converts b to a float64 0.0 or 1.0 value.
 func boolFloat(b bool) float64 {
 	if b {
@@ -1,12 +1,23 @@
 package keylightexporter_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,12 +26,15 @@ import (
 	keylightexporter "github.com/mdlayher/keylight_exporter"
 	"github.com/mdlayher/promtest"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/expfmt"
 )
 
 func TestHandler(t *testing.T) {
 	tests := []struct {
 		name   string
 		target string
+		addr   string
 		code   int
 	}{
 		{
@@ -42,34 +56,54 @@ func TestHandler(t *testing.T) {
 			target: "foo:bar",
 			code:   http.StatusBadRequest,
 		},
+		{
+			name:   "bad port range",
+			target: "foo:70000",
+			code:   http.StatusBadRequest,
+		},
 		{
 			name:   "bad path",
 			target: "http://foo/bar",
 			code:   http.StatusBadRequest,
 		},
+		{
+			name:   "bad empty target",
+			target: "foo,,bar",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "bad second target",
+			target: "foo,sftp://bar",
+			code:   http.StatusBadRequest,
+		},
 		{
 			name:   "OK host",
 			target: "foo",
+			addr:   "http://foo:9123",
 			code:   http.StatusOK,
 		},
 		{
 			name:   "OK host:port",
 			target: "foo:9123",
+			addr:   "http://foo:9123",
 			code:   http.StatusOK,
 		},
 		{
 			name:   "OK HTTP trailing slash",
 			target: "http://foo:9123/",
+			addr:   "http://foo:9123",
 			code:   http.StatusOK,
 		},
 		{
 			name:   "OK HTTP",
 			target: "http://foo:9123",
+			addr:   "http://foo:9123",
 			code:   http.StatusOK,
 		},
 		{
 			name:   "OK HTTPS",
 			target: "https://foo:9123",
+			addr:   "https://foo:9123",
 			code:   http.StatusOK,
 		},
 	}
@@ -95,22 +129,7 @@ func TestHandler(t *testing.T) {
 						t.Fatalf("unexpected URL path (-want +got):\n%s", diff)
 					}
 
-					return &keylightexporter.Data{
-						Device: &keylight.Device{
-							DisplayName:     "test",
-							FirmwareVersion: "1.0.0",
-							SerialNumber:    "1111",
-						},
-						Lights: []*keylight.Light{
-							{
-								On:          true,
-								Brightness:  20,
-								Temperature: 4200,
-							},
-							// A second light which is entirely off.
-							{},
-						},
-					}, nil
+					return testData(), nil
 				},
 			}
 
@@ -135,56 +154,1979 @@ func TestHandler(t *testing.T) {
 			}
 
 			match := []string{
-				`keylight_info{firmware="1.0.0",name="test",serial="1111"} 1`,
-				`keylight_light_on{light="light0",serial="1111"} 1`,
-				`keylight_light_brightness_percent{light="light0",serial="1111"} 20`,
-				`keylight_light_color_temperature_kelvin{light="light0",serial="1111"} 4200`,
-				`keylight_light_on{light="light1",serial="1111"} 0`,
-				`keylight_light_brightness_percent{light="light1",serial="1111"} 0`,
-				`keylight_light_color_temperature_kelvin{light="light1",serial="1111"} 0`,
+				upMetric(true, tt.addr),
+				`keylight_info{address="` + tt.addr + `",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`,
+				`keylight_firmware_build_number{serial="1111"} 192`,
+				`keylight_lights{serial="1111"} 2`,
+				`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+				`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+				`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+				`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+				`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+				`keylight_light_on{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_kelvin{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_mireds{light="light1",name="test",serial="1111"} 0`,
 			}
 
-			if !promtest.Match(t, b, match) {
+			if !matchDevice(t, b, match) {
 				t.Fatal("failed to match Prometheus metrics")
 			}
 		})
 	}
 }
 
-type testFetcher struct {
-	fetch func(ctx context.Context, addr string) (*keylightexporter.Data, error)
+func TestHandlerScrapeDuration(t *testing.T) {
+	const delay = 10 * time.Millisecond
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			time.Sleep(delay)
+			return testData(), nil
+		},
+	})
+
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	const prefix = `keylight_scrape_duration_seconds{serial="1111"} `
+
+	var found bool
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(l, prefix) {
+			continue
+		}
+
+		found = true
+		v, err := strconv.ParseFloat(strings.TrimPrefix(l, prefix), 64)
+		if err != nil {
+			t.Fatalf("failed to parse scrape duration: %v", err)
+		}
+
+		if v < delay.Seconds() || v > 5 {
+			t.Fatalf("implausible scrape duration: %v", v)
+		}
+	}
+
+	if !found {
+		t.Fatal("scrape duration metric was not found")
+	}
 }
 
-func (f testFetcher) Fetch(ctx context.Context, addr string) (*keylightexporter.Data, error) {
-	return f.fetch(ctx, addr)
+func TestHandlerScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name: "configured",
+			want: "2",
+		},
+		{
+			name:   "header",
+			header: "0.5",
+			want:   "0.5",
+		},
+		{
+			name:   "header exceeds configured",
+			header: "10",
+			want:   "2",
+		},
+	}
+
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithTimeout(2*time.Second))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"?target=foo", nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+			if tt.header != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+			}
+
+			res, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+
+			want := "keylight_exporter_scrape_timeout_seconds " + tt.want + "\n"
+			if b := testBody(t, res); !bytes.Contains(b, []byte(want)) {
+				t.Fatalf("scrape timeout metric %q was not found:\n%s", want, b)
+			}
+		})
+	}
 }
 
-// testHandler performs a single HTTP request to a handler created using
-// NewHandler, using the specified target.
-func testHandler(t *testing.T, f keylightexporter.Fetcher, target string) *http.Response {
-	t.Helper()
+func TestHandlerMetricNames(t *testing.T) {
+	b := testBody(t, testGet(t, testServer(t, testDataFetcher()), "foo"))
+
+	// Renaming a metric breaks users' dashboards and alerts, so verify the
+	// exact names of the light metrics.
+	for _, name := range []string{
+		"keylight_light_on",
+		"keylight_light_brightness_percent",
+		"keylight_light_brightness_ratio",
+		"keylight_light_color_temperature_kelvin",
+		"keylight_light_color_temperature_mireds",
+	} {
+		typ := fmt.Sprintf("# TYPE %s gauge\n", name)
+		if !bytes.Contains(b, []byte(typ)) {
+			t.Errorf("metric %q was not found", name)
+		}
+	}
+}
+
+func TestHandlerBrightnessRatio(t *testing.T) {
+	b := testBody(t, testGet(t, testServer(t, testDataFetcher()), "foo"))
+
+	// Both the percent and ratio series are reported for the same light.
+	for _, s := range []string{
+		`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+	} {
+		if !bytes.Contains(b, []byte(s+"\n")) {
+			t.Errorf("brightness series was not found: %s", s)
+		}
+	}
+}
+
+func TestHandlerInfoJoinLabels(t *testing.T) {
+	srv := testServer(t, testDataFetcher())
+
+	var p expfmt.TextParser
+	mfs, err := p.TextToMetricFamilies(testGet(t, srv, "foo").Body)
+	if err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+
+	// Every device series carries the same serial so that it may be joined
+	// with keylight_info, but only keylight_info carries the address.
+	for name, mf := range mfs {
+		if !strings.HasPrefix(name, "keylight_") || strings.HasPrefix(name, "keylight_exporter_") {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			if _, ok := labels["serial"]; !ok {
+				// Series which describe a target rather than a device.
+				continue
+			}
+			if diff := cmp.Diff("1111", labels["serial"]); diff != "" {
+				t.Errorf("unexpected serial for %q (-want +got):\n%s", name, diff)
+			}
+
+			addr, ok := labels["address"]
+			switch {
+			case name == "keylight_info":
+				if diff := cmp.Diff("http://foo:9123", addr); diff != "" {
+					t.Errorf("unexpected address for %q (-want +got):\n%s", name, diff)
+				}
+			case ok:
+				t.Errorf("metric %q has an address label", name)
+			}
+		}
+	}
+}
+
+func TestHandlerConsecutiveFailures(t *testing.T) {
+	var fetches atomic.Int32
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if addr == "http://bar:9123" {
+				return testData(), nil
+			}
+
+			switch fetches.Add(1) {
+			case 1, 2:
+				return nil, errors.New("device unreachable")
+			case 4:
+				// Missing lights also report the device as down.
+				d := testData()
+				d.Lights = nil
+				d.LightsErr = errors.New("failed to fetch lights")
+				return d, nil
+			default:
+				return testData(), nil
+			}
+		},
+	})
+
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{target: "foo", want: "1"},
+		{target: "foo", want: "2"},
+		// Other targets are tracked separately.
+		{target: "bar", want: "0"},
+		{target: "foo", want: "0"},
+		{target: "foo", want: "1"},
+		{target: "foo", want: "0"},
+	} {
+		b := testBody(t, testGet(t, srv, tt.target))
+
+		m := fmt.Sprintf(`keylight_scrape_consecutive_failures{target="http://%s:9123"} %s`, tt.target, tt.want)
+		if !bytes.Contains(b, []byte(m+"\n")) {
+			t.Fatalf("consecutive failures metric was not found: %s", m)
+		}
+	}
+}
+
+func TestHandlerLastSuccess(t *testing.T) {
+	var fail atomic.Bool
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			if fail.Load() {
+				return nil, errors.New("device unreachable")
+			}
+
+			return testData(), nil
+		},
+	})
+
+	re := regexp.MustCompile(`keylight_last_success_timestamp_seconds\{serial="1111"\} (\S+)\n`)
+
+	last := func() float64 {
+		t.Helper()
+
+		b := testBody(t, testGet(t, srv, "foo"))
+		m := re.FindSubmatch(b)
+		if m == nil {
+			t.Fatalf("last success metric was not found:\n%s", b)
+		}
+
+		v, err := strconv.ParseFloat(string(m[1]), 64)
+		if err != nil {
+			t.Fatalf("failed to parse last success timestamp: %v", err)
+		}
+
+		return v
+	}
+
+	first := last()
+	if now := float64(time.Now().Unix()); first < now-60 || first > now+60 {
+		t.Fatalf("implausible last success timestamp: %v", first)
+	}
+
+	// The timestamp is retained while the device is down.
+	time.Sleep(10 * time.Millisecond)
+	fail.Store(true)
+	if got := last(); got != first {
+		t.Fatalf("timestamp changed while the device was down: %v, previously %v", got, first)
+	}
+
+	// The timestamp advances once the device is fetched successfully again.
+	fail.Store(false)
+	if got := last(); got <= first {
+		t.Fatalf("timestamp did not advance after success: %v, previously %v", got, first)
+	}
+}
+
+func TestHandlerBootTime(t *testing.T) {
+	boot := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		boot   time.Time
+		series string
+	}{
+		{
+			name:   "reported",
+			boot:   boot,
+			series: `keylight_device_boot_time_seconds{serial="1111"} 1.5778368e+09`,
+		},
+		{
+			name: "not reported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBody(t, testHandler(t, testFetcher{
+				fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+					d := testData()
+					d.BootTime = tt.boot
+					return d, nil
+				},
+			}, "foo"))
+
+			if tt.series == "" {
+				if bytes.Contains(b, []byte("keylight_device_boot_time_seconds{")) {
+					t.Fatal("boot time was exported for a device which did not report it")
+				}
+				return
+			}
+
+			if !bytes.Contains(b, []byte(tt.series+"\n")) {
+				t.Fatalf("boot time metric was not found: %s", tt.series)
+			}
+		})
+	}
+}
+
+func TestHandlerFirmwareBuildNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		build  int
+		series string
+	}{
+		{
+			name:   "reported",
+			build:  218,
+			series: `keylight_firmware_build_number{serial="1111"} 218`,
+		},
+		{
+			// The device API reports the build as a JSON number, so it is
+			// numeric whenever it is present.
+			name: "not reported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBody(t, testHandler(t, testFetcher{
+				fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+					d := testData()
+					d.Device.FirmwareBuildNumber = tt.build
+					return d, nil
+				},
+			}, "foo"))
+
+			if tt.series == "" {
+				if bytes.Contains(b, []byte("keylight_firmware_build_number{")) {
+					t.Fatal("firmware build was exported for a device which did not report it")
+				}
+				return
+			}
+
+			if !bytes.Contains(b, []byte(tt.series+"\n")) {
+				t.Fatalf("firmware build metric was not found: %s", tt.series)
+			}
+		})
+	}
+}
+
+func TestHandlerEstimatedPower(t *testing.T) {
+	// No estimate is exported unless configured.
+	b := testBody(t, testGet(t, testServer(t, testDataFetcher()), "foo"))
+	if bytes.Contains(b, []byte("keylight_light_power_watts")) {
+		t.Fatal("power metric was exported without an estimate configured")
+	}
+
+	b = testBody(t, testGet(t, testServer(t, testDataFetcher(), keylightexporter.WithEstimatedPower(25)), "foo"))
 
-	srv := httptest.NewServer(keylightexporter.NewHandler(prometheus.NewPedanticRegistry(), f))
+	for _, m := range []string{
+		`keylight_light_power_watts{light="light0",name="test",serial="1111"} 5`,
+		`keylight_light_power_watts{light="light1",name="test",serial="1111"} 0`,
+	} {
+		if !bytes.Contains(b, []byte(m+"\n")) {
+			t.Fatalf("power metric was not found: %s", m)
+		}
+	}
+}
+
+func TestHandlerBuildInfo(t *testing.T) {
+	b := testBody(t, testGet(t, testServer(t, testDataFetcher()), "foo"))
+
+	re := regexp.MustCompile(`(?m)^keylight_exporter_build_info\{commit="[^"]+",goversion="(go[^"]+)",version="[^"]+"\} 1$`)
+	m := re.FindSubmatch(b)
+	if m == nil {
+		t.Fatal("build info metric was not found")
+	}
+
+	if diff := cmp.Diff(runtime.Version(), string(m[1])); diff != "" {
+		t.Fatalf("unexpected Go version (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerRequestMetrics(t *testing.T) {
+	// The exporter binary registers the Go and process collectors with the
+	// same registry.
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	srv := httptest.NewServer(keylightexporter.NewHandler(reg, testDataFetcher()))
 	defer srv.Close()
 
-	u, err := url.Parse(srv.URL)
+	_ = testBody(t, testGet(t, srv, "foo"))
+
+	res := testGet(t, srv, "")
+	_ = res.Body.Close()
+
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	// Requests are counted once served, so the current request is only
+	// reported as in flight.
+	for _, s := range []string{
+		`keylight_exporter_requests_total{code="200"} 1`,
+		`keylight_exporter_requests_total{code="400"} 1`,
+		`keylight_exporter_requests_in_flight 1`,
+	} {
+		if !bytes.Contains(b, []byte(s+"\n")) {
+			t.Errorf("request series was not found: %s", s)
+		}
+	}
+}
+
+func TestHandlerNamespace(t *testing.T) {
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithNamespace("mylights"))
+
+	// Scrape twice so that exporter counters are also reported.
+	_ = testBody(t, testGet(t, srv, "foo"))
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	for _, s := range []string{
+		`mylights_up{serial="1111",target="http://foo:9123"} 1`,
+		`mylights_light_on{light="light0",name="test",serial="1111"} 1`,
+		`mylights_exporter_brightness_distribution_count 2`,
+	} {
+		if !bytes.Contains(b, []byte(s+"\n")) {
+			t.Errorf("namespaced series was not found: %s", s)
+		}
+	}
+
+	if bytes.Contains(b, []byte("keylight_")) {
+		t.Fatalf("found series with default namespace:\n%s", b)
+	}
+}
+
+func TestHandlerFetchFailure(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			return nil, errors.New("device unreachable")
+		},
+	})
+
+	// The scrape succeeds so that Prometheus records the device as down.
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	up := upMetric(false, "http://foo:9123")
+	if !bytes.Contains(b, []byte(up)) {
+		t.Fatalf("up metric was not found: %s", up)
+	}
+
+	if !matchDevice(t, b, []string{
+		up,
+		`keylight_scrape_errors_total{reason="other"} 1`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
+
+func TestHandlerLogger(t *testing.T) {
+	// Fetches and requests are logged before the response is complete.
+	var buf bytes.Buffer
+	ll := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			// Remove non-deterministic attributes.
+			switch a.Key {
+			case slog.TimeKey, "elapsed":
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if addr == "http://bar:9123" {
+				return nil, errors.New("device unreachable")
+			}
+
+			return testData(), nil
+		},
+	}, keylightexporter.WithLogger(ll))
+
+	_ = testBody(t, testGet(t, srv, "foo"))
+	_ = testBody(t, testGet(t, srv, "bar"))
+
+	// Requests which fail are also logged, with their status code.
+	res, err := http.Get(srv.URL)
 	if err != nil {
-		t.Fatalf("failed to parse URL: %v", err)
+		t.Fatalf("failed to perform HTTP request: %v", err)
 	}
+	defer res.Body.Close()
 
-	q := u.Query()
-	q.Set("target", target)
-	u.RawQuery = q.Encode()
+	if _, err := io.ReadAll(res.Body); err != nil {
+		t.Fatalf("failed to read HTTP body: %v", err)
+	}
 
-	c := &http.Client{Timeout: 1 * time.Second}
-	res, err := c.Get(u.String())
+	want := strings.Join([]string{
+		`level=DEBUG msg="fetched data from device" target=http://foo:9123`,
+		`level=DEBUG msg="served request" method=GET path=/ target=foo status=200`,
+		`level=WARN msg="failed to fetch data from device" target=http://bar:9123 err="device unreachable"`,
+		`level=DEBUG msg="served request" method=GET path=/ target=bar status=200`,
+		`level=DEBUG msg="served request" method=GET path=/ target="" status=400`,
+		"",
+	}, "\n")
+
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("unexpected log output (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var buf bytes.Buffer
+	ll := slog.New(slog.NewTextHandler(&buf, nil))
+
+	// A Fetcher which returns malformed Data causes a panic while scraping.
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			return &keylightexporter.Data{}, nil
+		},
+	}, keylightexporter.WithLogger(ll))
+
+	res, err := srv.Client().Get(srv.URL + "?target=foo")
 	if err != nil {
 		t.Fatalf("failed to perform HTTP request: %v", err)
 	}
+	defer res.Body.Close()
 
-	return res
+	if diff := cmp.Diff(http.StatusInternalServerError, res.StatusCode); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+
+	const msg = `level=ERROR msg="recovered from panic while serving request" path=/ target=foo`
+	if !strings.Contains(buf.String(), msg) {
+		t.Fatalf("unexpected log output:\n%s", buf.String())
+	}
+
+	// The handler continues to serve subsequent requests.
+	_ = testBody(t, testHandler(t, testDataFetcher(), "foo"))
 }
 
-func panicf(format string, a ...interface{}) {
-	panic(fmt.Sprintf(format, a...))
+func TestHandlerHelp(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader("targets:\n  office:\n    address: foo\n    baseline:\n      on: true\n")); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	// Report every optional value and enable every option which adds
+	// metrics, so that all of the metrics are gathered.
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			d := testData()
+			d.Proto = "HTTP/1.1"
+			d.WiFiRSSI = -48
+			d.BootTime = time.Unix(1, 0)
+			d.TemperatureMin, d.TemperatureMax = 2900, 7000
+			d.ConnectDuration, d.TransferDuration = time.Millisecond, time.Millisecond
+			return d, nil
+		},
+	},
+		keylightexporter.WithNamedTargets(nt),
+		keylightexporter.WithDebug(),
+		keylightexporter.WithEstimatedPower(25),
+		keylightexporter.WithCache(time.Minute),
+		keylightexporter.WithCircuitBreaker(3, time.Minute),
+		keylightexporter.WithCardinalityLimit(100),
+	)
+
+	// The debug series are gathered once a request completes.
+	_ = testBody(t, testGet(t, srv, "office"))
+
+	var p expfmt.TextParser
+	mfs, err := p.TextToMetricFamilies(testGet(t, srv, "office").Body)
+	if err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+
+	for _, name := range []string{
+		"keylight_info",
+		"keylight_light_on",
+		"keylight_light_power_watts",
+		"keylight_light_drift",
+		"keylight_circuit_open",
+		"keylight_cache_age_seconds",
+		"keylight_exporter_series_emitted_total",
+	} {
+		if _, ok := mfs[name]; !ok {
+			t.Fatalf("metric %q was not gathered", name)
+		}
+	}
+
+	for name, mf := range mfs {
+		help := mf.GetHelp()
+		if help == "" {
+			t.Errorf("metric %q has no help text", name)
+			continue
+		}
+
+		if !strings.HasSuffix(help, ".") {
+			t.Errorf("help text for metric %q is not a sentence: %q", name, help)
+		}
+	}
+}
+
+func TestHandlerNoLights(t *testing.T) {
+	var buf bytes.Buffer
+	ll := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			switch a.Key {
+			case slog.TimeKey, "elapsed":
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			d := testData()
+			d.Lights = []*keylight.Light{}
+			return d, nil
+		},
+	}, keylightexporter.WithLogger(ll))
+
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	// The device is up and explicitly reports that it has no lights.
+	if !matchDevice(t, b, []string{
+		upMetric(true, "http://foo:9123"),
+		`keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`,
+		`keylight_firmware_build_number{serial="1111"} 192`,
+		`keylight_lights{serial="1111"} 0`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+
+	const want = `level=WARN msg="fetched no lights from device" target=http://foo:9123` + "\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("unexpected log output (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerMultipleTargets(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			switch addr {
+			case "http://foo:9123":
+				return testData(), nil
+			case "http://bar:9123":
+				d := testData()
+				d.Device.SerialNumber = "2222"
+				d.Lights = d.Lights[:1]
+				return d, nil
+			default:
+				return nil, errors.New("device unreachable")
+			}
+		},
+	})
+
+	// A failure of one target must not affect the others, and duplicate
+	// targets are only fetched once.
+	b := testBody(t, testGet(t, srv, "foo,bar,baz,foo"))
+
+	if !matchDevice(t, b, []string{
+		upMetric(true, "http://foo:9123"),
+		`keylight_up{serial="2222",target="http://bar:9123"} 1`,
+		upMetric(false, "http://baz:9123"),
+		`keylight_scrape_errors_total{reason="other"} 1`,
+		`keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`,
+		`keylight_firmware_build_number{serial="1111"} 192`,
+		`keylight_lights{serial="1111"} 2`,
+		`keylight_info{address="http://bar:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="2222"} 1`,
+		`keylight_firmware_build_number{serial="2222"} 192`,
+		`keylight_lights{serial="2222"} 1`,
+		`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+		`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+		`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+		`keylight_light_on{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_color_temperature_kelvin{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_color_temperature_mireds{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_on{light="light0",name="test",serial="2222"} 1`,
+		`keylight_light_brightness_percent{light="light0",name="test",serial="2222"} 20`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="2222"} 0.2`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="2222"} 4200`,
+		`keylight_light_color_temperature_mireds{light="light0",name="test",serial="2222"} 238.0952380952381`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+
+	for _, up := range []string{
+		upMetric(true, "http://foo:9123"),
+		`keylight_up{serial="2222",target="http://bar:9123"} 1`,
+		upMetric(false, "http://baz:9123"),
+	} {
+		if !bytes.Contains(b, []byte(up)) {
+			t.Fatalf("up metric was not found: %s", up)
+		}
+	}
+}
+
+func TestHandlerUpLastKnownSerial(t *testing.T) {
+	var down atomic.Bool
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if down.Load() || addr == "http://bar:9123" {
+				return nil, errors.New("device unreachable")
+			}
+
+			return testData(), nil
+		},
+	})
+
+	// ups returns the keylight_up series in b.
+	ups := func(b []byte) []string {
+		var out []string
+		for _, l := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(l, "keylight_up{") {
+				out = append(out, l)
+			}
+		}
+
+		return out
+	}
+
+	// The device is identified by both its serial and its address while up,
+	// and by the same labels once it goes down, while a device which has
+	// never been fetched has no known serial.
+	b := testBody(t, testGet(t, srv, "foo,bar"))
+	want := []string{
+		upMetric(false, "http://bar:9123"),
+		upMetric(true, "http://foo:9123"),
+	}
+	if diff := cmp.Diff(want, ups(b)); diff != "" {
+		t.Fatalf("unexpected up series while device is up (-want +got):\n%s", diff)
+	}
+
+	down.Store(true)
+	b = testBody(t, testGet(t, srv, "foo,bar"))
+	want = []string{
+		upMetric(false, "http://bar:9123"),
+		`keylight_up{serial="1111",target="http://foo:9123"} 0`,
+	}
+	if diff := cmp.Diff(want, ups(b)); diff != "" {
+		t.Fatalf("unexpected up series while device is down (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerDuplicateSerial(t *testing.T) {
+	// The same device is reachable via link-local addresses on two
+	// interfaces.
+	srv := testServer(t, testDataFetcher())
+
+	// lines returns the device series other than keylight_info and
+	// keylight_up, which identify the device regardless of its address.
+	lines := func(b []byte) []string {
+		var out []string
+		for _, l := range deviceLines(b) {
+			if !strings.HasPrefix(l, "keylight_info{") && !strings.HasPrefix(l, "keylight_up{") {
+				out = append(out, l)
+			}
+		}
+
+		return out
+	}
+
+	// The device is only served once, for the first of its addresses.
+	both := testBody(t, testGet(t, srv, "fe80::1%eth1,fe80::1%eth0"))
+
+	const info = `keylight_info{address="http://[fe80::1%25eth0]:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`
+	if !bytes.Contains(both, []byte(info+"\n")) {
+		t.Fatalf("info metric was not found: %s", info)
+	}
+
+	for _, s := range []string{
+		`keylight_scrape_consecutive_failures{target="http://[fe80::1%25eth0]:9123"} 0`,
+		`keylight_scrape_consecutive_failures{target="http://[fe80::1%25eth1]:9123"} 0`,
+	} {
+		if !bytes.Contains(both, []byte(s+"\n")) {
+			t.Fatalf("target metric was not found: %s", s)
+		}
+	}
+
+	// Each address, however it is spelled, produces the same series.
+	for _, target := range []string{"fe80::1%eth0", "[FE80:0::1%eth1]:9123"} {
+		b := testBody(t, testGet(t, srv, target))
+		if diff := cmp.Diff(lines(both), lines(b)); diff != "" {
+			t.Fatalf("unexpected device series for %q (-want +got):\n%s", target, diff)
+		}
+	}
+}
+
+func TestHandlerDuplicateSerialStale(t *testing.T) {
+	// Both addresses of the device are served stale data from a cache, so
+	// both are reported as down.
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			d := testData()
+			d.CachedAt = time.Now()
+			d.StaleErr = errors.New("device is unreachable")
+			return d, nil
+		},
+	})
+
+	b := testBody(t, testGet(t, srv, "fe80::1%eth1,fe80::1%eth0"))
+
+	for _, s := range []string{
+		`keylight_scrape_consecutive_failures{target="http://[fe80::1%25eth0]:9123"} 1`,
+		`keylight_scrape_consecutive_failures{target="http://[fe80::1%25eth1]:9123"} 1`,
+	} {
+		if !bytes.Contains(b, []byte(s+"\n")) {
+			t.Fatalf("target metric was not found: %s\n%s", s, b)
+		}
+	}
+}
+
+func TestHandlerProbePath(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		path   string
+		addr   string
+	}{
+		{
+			name:   "host",
+			target: "foo",
+			path:   "/probe/foo",
+			addr:   "http://foo:9123",
+		},
+		{
+			name:   "host:port",
+			target: "192.168.1.5:9123",
+			path:   "/probe/192.168.1.5:9123",
+			addr:   "http://192.168.1.5:9123",
+		},
+		{
+			name:   "percent-encoded",
+			target: "[fe80::1]:9123",
+			path:   "/probe/%5Bfe80::1%5D:9123",
+			addr:   "http://[fe80::1]:9123",
+		},
+		{
+			name:   "multiple",
+			target: "foo,bar",
+			path:   "/probe/foo,bar",
+			addr:   "http://bar:9123,http://foo:9123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				addrs []string
+			)
+
+			srv := testServer(t, testFetcher{
+				fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					addrs = append(addrs, addr)
+
+					d := testData()
+					d.Device.SerialNumber = addr
+					return d, nil
+				},
+			})
+
+			query := testBody(t, testGet(t, srv, tt.target))
+
+			res, err := http.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			path := testBody(t, res)
+
+			// Both forms fetch the same devices and emit the same device
+			// metrics.
+			want := strings.Split(tt.addr, ",")
+			want = append(want, want...)
+			sort.Strings(want)
+			sort.Strings(addrs)
+
+			if diff := cmp.Diff(want, addrs); diff != "" {
+				t.Fatalf("unexpected device addresses (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(deviceLines(query), deviceLines(path)); diff != "" {
+				t.Fatalf("unexpected metrics for path target (-query +path):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerDefaultPort(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		addrs []string
+	)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			addrs = append(addrs, addr)
+
+			d := testData()
+			d.Device.SerialNumber = addr
+			return d, nil
+		},
+	}, keylightexporter.WithDefaultPort(8080))
+
+	// Only targets without an explicit port use the default.
+	_ = testBody(t, testGet(t, srv, "foo,bar:9123,[fe80::1],https://baz:8443"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(addrs)
+
+	want := []string{
+		"http://[fe80::1]:8080",
+		"http://bar:9123",
+		"http://foo:8080",
+		"https://baz:8443",
+	}
+	if diff := cmp.Diff(want, addrs); diff != "" {
+		t.Fatalf("unexpected device addresses (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerProbePathErrors(t *testing.T) {
+	srv := testServer(t, testDataFetcher())
+
+	for _, path := range []string{
+		"/probe/",
+		"/probe/foo?target=bar",
+		"/probe/foo%2Fbar",
+	} {
+		t.Run(path, func(t *testing.T) {
+			res, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			_ = res.Body.Close()
+
+			if diff := cmp.Diff(http.StatusBadRequest, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// deviceLines returns the device metric lines of b, omitting comments and the
+// exporter metrics, scrape timings, and scrape state which vary between
+// scrapes.
+func deviceLines(b []byte) []string {
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l == "" || strings.HasPrefix(l, "#") ||
+			strings.HasPrefix(l, "keylight_exporter_") ||
+			strings.HasPrefix(l, "keylight_scrape_duration_seconds") ||
+			strings.HasPrefix(l, "keylight_scrape_connect_seconds") ||
+			strings.HasPrefix(l, "keylight_scrape_transfer_seconds") ||
+			strings.HasPrefix(l, "keylight_cache_age_seconds") ||
+			strings.HasPrefix(l, "keylight_scrape_consecutive_failures") ||
+			strings.HasPrefix(l, "keylight_last_success_timestamp_seconds") {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return lines
+}
+
+func TestHandlerMaxTargetConcurrency(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		active, max int
+	)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			active++
+			if active > max {
+				max = active
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+
+			d := testData()
+			d.Device.SerialNumber = addr
+			return d, nil
+		},
+	}, keylightexporter.WithMaxTargetConcurrency(2))
+
+	// All four slow targets are served, but only two are fetched at once.
+	b := testBody(t, testGet(t, srv, "a,b,c,d"))
+	for _, serial := range []string{"a", "b", "c", "d"} {
+		up := fmt.Sprintf(`keylight_up{serial="http://%[1]s:9123",target="http://%[1]s:9123"} 1`, serial)
+		if !bytes.Contains(b, []byte(up+"\n")) {
+			t.Fatalf("up metric was not found: %s", up)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff(2, max); diff != "" {
+		t.Fatalf("unexpected maximum concurrent fetches (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerMaxTargetsPerRequest(t *testing.T) {
+	var fetches atomic.Int32
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			fetches.Add(1)
+
+			d := testData()
+			d.Device.SerialNumber = addr
+			return d, nil
+		},
+	}, keylightexporter.WithMaxTargetsPerRequest(2))
+
+	res := testGet(t, srv, "a,b,c")
+	defer res.Body.Close()
+
+	if diff := cmp.Diff(http.StatusBadRequest, res.StatusCode); diff != "" {
+		t.Fatalf("unexpected HTTP status (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(int32(0), fetches.Load()); diff != "" {
+		t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+	}
+
+	// A request at the limit is scraped as usual.
+	_ = testBody(t, testGet(t, srv, "a,b"))
+
+	if diff := cmp.Diff(int32(2), fetches.Load()); diff != "" {
+		t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerMaxConcurrency(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if addr == "http://slow:9123" {
+				// Hold the only slot until the test releases it.
+				close(entered)
+				<-release
+			}
+
+			return testData(), nil
+		},
+	},
+		keylightexporter.WithMaxConcurrency(1),
+		keylightexporter.WithTimeout(100*time.Millisecond),
+	)
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+	done := func() {
+		once.Do(func() { close(release) })
+		wg.Wait()
+	}
+	defer done()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		res, err := http.Get(srv.URL + "?target=slow")
+		if err != nil {
+			t.Errorf("failed to perform HTTP request: %v", err)
+			return
+		}
+		_ = res.Body.Close()
+	}()
+
+	<-entered
+
+	// The slow device holds the only slot, so the fast device is reported as
+	// down once the scrape times out.
+	b := testBody(t, testGet(t, srv, "fast"))
+	if up := upMetric(false, "http://fast:9123"); !bytes.Contains(b, []byte(up)) {
+		t.Fatalf("up metric was not found: %s", up)
+	}
+
+	done()
+
+	// Once the slot is released, the fast device can be scraped again.
+	b = testBody(t, testGet(t, srv, "fast"))
+	if up := upMetric(true, "http://fast:9123"); !bytes.Contains(b, []byte(up)) {
+		t.Fatalf("up metric was not found: %s", up)
+	}
+}
+
+func TestHandlerMethodNotAllowed(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			panic("fetch should not be called")
+		},
+	})
+
+	for _, m := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		t.Run(m, func(t *testing.T) {
+			req, err := http.NewRequest(m, srv.URL+"?target=foo", nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			if diff := cmp.Diff(http.StatusMethodNotAllowed, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff("GET, HEAD", res.Header.Get("Allow")); diff != "" {
+				t.Fatalf("unexpected Allow header (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerOpenMetrics(t *testing.T) {
+	srv := testServer(t, testDataFetcher())
+
+	tests := []struct {
+		name, accept, contentType string
+		eof                       bool
+	}{
+		{
+			name:        "default",
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+		},
+		{
+			name:        "OpenMetrics",
+			accept:      "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			contentType: "application/openmetrics-text; version=0.0.1; charset=utf-8",
+			eof:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/?target=foo", nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.contentType, res.Header.Get("Content-Type")); diff != "" {
+				t.Fatalf("unexpected Content-Type (-want +got):\n%s", diff)
+			}
+
+			defer res.Body.Close()
+
+			// The Prometheus linter does not understand OpenMetrics, so read
+			// the body directly.
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("failed to read HTTP body: %v", err)
+			}
+
+			const typ = "# TYPE keylight_light_color_temperature_kelvin gauge\n"
+			if !bytes.Contains(b, []byte(typ)) {
+				t.Fatalf("color temperature type was not found: %s", typ)
+			}
+
+			// Only OpenMetrics terminates the exposition with an EOF marker.
+			if diff := cmp.Diff(tt.eof, bytes.HasSuffix(b, []byte("# EOF\n"))); diff != "" {
+				t.Fatalf("unexpected EOF marker (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerGzip(t *testing.T) {
+	srv := testServer(t, testDataFetcher())
+
+	tests := []struct {
+		name, accept, encoding string
+	}{
+		{name: "identity", accept: "identity"},
+		{name: "gzip", accept: "gzip", encoding: "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/?target=foo", nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+
+			// Setting the header explicitly disables the transparent
+			// decompression of the HTTP client.
+			req.Header.Set("Accept-Encoding", tt.accept)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			if diff := cmp.Diff(tt.encoding, res.Header.Get("Content-Encoding")); diff != "" {
+				t.Fatalf("unexpected Content-Encoding (-want +got):\n%s", diff)
+			}
+
+			body := io.Reader(res.Body)
+			if tt.encoding == "gzip" {
+				zr, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("failed to create gzip reader: %v", err)
+				}
+				defer zr.Close()
+
+				body = zr
+			}
+
+			b, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("failed to read HTTP body: %v", err)
+			}
+
+			if !promtest.Lint(t, b) {
+				t.Fatal("failed to lint Prometheus metrics")
+			}
+			if !matchDevice(t, b, []string{
+				upMetric(true, "http://foo:9123"),
+				`keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`,
+				`keylight_firmware_build_number{serial="1111"} 192`,
+				`keylight_lights{serial="1111"} 2`,
+				`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+				`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+				`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+				`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+				`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+				`keylight_light_on{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_kelvin{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_mireds{light="light1",name="test",serial="1111"} 0`,
+			}) {
+				t.Fatal("failed to match Prometheus metrics")
+			}
+		})
+	}
+}
+
+func TestHandlerErrorContentType(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			return nil, errors.New("device unreachable")
+		},
+	})
+
+	const (
+		jsonType  = "application/json"
+		plainType = "text/plain; charset=utf-8"
+	)
+
+	tests := []struct {
+		name, path, accept string
+		code               int
+		contentType, body  string
+	}{
+		{
+			name:        "missing target text",
+			path:        "/",
+			code:        http.StatusBadRequest,
+			contentType: plainType,
+			body:        "missing target parameter\n",
+		},
+		{
+			name:        "missing target JSON",
+			path:        "/",
+			accept:      jsonType,
+			code:        http.StatusBadRequest,
+			contentType: jsonType,
+			body:        `{"error":"missing target parameter","target":""}` + "\n",
+		},
+		{
+			name:        "malformed target text",
+			path:        "/?target=foo,,bar",
+			code:        http.StatusBadRequest,
+			contentType: plainType,
+			body:        "malformed target parameter: empty target\n",
+		},
+		{
+			name:        "malformed target JSON",
+			path:        "/?target=foo,,bar",
+			accept:      "application/json; charset=utf-8, text/plain;q=0.5",
+			code:        http.StatusBadRequest,
+			contentType: jsonType,
+			body:        `{"error":"malformed target parameter: empty target","target":"foo,,bar"}` + "\n",
+		},
+		{
+			name:        "wildcard",
+			path:        "/",
+			accept:      "text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			code:        http.StatusBadRequest,
+			contentType: plainType,
+			body:        "missing target parameter\n",
+		},
+		{
+			// Devices which cannot be fetched are reported as down rather
+			// than failing the request, regardless of the Accept header.
+			name:        "fetch failure JSON",
+			path:        "/?target=foo",
+			accept:      jsonType,
+			code:        http.StatusOK,
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.contentType, res.Header.Get("Content-Type")); diff != "" {
+				t.Fatalf("unexpected Content-Type (-want +got):\n%s", diff)
+			}
+
+			if tt.body == "" {
+				return
+			}
+
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("failed to read HTTP body: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.body, string(b)); diff != "" {
+				t.Fatalf("unexpected HTTP body (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerDebugSeriesEmitted(t *testing.T) {
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithDebug())
+
+	// Series are counted once each request completes, so the first request
+	// populates the counter and the second reports it.
+	_ = testBody(t, testGet(t, srv, "foo"))
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	// One up, one info, one firmware build, one scrape duration, one lights,
+	// and one consecutive failures series, plus five series for each of the
+	// two lights.
+	const series = `keylight_exporter_series_emitted_total{serial="1111"} 16`
+	if !bytes.Contains(b, []byte(series)) {
+		t.Fatalf("series emitted counter was not found: %s", series)
+	}
+
+	if !matchDevice(t, b, []string{
+		upMetric(true, "http://foo:9123"),
+		`keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`,
+		`keylight_firmware_build_number{serial="1111"} 192`,
+		`keylight_lights{serial="1111"} 2`,
+		`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+		`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+		`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+		`keylight_light_on{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_color_temperature_kelvin{light="light1",name="test",serial="1111"} 0`,
+		`keylight_light_color_temperature_mireds{light="light1",name="test",serial="1111"} 0`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+}
+
+func TestHandlerConcurrentTargets(t *testing.T) {
+	var (
+		entered = make(chan struct{}, 3)
+		release = make(chan struct{})
+	)
+
+	// Block each request while the shared registry is gathered so that
+	// concurrent requests can be observed.
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(&blockingCollector{
+		entered: entered,
+		release: release,
+	})
+
+	srv := httptest.NewServer(keylightexporter.NewHandler(reg, testDataFetcher()))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	defer func() {
+		close(release)
+		wg.Wait()
+	}()
+
+	scrape := func(target string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := http.Get(srv.URL + "?target=" + target)
+			if err != nil {
+				t.Errorf("failed to perform HTTP request: %v", err)
+				return
+			}
+			_ = res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("unexpected HTTP status code: %d", res.StatusCode)
+			}
+		}()
+	}
+
+	wait := func() bool {
+		select {
+		case <-entered:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	// Each request gathers its devices using its own registry, so scrapes of
+	// the same target are no longer serialized.
+	for _, target := range []string{"foo", "bar", "foo"} {
+		scrape(target)
+		if !wait() {
+			t.Fatalf("scrape of %q was blocked", target)
+		}
+	}
+}
+
+func TestHandlerConcurrentTargetsIsolated(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			// Hold each fetch briefly so that the scrapes overlap.
+			time.Sleep(5 * time.Millisecond)
+
+			d := testData()
+			d.Device.SerialNumber = addr
+			return d, nil
+		},
+	})
+
+	const n = 16
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+
+			res, err := http.Get(srv.URL + "?target=" + target)
+			if err != nil {
+				t.Errorf("failed to perform HTTP request: %v", err)
+				return
+			}
+			defer res.Body.Close()
+
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Errorf("failed to read HTTP body: %v", err)
+				return
+			}
+
+			// Every device series of a scrape belongs to its own target.
+			want := fmt.Sprintf(`serial="http://%s:9123"`, target)
+			for _, l := range deviceLines(b) {
+				if !strings.Contains(l, "serial=") {
+					continue
+				}
+				if !strings.Contains(l, want) {
+					t.Errorf("scrape of %q contains series of another target: %s", target, l)
+				}
+			}
+		}(fmt.Sprintf("device%d", i))
+	}
+
+	wg.Wait()
+}
+
+// A blockingCollector is a prometheus.Collector which blocks until release is
+// closed.
+type blockingCollector struct {
+	entered chan<- struct{}
+	release <-chan struct{}
+}
+
+func (*blockingCollector) Describe(_ chan<- *prometheus.Desc) {}
+
+func (c *blockingCollector) Collect(_ chan<- prometheus.Metric) {
+	c.entered <- struct{}{}
+	<-c.release
+}
+
+func TestHandlerChangedLightsOnly(t *testing.T) {
+	var (
+		mu sync.Mutex
+		d  = testData()
+	)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			// Copy the lights so the fixture can be modified between scrapes.
+			out := *d
+			out.Lights = make([]*keylight.Light, 0, len(d.Lights))
+			for _, l := range d.Lights {
+				l := *l
+				out.Lights = append(out.Lights, &l)
+			}
+
+			return &out, nil
+		},
+	}, keylightexporter.WithChangedLightsOnly())
+
+	const (
+		up     = `keylight_up{serial="1111",target="http://foo:9123"} 1`
+		info   = `keylight_info{address="http://foo:9123",firmware="1.0.0",firmware_build="192",hardware_board_type="53",model="keylight",name="test",product="Elgato Key Light",serial="1111"} 1`
+		build  = `keylight_firmware_build_number{serial="1111"} 192`
+		lights = `keylight_lights{serial="1111"} 2`
+	)
+
+	tests := []struct {
+		name   string
+		modify func(d *keylightexporter.Data)
+		match  []string
+	}{
+		{
+			name: "initial",
+			match: []string{
+				up,
+				info,
+				build,
+				lights,
+				`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+				`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+				`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+				`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+				`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+				`keylight_light_on{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_kelvin{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_mireds{light="light1",name="test",serial="1111"} 0`,
+			},
+		},
+		{
+			name:  "unchanged",
+			match: []string{up, info, build, lights},
+		},
+		{
+			name: "light1 changed",
+			modify: func(d *keylightexporter.Data) {
+				d.Lights[1].On = true
+			},
+			match: []string{
+				up,
+				info,
+				build,
+				lights,
+				`keylight_light_on{light="light1",name="test",serial="1111"} 1`,
+				`keylight_light_brightness_percent{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_brightness_ratio{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_kelvin{light="light1",name="test",serial="1111"} 0`,
+				`keylight_light_color_temperature_mireds{light="light1",name="test",serial="1111"} 0`,
+			},
+		},
+	}
+
+	// Each scrape depends on the state from the previous one, so these
+	// subtests must run in order against the same handler.
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.modify != nil {
+				mu.Lock()
+				tt.modify(d)
+				mu.Unlock()
+			}
+
+			b := testBody(t, testGet(t, srv, "foo"))
+
+			if diff := cmp.Diff(len(tt.match), bytes.Count(b, []byte("\nkeylight_light_"))+4); diff != "" {
+				t.Fatalf("unexpected number of series (-want +got):\n%s", diff)
+			}
+
+			if !matchDevice(t, b, tt.match) {
+				t.Fatal("failed to match Prometheus metrics")
+			}
+		})
+	}
+}
+
+func TestHandlerBrightnessDistribution(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			d := testData()
+			d.Lights = append(d.Lights,
+				&keylight.Light{On: true, Brightness: 75},
+				// Off lights are not observed, regardless of brightness.
+				&keylight.Light{On: false, Brightness: 100},
+			)
+
+			return d, nil
+		},
+	})
+
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	for _, m := range []string{
+		`keylight_exporter_brightness_distribution_bucket{le="10"} 0`,
+		`keylight_exporter_brightness_distribution_bucket{le="20"} 1`,
+		`keylight_exporter_brightness_distribution_bucket{le="80"} 2`,
+		`keylight_exporter_brightness_distribution_sum 95`,
+		`keylight_exporter_brightness_distribution_count 2`,
+	} {
+		if !bytes.Contains(b, []byte(m+"\n")) {
+			t.Fatalf("brightness distribution series was not found: %s", m)
+		}
+	}
+}
+
+func TestHandlerSanitizeLabels(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			d := testData()
+			d.Device.DisplayName = "bad\xffname\x07"
+			d.Lights = nil
+			return d, nil
+		},
+	})
+
+	b := testBody(t, testGet(t, srv, "foo"))
+
+	if !matchDevice(t, b, []string{
+		upMetric(true, "http://foo:9123"),
+		"keylight_info{address=\"http://foo:9123\",firmware=\"1.0.0\",firmware_build=\"192\",hardware_board_type=\"53\",model=\"keylight\",name=\"bad\uFFFDname\",product=\"Elgato Key Light\",serial=\"1111\"} 1",
+		`keylight_firmware_build_number{serial="1111"} 192`,
+		`keylight_lights{serial="1111"} 0`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+
+	const sanitized = "keylight_exporter_label_values_sanitized_total 1\n"
+	if !bytes.Contains(b, []byte(sanitized)) {
+		t.Fatalf("sanitized label values counter was not found: %s", sanitized)
+	}
+}
+
+func TestHandlerCardinalityLimit(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		serial int
+	)
+
+	var buf bytes.Buffer
+	ll := slog.New(slog.NewTextHandler(&buf, nil))
+
+	// Each scrape emits 16 series for a new serial.
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			serial++
+			d := testData()
+			d.Device.SerialNumber = strconv.Itoa(serial)
+			return d, nil
+		},
+	}, keylightexporter.WithCardinalityLimit(16), keylightexporter.WithLogger(ll))
+
+	// Drive the exporter past the limit with 3 scrapes (48 series), the last 2
+	// of which exceed the limit. Warnings are reported once each scrape
+	// completes, so a fourth scrape reports them.
+	var b []byte
+	for i := 0; i < 4; i++ {
+		b = testBody(t, testGet(t, srv, "foo"))
+	}
+
+	const warnings = "keylight_exporter_high_cardinality_warnings_total 2\n"
+	if !bytes.Contains(b, []byte(warnings)) {
+		t.Fatalf("high cardinality warnings counter was not found: %s", warnings)
+	}
+
+	const msg = `level=WARN msg="device series exceed the cardinality limit" target=http://foo:9123 serial=3 limit=16 series=31`
+	if !strings.Contains(buf.String(), msg) {
+		t.Fatalf("unexpected log output:\n%s", buf.String())
+	}
+}
+
+type testFetcher struct {
+	fetch func(ctx context.Context, addr string) (*keylightexporter.Data, error)
+}
+
+func (f testFetcher) Fetch(ctx context.Context, addr string) (*keylightexporter.Data, error) {
+	return f.fetch(ctx, addr)
+}
+
+// testHandler performs a single HTTP request to a handler created using
+// NewHandler, using the specified target and options.
+func testHandler(
+	t *testing.T,
+	f keylightexporter.Fetcher,
+	target string,
+	opts ...keylightexporter.Option,
+) *http.Response {
+	t.Helper()
+
+	return testGet(t, testServer(t, f, opts...), target)
+}
+
+// testServer creates an HTTP server for a handler created using NewHandler,
+// so that multiple requests may be performed against a single handler.
+func testServer(t *testing.T, f keylightexporter.Fetcher, opts ...keylightexporter.Option) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(keylightexporter.NewHandler(prometheus.NewPedanticRegistry(), f, opts...))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// testGet performs a single HTTP request against srv using the specified
+// target.
+func testGet(t *testing.T, srv *httptest.Server, target string) *http.Response {
+	t.Helper()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse URL: %v", err)
+	}
+
+	q := u.Query()
+	q.Set("target", target)
+	u.RawQuery = q.Encode()
+
+	c := &http.Client{Timeout: 1 * time.Second}
+	res, err := c.Get(u.String())
+	if err != nil {
+		t.Fatalf("failed to perform HTTP request: %v", err)
+	}
+
+	return res
+}
+
+// testBody reads the body of res, verifying that the request succeeded and
+// that the body contains well-formed Prometheus metrics.
+func testBody(t *testing.T, res *http.Response) []byte {
+	t.Helper()
+	defer res.Body.Close()
+
+	if diff := cmp.Diff(http.StatusOK, res.StatusCode); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read HTTP body: %v", err)
+	}
+
+	if !promtest.Lint(t, b) {
+		t.Fatal("failed to lint Prometheus metrics")
+	}
+
+	return b
+}
+
+// matchDevice reports whether each device metric in body matches a metric
+// from the input metrics slice, ignoring exporter metrics and device metrics
+// with non-deterministic values.
+func matchDevice(t *testing.T, body []byte, metrics []string) bool {
+	t.Helper()
+
+	ignore := [][]byte{
+		[]byte("keylight_exporter_"),
+		[]byte("keylight_scrape_duration_seconds"),
+		[]byte("keylight_scrape_connect_seconds"),
+		[]byte("keylight_scrape_transfer_seconds"),
+		[]byte("keylight_cache_age_seconds"),
+		[]byte("keylight_scrape_consecutive_failures"),
+		[]byte("keylight_last_success_timestamp_seconds"),
+	}
+
+	var device []byte
+	for _, l := range bytes.SplitAfter(body, []byte("\n")) {
+		var skip bool
+		for _, prefix := range ignore {
+			if bytes.HasPrefix(l, prefix) {
+				skip = true
+				break
+			}
+		}
+
+		if !skip {
+			device = append(device, l...)
+		}
+	}
+
+	return promtest.Match(t, device, metrics)
+}
+
+// upMetric returns the keylight_up series expected for a successful scrape of
+// the fixture device, or for a failed scrape of addr.
+func upMetric(ok bool, addr string) string {
+	if ok {
+		return fmt.Sprintf(`keylight_up{serial="1111",target=%q} 1`, addr)
+	}
+
+	return fmt.Sprintf(`keylight_up{serial="",target=%q} 0`, addr)
+}
+
+// testData returns a fixture device with two lights.
+func testData() *keylightexporter.Data {
+	return &keylightexporter.Data{
+		Device: &keylight.Device{
+			ProductName:         "Elgato Key Light",
+			HardwareBoardType:   53,
+			FirmwareBuildNumber: 192,
+			DisplayName:         "test",
+			FirmwareVersion:     "1.0.0",
+			SerialNumber:        "1111",
+		},
+		Lights: []*keylight.Light{
+			{
+				On:          true,
+				Brightness:  20,
+				Temperature: 4200,
+			},
+			// A second light which is entirely off.
+			{},
+		},
+	}
+}
+
+// testDataFetcher returns a Fetcher which always returns testData.
+func testDataFetcher() testFetcher {
+	return testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			return testData(), nil
+		},
+	}
+}
+
+// testDevice creates an HTTP server which emulates the Key Light API for a
+// device with a single light. If fn is not nil, it is invoked before each
+// request is served.
+func testDevice(t *testing.T, fn func(r *http.Request)) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(testDeviceHandler(fn))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// testDeviceHandler returns an http.Handler for use with testDevice.
+func testDeviceHandler(fn func(r *http.Request)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/elgato/accessory-info", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, `{"displayName":"test","firmwareVersion":"1.0.0","serialNumber":"1111"}`)
+	})
+	mux.HandleFunc("/elgato/lights", func(w http.ResponseWriter, _ *http.Request) {
+		// Temperature is expressed in the device's own units, equivalent to
+		// 4200K.
+		_, _ = io.WriteString(w, `{"numberOfLights":1,"lights":[{"on":1,"brightness":20,"temperature":280}]}`)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fn != nil {
+			fn(r)
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func panicf(format string, a ...interface{}) {
+	panic(fmt.Sprintf(format, a...))
+}
+
+func BenchmarkHandlerConcurrentScrapes(b *testing.B) {
+	h := keylightexporter.NewHandler(prometheus.NewPedanticRegistry(), testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if addr == "http://slow:9123" {
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			d := testData()
+			d.Device.SerialNumber = addr
+			return d, nil
+		},
+	})
+
+	var n atomic.Int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Interleave scrapes of a fast device alone and alongside a slow device,
+	// so that any serialization between requests for the same device delays
+	// the scrapes of the fast device.
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			target := "fast"
+			if n.Add(1)%2 == 0 {
+				target = "fast,slow"
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?target="+target, nil))
+			if w.Code != http.StatusOK {
+				b.Errorf("unexpected HTTP status code: %d", w.Code)
+			}
+		}
+	})
 }
@@ -0,0 +1,122 @@
+package keylightexporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// inventoryPath is the HTTP path which serves a JSON summary of a device.
+const inventoryPath = "/inventory"
+
+// An inventory is a summary of the Data fetched from a single device, served
+// by the inventory endpoint.
+type inventory struct {
+	Target         string          `json:"target"`
+	Device         inventoryDevice `json:"device"`
+	Lights         []controlLight  `json:"lights"`
+	LightsError    string          `json:"lights_error,omitempty"`
+	StaleError     string          `json:"stale_error,omitempty"`
+	Proto          string          `json:"proto,omitempty"`
+	WiFiSignalDBM  int             `json:"wifi_signal_dbm,omitempty"`
+	BootTime       *time.Time      `json:"boot_time,omitempty"`
+	TemperatureMin int             `json:"temperature_min,omitempty"`
+	TemperatureMax int             `json:"temperature_max,omitempty"`
+	CachedAt       *time.Time      `json:"cached_at,omitempty"`
+}
+
+// An inventoryDevice is the metadata of a device, as reported by keylight_info.
+type inventoryDevice struct {
+	Name              string `json:"name"`
+	Serial            string `json:"serial"`
+	Product           string `json:"product"`
+	Firmware          string `json:"firmware"`
+	FirmwareBuild     int    `json:"firmware_build"`
+	HardwareBoardType int    `json:"hardware_board_type"`
+}
+
+// serveInventory fetches data from the single device specified by the target
+// of r, and serves a summary of the device as JSON.
+func (h *handler) serveInventory(w http.ResponseWriter, r *http.Request) {
+	target, err := requestTarget(r)
+	if err != nil {
+		httpError(w, r, err.Error(), r.URL.Query().Get("target"), http.StatusBadRequest)
+		return
+	}
+
+	addrs, _, ok := h.resolveTargets(w, r, target)
+	if !ok {
+		return
+	}
+	if len(addrs) != 1 {
+		httpError(w, r, "inventory target must specify a single device", target, http.StatusBadRequest)
+		return
+	}
+	addr := addrs[0]
+
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r, h.timeout))
+	defer cancel()
+
+	if !h.allowed(ctx, w, r, addrs) {
+		return
+	}
+
+	d, err := h.fetchDevice(ctx, addr)
+	if err != nil {
+		h.scrapeErrors(1, errorReason(err))
+		h.ll.Warn("failed to fetch data from device", "target", addr, "err", err)
+		httpError(w, r, "failed to fetch data from device", addr, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(newInventory(addr, d))
+}
+
+// newInventory summarizes the Data d fetched from the device at addr.
+func newInventory(addr string, d *Data) inventory {
+	inv := inventory{
+		Target: addr,
+		Device: inventoryDevice{
+			Name:              d.Device.DisplayName,
+			Serial:            d.Device.SerialNumber,
+			Product:           d.Device.ProductName,
+			Firmware:          d.Device.FirmwareVersion,
+			FirmwareBuild:     d.Device.FirmwareBuildNumber,
+			HardwareBoardType: d.Device.HardwareBoardType,
+		},
+		Lights:         make([]controlLight, 0, len(d.Lights)),
+		Proto:          d.Proto,
+		WiFiSignalDBM:  d.WiFiRSSI,
+		TemperatureMin: d.TemperatureMin,
+		TemperatureMax: d.TemperatureMax,
+	}
+
+	for i, l := range d.Lights {
+		inv.Lights = append(inv.Lights, controlLight{
+			Light:       "light" + strconv.Itoa(i),
+			On:          l.On,
+			Brightness:  l.Brightness,
+			Temperature: l.Temperature,
+		})
+	}
+
+	if d.LightsErr != nil {
+		inv.LightsError = d.LightsErr.Error()
+	}
+	if d.StaleErr != nil {
+		inv.StaleError = d.StaleErr.Error()
+	}
+	if !d.BootTime.IsZero() {
+		inv.BootTime = &d.BootTime
+	}
+	if !d.CachedAt.IsZero() {
+		inv.CachedAt = &d.CachedAt
+	}
+
+	return inv
+}
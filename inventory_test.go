@@ -0,0 +1,113 @@
+package keylightexporter_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerInventory(t *testing.T) {
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if addr == "http://bad:9123" {
+				return nil, errors.New("device unreachable")
+			}
+
+			d := testData()
+			d.Proto = "HTTP/1.1"
+			return d, nil
+		},
+	})
+
+	tests := []struct {
+		name, query string
+		code        int
+	}{
+		{
+			name:  "OK",
+			query: "?target=foo",
+			code:  http.StatusOK,
+		},
+		{
+			name: "missing target",
+			code: http.StatusBadRequest,
+		},
+		{
+			name:  "malformed target",
+			query: "?target=sftp://foo",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "multiple targets",
+			query: "?target=foo,bar",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "fetch error",
+			query: "?target=bad",
+			code:  http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/inventory" + tt.query)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+
+			if diff := cmp.Diff("application/json", res.Header.Get("Content-Type")); diff != "" {
+				t.Fatalf("unexpected Content-Type (-want +got):\n%s", diff)
+			}
+
+			var got map[string]any
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatalf("failed to decode JSON: %v", err)
+			}
+
+			want := map[string]any{
+				"target": "http://foo:9123",
+				"device": map[string]any{
+					"name":                "test",
+					"serial":              "1111",
+					"product":             "Elgato Key Light",
+					"firmware":            "1.0.0",
+					"firmware_build":      192.0,
+					"hardware_board_type": 53.0,
+				},
+				"lights": []any{
+					map[string]any{
+						"light":       "light0",
+						"on":          true,
+						"brightness":  20.0,
+						"temperature": 4200.0,
+					},
+					map[string]any{
+						"light":       "light1",
+						"on":          false,
+						"brightness":  0.0,
+						"temperature": 0.0,
+					},
+				},
+				"proto": "HTTP/1.1",
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("unexpected inventory (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package keylightexporter
+
+import (
+	"strings"
+
+	"github.com/mdlayher/keylight"
+)
+
+// modelUnknown is the model of a device which is not recognized.
+const modelUnknown = "unknown"
+
+// productModels maps the product names reported by devices to a normalized
+// model, so that devices may be grouped by model regardless of how their
+// firmware spells the product name. Product names are compared
+// case-insensitively.
+var productModels = map[string]string{
+	"elgato key light":      "keylight",
+	"elgato key light air":  "keylight_air",
+	"elgato key light mini": "keylight_mini",
+}
+
+// boardModels maps the hardware board types reported by devices to a
+// normalized model, for devices which do not report a recognized product name.
+var boardModels = map[int]string{
+	53:  "keylight",
+	200: "keylight_air",
+}
+
+// deviceModel returns the normalized model of d, identified by its product
+// name or otherwise by its hardware board type, or modelUnknown if neither is
+// recognized.
+func deviceModel(d *keylight.Device) string {
+	if m, ok := productModels[strings.ToLower(strings.TrimSpace(d.ProductName))]; ok {
+		return m
+	}
+	if m, ok := boardModels[d.HardwareBoardType]; ok {
+		return m
+	}
+
+	return modelUnknown
+}
@@ -0,0 +1,64 @@
+package keylightexporter
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+)
+
+func TestDeviceModel(t *testing.T) {
+	tests := []struct {
+		name string
+		d    keylight.Device
+		want string
+	}{
+		{
+			name: "Key Light",
+			d:    keylight.Device{ProductName: "Elgato Key Light", HardwareBoardType: 53},
+			want: "keylight",
+		},
+		{
+			name: "Key Light Air",
+			d:    keylight.Device{ProductName: "Elgato Key Light Air", HardwareBoardType: 200},
+			want: "keylight_air",
+		},
+		{
+			name: "Key Light Mini",
+			d:    keylight.Device{ProductName: "Elgato Key Light Mini"},
+			want: "keylight_mini",
+		},
+		{
+			name: "product case and whitespace",
+			d:    keylight.Device{ProductName: " elgato KEY LIGHT air "},
+			want: "keylight_air",
+		},
+		{
+			name: "board type only",
+			d:    keylight.Device{HardwareBoardType: 200},
+			want: "keylight_air",
+		},
+		{
+			name: "product takes precedence",
+			d:    keylight.Device{ProductName: "Elgato Key Light Mini", HardwareBoardType: 53},
+			want: "keylight_mini",
+		},
+		{
+			name: "unknown product",
+			d:    keylight.Device{ProductName: "Elgato Light Strip", HardwareBoardType: 70},
+			want: "unknown",
+		},
+		{
+			name: "empty",
+			want: "unknown",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, deviceModel(&tt.d)); diff != "" {
+				t.Fatalf("unexpected model (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package keylightexporter
+
+import (
+	"strings"
+
+	"github.com/mdlayher/metricslite"
+)
+
+// defaultNamespace is the prefix of all metric names unless a custom namespace
+// is configured.
+const defaultNamespace = "keylight"
+
+// metricName returns the name of the metric with default name s when using
+// namespace ns.
+func metricName(ns, s string) string {
+	return ns + strings.TrimPrefix(s, defaultNamespace)
+}
+
+var _ metricslite.Interface = &namespacedMetrics{}
+
+// A namespacedMetrics is a metricslite.Interface which replaces the default
+// namespace of each metric name with a custom namespace, so that the rest of
+// the package may refer to metrics by their default names.
+type namespacedMetrics struct {
+	mm metricslite.Interface
+	ns string
+}
+
+// withNamespace wraps mm so that its metrics use namespace ns. If ns is the
+// default namespace, mm is returned unmodified.
+func withNamespace(mm metricslite.Interface, ns string) metricslite.Interface {
+	if ns == defaultNamespace {
+		return mm
+	}
+
+	return &namespacedMetrics{mm: mm, ns: ns}
+}
+
+// ConstCounter implements metricslite.Interface.
+func (m *namespacedMetrics) ConstCounter(name, help string, labelNames ...string) {
+	m.mm.ConstCounter(metricName(m.ns, name), help, labelNames...)
+}
+
+// ConstGauge implements metricslite.Interface.
+func (m *namespacedMetrics) ConstGauge(name, help string, labelNames ...string) {
+	m.mm.ConstGauge(metricName(m.ns, name), help, labelNames...)
+}
+
+// OnConstScrape implements metricslite.Interface.
+func (m *namespacedMetrics) OnConstScrape(scrape metricslite.ScrapeFunc) {
+	m.mm.OnConstScrape(func(metrics map[string]func(value float64, labels ...string)) error {
+		// Present metrics to scrape using their default names.
+		renamed := make(map[string]func(float64, ...string), len(metrics))
+		for name, c := range metrics {
+			renamed[defaultNamespace+strings.TrimPrefix(name, m.ns)] = c
+		}
+
+		return scrape(renamed)
+	})
+}
+
+// Counter implements metricslite.Interface.
+func (m *namespacedMetrics) Counter(name, help string, labelNames ...string) metricslite.Counter {
+	return m.mm.Counter(metricName(m.ns, name), help, labelNames...)
+}
+
+// Gauge implements metricslite.Interface.
+func (m *namespacedMetrics) Gauge(name, help string, labelNames ...string) metricslite.Gauge {
+	return m.mm.Gauge(metricName(m.ns, name), help, labelNames...)
+}
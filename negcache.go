@@ -0,0 +1,71 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var _ Fetcher = &negativeCacheFetcher{}
+
+// A negativeCacheFetcher is a Fetcher which caches failures to fetch data from
+// each device for ttl, so that repeated scrapes of an unreachable device fail
+// immediately rather than each waiting for a connection which is likely to
+// fail. Successful fetches are never cached, and clear any cached failure.
+type negativeCacheFetcher struct {
+	f   Fetcher
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]negativeEntry
+}
+
+// A negativeEntry is a cached failure to fetch data from a single device.
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+// newNegativeCacheFetcher creates a negativeCacheFetcher which caches the
+// errors returned by f for each device address for ttl.
+func newNegativeCacheFetcher(f Fetcher, ttl time.Duration) *negativeCacheFetcher {
+	return &negativeCacheFetcher{
+		f:        f,
+		ttl:      ttl,
+		now:      time.Now,
+		failures: make(map[string]negativeEntry),
+	}
+}
+
+// Fetch implements Fetcher.
+func (f *negativeCacheFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	f.mu.Lock()
+	e, ok := f.failures[addr]
+	if ok && f.now().Before(e.expires) {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("cached failure: %w", e.err)
+	}
+	f.mu.Unlock()
+
+	d, err := f.f.Fetch(ctx, addr)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case err == nil:
+		delete(f.failures, addr)
+	case errors.Is(err, context.Canceled):
+		// The caller gave up, which says nothing about the device.
+	default:
+		f.failures[addr] = negativeEntry{
+			err:     err,
+			expires: f.now().Add(f.ttl),
+		}
+	}
+
+	return d, err
+}
@@ -0,0 +1,99 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+)
+
+func TestNegativeCacheFetcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		now     = time.Unix(0, 0)
+		fetches int
+		fail    = true
+	)
+
+	errDown := errors.New("device is down")
+	f := newNegativeCacheFetcher(discoverFetcher(func(_ context.Context, _ string) (*Data, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		fetches++
+		if fail {
+			return nil, errDown
+		}
+
+		return &Data{Device: &keylight.Device{SerialNumber: "1111"}}, nil
+	}), 10*time.Second)
+
+	f.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	set := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+
+	fetch := func(ok bool, want int) {
+		t.Helper()
+
+		_, err := f.Fetch(context.Background(), "foo")
+		if ok && err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+		if !ok && !errors.Is(err, errDown) {
+			t.Fatalf("expected device error, but got: %v", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if diff := cmp.Diff(want, fetches); diff != "" {
+			t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+		}
+	}
+
+	// The failure is cached until the TTL elapses, even once the device
+	// recovers.
+	fetch(false, 1)
+	set(func() { now = now.Add(5 * time.Second) })
+	fetch(false, 1)
+	set(func() { fail = false })
+	fetch(false, 1)
+
+	// Once the TTL elapses, the device is fetched again, and the success
+	// clears the cached failure.
+	set(func() { now = now.Add(5 * time.Second) })
+	fetch(true, 2)
+	fetch(true, 3)
+
+	// A new failure is cached relative to the time it occurred.
+	set(func() { fail = true })
+	fetch(false, 4)
+	set(func() { now = now.Add(9 * time.Second) })
+	fetch(false, 4)
+	set(func() { now = now.Add(1 * time.Second) })
+	fetch(false, 5)
+
+	// Canceled fetches are not cached.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := newNegativeCacheFetcher(discoverFetcher(func(ctx context.Context, _ string) (*Data, error) {
+		return nil, ctx.Err()
+	}), 10*time.Second)
+	if _, err := c.Fetch(ctx, "foo"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, but got: %v", err)
+	}
+	if diff := cmp.Diff(0, len(c.failures)); diff != "" {
+		t.Fatalf("unexpected cached failures (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,37 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerNegativeCache(t *testing.T) {
+	var fetches atomic.Int32
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			fetches.Add(1)
+			return nil, errors.New("device is down")
+		},
+	}, keylightexporter.WithNegativeCache(time.Hour))
+
+	for i := 0; i < 2; i++ {
+		b := testBody(t, testGet(t, srv, "foo"))
+
+		up := upMetric(false, "http://foo:9123")
+		if !bytes.Contains(b, []byte(up+"\n")) {
+			t.Fatalf("metric was not found: %s", up)
+		}
+	}
+
+	// The second scrape failed without reaching the device.
+	if diff := cmp.Diff(int32(1), fetches.Load()); diff != "" {
+		t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,663 @@
+package keylightexporter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// An Option configures the behavior of a handler created by NewHandler.
+type Option func(cfg *config)
+
+// config contains the settings applied by Options.
+type config struct {
+	// Default HTTP fetcher settings.
+	connectProxy    *url.URL
+	proxy           *url.URL
+	tlsConfig       *tls.Config
+	skipVerify      *bool
+	rootCAs         *x509.CertPool
+	concurrentFetch bool
+	authHook        AuthHook
+	wifiSignal      bool
+	tempLimits      bool
+	dnsCache        bool
+	dnsCacheTTL     time.Duration
+	connectTimeout  time.Duration
+	maxBodySize     int64
+	minReqInterval  time.Duration
+	transport       TransportConfig
+	basePath        string
+	forceScheme     string
+
+	// Handler settings.
+	timeout           time.Duration
+	defaultPort       int
+	debug             bool
+	changedOnly       bool
+	deviceTimestamps  bool
+	maxWatts          float64
+	externalLabels    prometheus.Labels
+	accessLog         io.Writer
+	logger            *slog.Logger
+	cardinalityLimit  int
+	basicAuthUser     string
+	basicAuthHash     string
+	allowedTargets    []string
+	discoverer        *Discoverer
+	cacheTTL          time.Duration
+	cacheStale        time.Duration
+	staleFallback     time.Duration
+	targetConcurrency int
+	maxTargets        int
+	retryAttempts     int
+	retryBackoff      time.Duration
+	circuitBreaker    bool
+	circuitFailures   int
+	circuitCooldown   time.Duration
+	negativeCacheTTL  time.Duration
+	singleFlight      bool
+	namedTargets      *NamedTargets
+	pollCtx           context.Context
+	pollInterval      time.Duration
+	namespace         string
+	maxConcurrency    int
+	control           bool
+	autoDiscover      bool
+	clock             clock
+}
+
+// WithConnectProxy configures the default HTTP fetcher to tunnel all device
+// connections through the HTTP CONNECT proxy at proxy, such as a jump host
+// which can reach the devices. If proxy contains user information, it is sent
+// to the proxy using HTTP basic authentication.
+//
+// WithConnectProxy has no effect when a custom Fetcher is passed to NewHandler.
+func WithConnectProxy(proxy *url.URL) Option {
+	return func(cfg *config) {
+		cfg.connectProxy = proxy
+	}
+}
+
+// WithProxy configures the default HTTP fetcher to send all device requests
+// through the proxy at proxy, such as a bastion which can reach an isolated
+// network of devices. An http or https proxy receives each plain HTTP request
+// directly and tunnels HTTPS requests using CONNECT, while a socks5 proxy
+// tunnels every connection using SOCKS5. The proxy resolves device hostnames.
+// If proxy contains user information, it is used to authenticate with the
+// proxy.
+//
+// Unless WithProxy or WithConnectProxy is set, device requests are never sent
+// through a proxy, including any proxy set by the HTTP_PROXY environment
+// variable. If both are set, WithConnectProxy takes precedence.
+//
+// WithProxy has no effect when a custom Fetcher is passed to NewHandler.
+func WithProxy(proxy *url.URL) Option {
+	return func(cfg *config) {
+		cfg.proxy = proxy
+	}
+}
+
+// WithTimeout sets the maximum duration of each scrape. If Prometheus also
+// sends its scrape timeout using the X-Prometheus-Scrape-Timeout-Seconds
+// header, the smaller of the two is used. If neither is set, a default of 5
+// seconds is used.
+func WithTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = d
+	}
+}
+
+// WithDefaultPort sets the port used to communicate with devices whose target
+// does not specify a port, such as devices behind port forwarding. Ports
+// specified by a target always take precedence. If port is not positive, the
+// Key Light default of 9123 is used.
+func WithDefaultPort(port int) Option {
+	return func(cfg *config) {
+		cfg.defaultPort = port
+	}
+}
+
+// port returns the default port of targets which do not specify one.
+func (cfg *config) port() string {
+	if cfg.defaultPort > 0 {
+		return strconv.Itoa(cfg.defaultPort)
+	}
+
+	return keylightPort
+}
+
+// WithLogger configures the handler to log the outcome of fetching data from
+// each device to ll. Failures are logged at warn level and successful fetches
+// at debug level, along with the target and elapsed time. The method, path,
+// target, status code, and elapsed time of each request served by the handler
+// are also logged at debug level. By default, nothing is logged.
+func WithLogger(ll *slog.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = ll
+	}
+}
+
+// WithTLSConfig configures the default HTTP fetcher to use a copy of cfg for
+// HTTPS connections to devices. For example, cfg.ServerName may be set to verify
+// a device's certificate against the intended hostname when the device is
+// addressed by its IP address.
+//
+// WithTLSConfig has no effect when a custom Fetcher is passed to NewHandler.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *config) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithInsecureSkipVerify configures whether the default HTTP fetcher skips
+// verification of the TLS certificates of HTTPS devices, such as devices or
+// reverse proxies which use self-signed certificates. Certificates are verified
+// by default. This applies only to connections to devices, and never to the
+// exporter's own server.
+//
+// WithInsecureSkipVerify takes precedence over the InsecureSkipVerify field of
+// the configuration set by WithTLSConfig, and has no effect when a custom
+// Fetcher is passed to NewHandler.
+func WithInsecureSkipVerify(skip bool) Option {
+	return func(cfg *config) {
+		cfg.skipVerify = &skip
+	}
+}
+
+// WithRootCAs configures the default HTTP fetcher to verify the TLS
+// certificates of HTTPS devices using pool rather than the system's root
+// certificate authorities, so that devices with certificates issued by a
+// private authority can be verified.
+//
+// WithRootCAs takes precedence over the RootCAs field of the configuration set
+// by WithTLSConfig, and has no effect when a custom Fetcher is passed to
+// NewHandler.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(cfg *config) {
+		cfg.rootCAs = pool
+	}
+}
+
+// WithConcurrentFetch configures the default HTTP fetcher to fetch a device's
+// accessory information and light state concurrently rather than sequentially,
+// reducing the latency of each scrape to roughly that of a single request. Both
+// requests share the scrape's context, so canceling the scrape stops both. If
+// the accessory information cannot be fetched, the request for the lights is
+// canceled and the scrape fails. If only the lights cannot be fetched, the
+// device information is still exported as partial data.
+//
+// WithConcurrentFetch has no effect when a custom Fetcher is passed to
+// NewHandler.
+func WithConcurrentFetch() Option {
+	return func(cfg *config) {
+		cfg.concurrentFetch = true
+	}
+}
+
+// WithAuthHook configures the default HTTP fetcher to invoke hook before
+// fetching data from each device, so that devices which require a session
+// handshake can be scraped.
+//
+// WithAuthHook has no effect when a custom Fetcher is passed to NewHandler.
+func WithAuthHook(hook AuthHook) Option {
+	return func(cfg *config) {
+		cfg.authHook = hook
+	}
+}
+
+// WithWiFiSignal configures the default HTTP fetcher to report the signal
+// strength of each device's WiFi connection, if the device reports it in its
+// accessory information. No additional requests are made to the device.
+//
+// WithWiFiSignal has no effect when a custom Fetcher is passed to NewHandler.
+func WithWiFiSignal() Option {
+	return func(cfg *config) {
+		cfg.wifiSignal = true
+	}
+}
+
+// WithTemperatureLimits configures the default HTTP fetcher to report the
+// minimum and maximum color temperatures supported by each device's lights, if
+// the device reports them in its light settings. This requires an additional
+// request to each device on every scrape.
+//
+// WithTemperatureLimits has no effect when a custom Fetcher is passed to
+// NewHandler.
+func WithTemperatureLimits() Option {
+	return func(cfg *config) {
+		cfg.tempLimits = true
+	}
+}
+
+// WithDNSCache configures the default HTTP fetcher to cache the addresses
+// resolved for each device hostname for ttl, so that repeated scrapes of a
+// device reuse a recently resolved address rather than performing a DNS
+// lookup for each new connection. If a cached address cannot be dialed, the
+// hostname is resolved again. If ttl is not positive, a default of 30 seconds
+// is used.
+//
+// WithDNSCache has no effect when a custom Fetcher is passed to NewHandler, or
+// when WithConnectProxy is used, because the proxy resolves device hostnames.
+func WithDNSCache(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.dnsCache, cfg.dnsCacheTTL = true, ttl
+	}
+}
+
+// WithConnectTimeout sets the maximum duration the default HTTP fetcher waits
+// to establish each TCP connection to a device, so that an unreachable device
+// fails quickly rather than consuming the whole scrape timeout. It should be
+// shorter than the scrape timeout. If d is not positive, a default of 2 seconds
+// is used.
+//
+// WithConnectTimeout has no effect when a custom Fetcher is passed to
+// NewHandler. When WithConnectProxy is used, it bounds the connection to the
+// proxy.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.connectTimeout = d
+	}
+}
+
+// WithMaxBodySize sets the maximum size in bytes of each HTTP response body the
+// default HTTP fetcher reads from a device, so that a misbehaving or spoofed
+// device cannot exhaust the exporter's memory. A fetch fails if a response
+// exceeds n bytes. If n is not positive, a default of 256KiB is used.
+//
+// WithMaxBodySize has no effect when a custom Fetcher is passed to NewHandler.
+func WithMaxBodySize(n int64) Option {
+	return func(cfg *config) {
+		cfg.maxBodySize = n
+	}
+}
+
+// WithMinRequestInterval configures the default HTTP fetcher to wait at least
+// d between the starts of consecutive HTTP requests to the same device, such
+// as the requests for its accessory information and lights, because some
+// devices misbehave when they receive rapid back-to-back requests. Up to a
+// quarter of d of random jitter is added to each wait. Requests to different
+// devices are not delayed, and the wait is bounded by the scrape timeout. If d
+// is not positive, requests are not delayed.
+//
+// WithMinRequestInterval has no effect when a custom Fetcher is passed to
+// NewHandler.
+func WithMinRequestInterval(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.minReqInterval = d
+	}
+}
+
+// WithTransportConfig tunes the reuse of HTTP connections to devices by the
+// default HTTP fetcher using tc. Devices close idle connections aggressively,
+// so the defaults retain idle connections only briefly. See TransportConfig
+// for details.
+//
+// WithTransportConfig has no effect when a custom Fetcher is passed to
+// NewHandler.
+func WithTransportConfig(tc TransportConfig) Option {
+	return func(cfg *config) {
+		cfg.transport = tc
+	}
+}
+
+// WithBasePath configures the default HTTP fetcher to prefix the path of each
+// request to a device with prefix, such as when a reverse proxy serves the
+// device API at "https://host/keylight/elgato/lights". Leading and trailing
+// slashes are optional. Targets must still not specify a path, so the prefix
+// applies to every device.
+//
+// WithBasePath has no effect when a custom Fetcher is passed to NewHandler.
+func WithBasePath(prefix string) Option {
+	return func(cfg *config) {
+		cfg.basePath = prefix
+	}
+}
+
+// WithForceScheme configures the default HTTP fetcher to use scheme, either
+// "http" or "https", for each request to a device regardless of the scheme of
+// its target, such as when a reverse proxy requires HTTPS. Device addresses
+// reported by the handler are unchanged. Targets which do not specify a port
+// still use the default port, as set by WithDefaultPort.
+//
+// WithForceScheme has no effect when a custom Fetcher is passed to NewHandler.
+func WithForceScheme(scheme string) Option {
+	return func(cfg *config) {
+		cfg.forceScheme = scheme
+	}
+}
+
+// WithDebug enables additional metrics which are useful for debugging the
+// exporter itself, such as the number of series emitted for each device. When
+// the default HTTP fetcher is used, the most recent raw responses from each
+// device are also retained and served by the handler at "/debug/raw".
+func WithDebug() Option {
+	return func(cfg *config) {
+		cfg.debug = true
+	}
+}
+
+// WithChangedLightsOnly configures the handler to only emit metrics for the
+// lights on a device whose state has changed since the device was last
+// scraped. Device metadata is always emitted.
+//
+// This option is intended for deployments which push or remote-write scraped
+// metrics at a high frequency. It should not be used when Prometheus scrapes
+// the handler directly, because the series for unchanged lights will be
+// considered stale.
+func WithChangedLightsOnly() Option {
+	return func(cfg *config) {
+		cfg.changedOnly = true
+	}
+}
+
+// WithExternalLabels attaches labels to every series exported by the handler,
+// including both device and exporter metrics, so that data federated from
+// multiple exporters can be attributed to a given exporter. As with Prometheus
+// external labels, a label which is already present on a series is not
+// overwritten.
+func WithExternalLabels(labels prometheus.Labels) Option {
+	return func(cfg *config) {
+		cfg.externalLabels = labels
+	}
+}
+
+// WithEstimatedPower configures the handler to export an estimate of the
+// power draw of each light, assuming that power scales linearly with
+// brightness up to maxWatts for a light at full brightness. Key Light devices
+// do not report their power draw, so nothing is exported unless maxWatts is
+// positive.
+func WithEstimatedPower(maxWatts float64) Option {
+	return func(cfg *config) {
+		cfg.maxWatts = maxWatts
+	}
+}
+
+// WithDeviceTimestamps configures the handler to apply the Timestamp reported
+// in a device's Data to each of its samples, so that staleness reflects the
+// device's clock rather than the time of the scrape. Samples are emitted without
+// explicit timestamps when the Fetcher does not report one.
+//
+// Most devices do not report timestamps, so this option is disabled by default.
+func WithDeviceTimestamps() Option {
+	return func(cfg *config) {
+		cfg.deviceTimestamps = true
+	}
+}
+
+// WithAccessLog configures the handler to write a structured access log entry
+// to w for each request, as a single JSON object per line. Writes to w are
+// serialized by the handler.
+func WithAccessLog(w io.Writer) Option {
+	return func(cfg *config) {
+		cfg.accessLog = w
+	}
+}
+
+// WithCardinalityLimit configures the handler to track the number of distinct
+// device series it emits over its lifetime. Each scrape which emits series
+// other than the first limit distinct series to be emitted increments the
+// keylight_exporter_high_cardinality_warnings_total counter and logs a warning,
+// which may indicate a misconfiguration such as a device reporting a new serial
+// on each scrape. Only the first limit series are retained by the handler.
+func WithCardinalityLimit(limit int) Option {
+	return func(cfg *config) {
+		cfg.cardinalityLimit = limit
+	}
+}
+
+// WithBasicAuth configures the handler to require HTTP basic authentication
+// for all requests, permitting only user with a password matching the bcrypt
+// hash passwordHash. Requests with missing or invalid credentials receive an
+// HTTP 401 response before any device is contacted.
+func WithBasicAuth(user, passwordHash string) Option {
+	return func(cfg *config) {
+		cfg.basicAuthUser = user
+		cfg.basicAuthHash = passwordHash
+	}
+}
+
+// WithAllowedTargets configures the handler to only scrape devices permitted
+// by hosts, each of which may be a hostname, an IP address, or a CIDR range
+// such as "192.168.1.0/24". Requests for any other target receive an HTTP 403
+// response before the device is contacted. A hostname which is not explicitly
+// permitted is resolved, and all of its addresses must be permitted.
+//
+// If hosts is empty, any target may be scraped.
+func WithAllowedTargets(hosts []string) Option {
+	return func(cfg *config) {
+		cfg.allowedTargets = hosts
+	}
+}
+
+// WithNamedTargets configures the handler to resolve each target specified by a
+// request as a name configured by nt, scraping the device at its configured
+// address and attaching its configured labels to each of the device's series.
+// Configured labels take precedence over labels specified by the request.
+// Requests for a name which is not configured receive an HTTP 404 response.
+//
+// When WithNamedTargets is used, targets must be specified by name rather than
+// by address. nt may be reloaded while the handler is in use.
+func WithNamedTargets(nt *NamedTargets) Option {
+	return func(cfg *config) {
+		cfg.namedTargets = nt
+	}
+}
+
+// WithDiscoverer configures the handler to serve a JSON list of the devices
+// found by d at "/discover", including the name, serial, and address of each
+// device. Each address may be used as the "target" query parameter.
+func WithDiscoverer(d *Discoverer) Option {
+	return func(cfg *config) {
+		cfg.discoverer = d
+	}
+}
+
+// WithAutoDiscover enables or disables scraping of all devices on the local
+// network by requests which specify no target, rather than rejecting them.
+// Devices are discovered on each such request using half of the scrape
+// timeout, and each device which cannot be fetched is reported as down.
+//
+// The Discoverer set by WithDiscoverer is used if present, or one created by
+// NewDiscoverer otherwise. Devices which are not permitted by
+// WithAllowedTargets are skipped.
+func WithAutoDiscover(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.autoDiscover = enabled
+	}
+}
+
+// WithCache configures the handler to cache the data fetched from each device
+// for ttl using a CachingFetcher, so that multiple Prometheus servers scraping
+// a device within ttl only contact the device once. The cache wraps either the
+// Fetcher passed to NewHandler or the default HTTP fetcher.
+func WithCache(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.cacheTTL, cfg.cacheStale = ttl, 0
+	}
+}
+
+// WithStaleCache configures the handler to cache the data fetched from each
+// device using a CachingFetcher with stale-while-revalidate semantics, as
+// described by NewStaleCachingFetcher. Scrapes of a device whose data is
+// younger than stale are served immediately from the cache, while data older
+// than fresh is refreshed in the background. The cache wraps either the
+// Fetcher passed to NewHandler or the default HTTP fetcher.
+func WithStaleCache(fresh, stale time.Duration) Option {
+	return func(cfg *config) {
+		cfg.cacheTTL, cfg.cacheStale = fresh, stale
+	}
+}
+
+// WithStaleFallback configures the cache enabled by WithCache or
+// WithStaleCache to serve the most recently cached data for a device when
+// fetching it fails, as long as the data is younger than maxAge. The device is
+// still reported as down, and keylight_data_stale reports that the data is
+// stale. Cached data older than maxAge is discarded, so that a device which
+// remains unreachable eventually exports no metrics other than its up metric.
+//
+// WithStaleFallback has no effect unless a cache is enabled.
+func WithStaleFallback(maxAge time.Duration) Option {
+	return func(cfg *config) {
+		cfg.staleFallback = maxAge
+	}
+}
+
+// WithNegativeCache configures the handler to cache each failure to fetch data
+// from a device for ttl, so that repeated scrapes during an outage report the
+// device as down immediately rather than each waiting for a connection which
+// is likely to fail. The device is fetched again once ttl elapses, and a
+// successful fetch clears any cached failure. If ttl is not positive, failures
+// are not cached.
+//
+// Unlike WithCircuitBreaker, every failure is cached, and the device is simply
+// fetched again once ttl elapses.
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.negativeCacheTTL = ttl
+	}
+}
+
+// WithCircuitBreaker configures the handler to stop fetching data from a device
+// once failures consecutive fetches have failed, so that an unreachable device
+// does not consume the timeout of every scrape. For cooldown, the device is
+// reported as down without attempting a connection. A single fetch then probes
+// the device: if it succeeds, the device is fetched as usual, and otherwise it
+// is skipped for another cooldown. If either value is not positive, a default
+// of 3 failures or 30 seconds is used, respectively.
+//
+// When a circuit breaker is configured, the handler also exports whether it is
+// open for each target.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(cfg *config) {
+		cfg.circuitBreaker = true
+		cfg.circuitFailures = failures
+		cfg.circuitCooldown = cooldown
+	}
+}
+
+// WithSingleFlight configures the handler to coalesce concurrent fetches of the
+// same device, such as simultaneous scrapes by multiple Prometheus servers,
+// into a single fetch whose result is shared by each scrape. Only fetches
+// which are in flight at the same time are coalesced; use WithCache to reuse
+// data across scrapes.
+func WithSingleFlight() Option {
+	return func(cfg *config) {
+		cfg.singleFlight = true
+	}
+}
+
+// WithBackgroundPoll configures the handler to fetch data from devices in the
+// background every interval until ctx is canceled, and to serve the data from
+// the most recent poll immediately rather than fetching it for each request.
+// The fetches of each poll are staggered randomly over half of the interval,
+// and samples are timestamped with the time at which their data was fetched.
+// The age of the data served for each target is reported by the
+// keylight_exporter_sample_age_seconds gauge.
+//
+// The devices configured by WithNamedTargets and those discovered when
+// WithAutoDiscover is enabled are polled from the start. Any other device is
+// fetched when it is first requested, and then polled until it has not been
+// requested for 5 minutes. Each fetch is bounded by the timeout set by
+// WithTimeout, or by the smaller of 5 seconds and interval otherwise.
+//
+// If interval is not positive, WithBackgroundPoll has no effect.
+func WithBackgroundPoll(ctx context.Context, interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pollCtx = ctx
+		cfg.pollInterval = interval
+	}
+}
+
+// WithMaxTargetsPerRequest sets the maximum number of comma-separated targets
+// which may be specified by a single request, so that a misconfigured or
+// abusive client cannot tie up the exporter. Requests which specify more
+// targets are rejected with HTTP 400 before any devices are fetched. If n is
+// not positive, a default of 100 is used.
+//
+// Unlike WithMaxTargetConcurrency, which bounds how many of a request's targets
+// are fetched at once, WithMaxTargetsPerRequest bounds how many targets a
+// request may specify in total.
+func WithMaxTargetsPerRequest(n int) Option {
+	return func(cfg *config) {
+		cfg.maxTargets = n
+	}
+}
+
+// WithMaxTargetConcurrency sets the maximum number of devices which may be
+// fetched concurrently when a request specifies multiple comma-separated
+// targets. Further targets wait until a fetch completes, and the metrics of
+// all of the targets are served together once every fetch is done. Targets
+// which are still waiting when the scrape times out are reported as down. If
+// n is not positive, a default of 8 is used.
+//
+// WithMaxTargetConcurrency bounds each request separately; use
+// WithMaxConcurrency to bound fetches across all requests.
+func WithMaxTargetConcurrency(n int) Option {
+	return func(cfg *config) {
+		cfg.targetConcurrency = n
+	}
+}
+
+// WithRetry configures the handler to make up to attempts calls to its Fetcher
+// when fetching data from a device fails due to a transient error, such as a
+// connection reset or timeout. The handler waits for backoff before the first
+// retry, doubling the wait before each subsequent retry. HTTP error statuses
+// and malformed responses are not retried.
+//
+// The total time spent retrying is bounded by the scrape timeout. If attempts
+// is less than 2, failures are not retried. Each retry increments the
+// keylight_exporter_scrape_retries_total counter for the target.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(cfg *config) {
+		cfg.retryAttempts = attempts
+		cfg.retryBackoff = backoff
+	}
+}
+
+// WithNamespace replaces the "keylight" prefix of all metric names exported by
+// the handler with ns, so that keylight_light_on is exported as ns_light_on.
+// ns must be a valid Prometheus metric name. If ns is empty, the default of
+// "keylight" is used.
+func WithNamespace(ns string) Option {
+	return func(cfg *config) {
+		cfg.namespace = ns
+	}
+}
+
+// WithMaxConcurrency limits the number of devices which may be fetched
+// concurrently by the handler across all requests to n. Each device consumes a
+// single slot while it is fetched, so a slow device does not delay scrapes of
+// other devices unless all slots are in use. Requests which cannot acquire a
+// slot before the scrape timeout report their devices as down.
+//
+// If n is not positive, the number of concurrent fetches is not limited.
+func WithMaxConcurrency(n int) Option {
+	return func(cfg *config) {
+		cfg.maxConcurrency = n
+	}
+}
+
+// WithControl enables or disables control of devices by the handler. When
+// enabled, the handler accepts POST requests at "/control" which turn the
+// lights on a device on or off and set their brightness and color temperature,
+// and responds with the resulting state of the lights as JSON. Control is
+// disabled by default.
+//
+// The target of a control request is resolved and authorized as it is for a
+// scrape, including by WithNamedTargets and WithAllowedTargets, and must refer
+// to a single device. The device is controlled using the clients and transport
+// settings of the default HTTP fetcher, even when a custom Fetcher is passed
+// to NewHandler.
+func WithControl(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.control = enabled
+	}
+}
@@ -0,0 +1,205 @@
+package keylightexporter
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ Fetcher = &pollingFetcher{}
+
+// pollIdleTimeout is the duration after which a device which was fetched by a
+// request, but is neither configured nor discovered, is no longer polled.
+const pollIdleTimeout = 5 * time.Minute
+
+// A pollingFetcher is a Fetcher which fetches data from devices in the
+// background on a fixed interval, and serves the most recent data for each
+// device immediately.
+type pollingFetcher struct {
+	f        Fetcher
+	interval time.Duration
+	timeout  time.Duration
+
+	// targets returns the addresses of the configured or discovered devices
+	// which are polled regardless of whether they are requested, if set.
+	targets func(ctx context.Context) []string
+
+	// jitter returns a random delay before polling a device, less than max.
+	jitter func(max time.Duration) time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	snapshots map[string]*snapshot
+}
+
+// A snapshot is the result of the most recent fetch of a single device.
+type snapshot struct {
+	d         *Data
+	err       error
+	polled    time.Time
+	requested time.Time
+}
+
+// newPollingFetcher creates a pollingFetcher which polls devices using f every
+// interval, bounding each fetch by timeout.
+func newPollingFetcher(f Fetcher, interval, timeout time.Duration) *pollingFetcher {
+	return &pollingFetcher{
+		f:        f,
+		interval: interval,
+		timeout:  timeout,
+		jitter: func(max time.Duration) time.Duration {
+			if max <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(max)))
+		},
+		now:       time.Now,
+		snapshots: make(map[string]*snapshot),
+	}
+}
+
+// Fetch implements Fetcher. The most recent data for the device at addr is
+// returned if it has been polled, and otherwise the device is fetched
+// immediately and polled from then on.
+func (f *pollingFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	f.mu.Lock()
+	s, ok := f.snapshots[addr]
+	if ok {
+		s.requested = f.now()
+		d, err := s.data()
+		f.mu.Unlock()
+		return d, err
+	}
+	f.mu.Unlock()
+
+	d, err := f.f.Fetch(ctx, addr)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s = f.store(addr, d, err)
+	s.requested = f.now()
+	return s.data()
+}
+
+// run polls devices every interval until ctx is canceled. Polls do not
+// overlap: if a poll takes longer than interval, the next begins once it
+// completes.
+func (f *pollingFetcher) run(ctx context.Context) {
+	t := time.NewTicker(f.interval)
+	defer t.Stop()
+
+	for {
+		f.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// poll fetches data from each device which should be polled, staggering the
+// fetches over half of the interval.
+func (f *pollingFetcher) poll(ctx context.Context) {
+	var targets []string
+	if f.targets != nil {
+		targets = f.targets(ctx)
+	}
+
+	addrs := f.addrs(targets)
+
+	var wg sync.WaitGroup
+	wg.Add(len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			defer wg.Done()
+
+			delay := time.NewTimer(f.jitter(f.interval / 2))
+			select {
+			case <-ctx.Done():
+				delay.Stop()
+				return
+			case <-delay.C:
+			}
+
+			fctx, cancel := context.WithTimeout(ctx, f.timeout)
+			defer cancel()
+
+			d, err := f.f.Fetch(fctx, addr)
+			if ctx.Err() != nil {
+				// Shutting down, so keep the last complete data.
+				return
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.store(addr, d, err)
+		}(addr)
+	}
+
+	wg.Wait()
+}
+
+// addrs returns the sorted addresses of targets and of the devices which were
+// requested recently, evicting any other devices.
+func (f *pollingFetcher) addrs(targets []string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keep := make(map[string]struct{}, len(targets))
+	for _, addr := range targets {
+		keep[addr] = struct{}{}
+	}
+
+	now := f.now()
+	for addr, s := range f.snapshots {
+		if now.Sub(s.requested) < pollIdleTimeout {
+			keep[addr] = struct{}{}
+			continue
+		}
+		if _, ok := keep[addr]; !ok {
+			delete(f.snapshots, addr)
+		}
+	}
+
+	addrs := make([]string, 0, len(keep))
+	for addr := range keep {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+	return addrs
+}
+
+// store records the result of fetching the device at addr. The caller must
+// hold f.mu.
+func (f *pollingFetcher) store(addr string, d *Data, err error) *snapshot {
+	s, ok := f.snapshots[addr]
+	if !ok {
+		s = &snapshot{}
+		f.snapshots[addr] = s
+	}
+
+	s.d, s.err, s.polled = d, err, f.now()
+	return s
+}
+
+// data returns a copy of the Data in s, timestamped with the time the device
+// was polled if the Fetcher did not report a timestamp.
+func (s *snapshot) data() (*Data, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	d := *s.d
+	d.PolledAt = s.polled
+	if d.Timestamp.IsZero() {
+		d.Timestamp = s.polled
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,168 @@
+package keylightexporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPollingFetcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		now     = time.Unix(0, 0)
+		fetches = make(map[string]int)
+		down    bool
+	)
+
+	errDown := errors.New("device is down")
+
+	f := newPollingFetcher(discoverFetcher(func(_ context.Context, addr string) (*Data, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		fetches[addr]++
+		if down {
+			return nil, errDown
+		}
+
+		return &Data{
+			Device: &keylight.Device{SerialNumber: addr},
+			Lights: []*keylight.Light{{Brightness: fetches[addr]}},
+		}, nil
+	}), time.Minute, 5*time.Second)
+
+	f.jitter = func(_ time.Duration) time.Duration { return 0 }
+	f.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	f.targets = func(_ context.Context) []string { return []string{"configured"} }
+
+	set := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+
+	fetch := func(addr string, brightness int, polled time.Duration) {
+		t.Helper()
+
+		d, err := f.Fetch(context.Background(), addr)
+		if err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+
+		if diff := cmp.Diff(brightness, d.Lights[0].Brightness); diff != "" {
+			t.Fatalf("unexpected brightness (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(time.Unix(0, 0).Add(polled), d.Timestamp); diff != "" {
+			t.Fatalf("unexpected timestamp (-want +got):\n%s", diff)
+		}
+	}
+
+	check := func(want map[string]int) {
+		t.Helper()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if diff := cmp.Diff(want, fetches); diff != "" {
+			t.Fatalf("unexpected fetches (-want +got):\n%s", diff)
+		}
+	}
+
+	// A device which has not been polled is fetched immediately, and its data
+	// is then served without fetching it again.
+	fetch("foo", 1, 0)
+	set(func() { now = now.Add(10 * time.Second) })
+	fetch("foo", 1, 0)
+	check(map[string]int{"foo": 1})
+
+	// Each poll fetches the configured and requested devices, and serves the
+	// latest data with the time of the poll.
+	f.poll(context.Background())
+	check(map[string]int{"configured": 1, "foo": 2})
+	fetch("foo", 2, 10*time.Second)
+	fetch("configured", 1, 10*time.Second)
+
+	// Failures are also served from the most recent poll.
+	set(func() {
+		now = now.Add(1 * time.Minute)
+		down = true
+	})
+	f.poll(context.Background())
+	check(map[string]int{"configured": 2, "foo": 3})
+
+	if _, err := f.Fetch(context.Background(), "foo"); !errors.Is(err, errDown) {
+		t.Fatalf("unexpected error: want %v, got %v", errDown, err)
+	}
+
+	// Devices which are no longer requested stop being polled, but the
+	// configured devices are always polled.
+	set(func() {
+		now = now.Add(pollIdleTimeout)
+		down = false
+	})
+	f.poll(context.Background())
+	check(map[string]int{"configured": 3, "foo": 3})
+
+	// Canceling the poll keeps the previous data.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.poll(ctx)
+	fetch("configured", 3, 70*time.Second+pollIdleTimeout)
+}
+
+func TestHandlerSampleAge(t *testing.T) {
+	c := newFakeClock(time.Unix(1000, 0))
+
+	// Stop polling immediately, so that each request is served the data from
+	// the first fetch of the device.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	h := NewHandler(prometheus.NewPedanticRegistry(),
+		discoverFetcher(func(_ context.Context, _ string) (*Data, error) {
+			return &Data{
+				Device: &keylight.Device{SerialNumber: "1111"},
+				Lights: []*keylight.Light{{On: true}},
+			}, nil
+		}),
+		withClock(c),
+		WithBackgroundPoll(ctx, time.Minute),
+	)
+
+	scrape := func(age string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?target=foo", nil))
+
+		b, err := io.ReadAll(w.Result().Body)
+		if err != nil {
+			t.Fatalf("failed to read HTTP body: %v", err)
+		}
+
+		series := `keylight_exporter_sample_age_seconds{target="http://foo:9123"} ` + age + "\n"
+		if !strings.Contains(string(b), series) {
+			t.Fatalf("sample age series %q was not found:\n%s", series, b)
+		}
+	}
+
+	// The age grows with the clock until the device is polled again.
+	scrape("0")
+	c.Add(15 * time.Second)
+	scrape("15")
+	c.Add(30 * time.Second)
+	scrape("45")
+}
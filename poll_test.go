@@ -0,0 +1,102 @@
+package keylightexporter_test
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerBackgroundPoll(t *testing.T) {
+	const delay = 100 * time.Millisecond
+
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader("targets:\n  office:\n    address: foo\n")); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	// Each fetch of the slow device reports a higher brightness.
+	var fetches atomic.Int32
+	f := testFetcher{
+		fetch: func(ctx context.Context, _ string) (*keylightexporter.Data, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+
+			d := testData()
+			d.Lights[0].Brightness = int(fetches.Add(1))
+			return d, nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := testServer(t, f,
+		keylightexporter.WithNamedTargets(nt),
+		keylightexporter.WithBackgroundPoll(ctx, 2*delay),
+	)
+
+	// The configured device is polled without being requested.
+	wait := func(n int32) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for fetches.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d polls", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	re := regexp.MustCompile(`keylight_light_brightness_percent\{light="light0",name="test",serial="1111"\} (\d+) \d+\n`)
+
+	scrape := func() int {
+		t.Helper()
+
+		start := time.Now()
+		b := testBody(t, testGet(t, srv, "office"))
+		if elapsed := time.Since(start); elapsed >= delay {
+			t.Fatalf("scrape took %s, expected it to be served from the last poll", elapsed)
+		}
+
+		// Samples carry the timestamp of the poll which gathered them.
+		m := re.FindSubmatch(b)
+		if m == nil {
+			t.Fatal("timestamped brightness metric was not found")
+		}
+
+		var n int
+		if _, err := fmt.Sscan(string(m[1]), &n); err != nil {
+			t.Fatalf("failed to parse brightness: %v", err)
+		}
+
+		return n
+	}
+
+	wait(1)
+	first := scrape()
+
+	// The next scrape reflects a later poll.
+	wait(int32(first) + 2)
+	if next := scrape(); next <= first {
+		t.Fatalf("scrape did not reflect the latest poll: brightness %d, previously %d", next, first)
+	}
+
+	// Polling stops once the context is canceled.
+	cancel()
+	time.Sleep(2 * delay)
+	n := fetches.Load()
+	time.Sleep(4 * delay)
+	if got := fetches.Load(); got != n {
+		t.Fatalf("devices were polled after cancelation: %d polls, previously %d", got, n)
+	}
+}
@@ -0,0 +1,95 @@
+package keylightexporter
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// connectDialer returns a DialContext function which uses d to connect to the
+// HTTP proxy at proxy, and then issues a CONNECT request to establish a tunnel
+// to the requested address.
+func connectDialer(
+	proxy *url.URL,
+	d *net.Dialer,
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, proxy.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial CONNECT proxy: %v", err)
+		}
+
+		conn, err := connectTunnel(ctx, c, proxy, addr)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+// connectTunnel issues a CONNECT request for addr over c and waits for the
+// proxy to acknowledge the tunnel.
+func connectTunnel(ctx context.Context, c net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	// Bound the CONNECT handshake by the context deadline, but clear it once
+	// the tunnel is established so the HTTP transport can manage the
+	// connection from then on.
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		defer c.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(c); err != nil {
+		return nil, fmt.Errorf("failed to send CONNECT request: %v", err)
+	}
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response: %v", err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT proxy returned HTTP %d", res.StatusCode)
+	}
+
+	if br.Buffered() == 0 {
+		return c, nil
+	}
+
+	// The proxy sent data beyond the CONNECT response, so it must be read
+	// before any further data from the underlying connection.
+	return &bufferedConn{Conn: c, r: br}, nil
+}
+
+// A bufferedConn is a net.Conn which reads from a buffer before reading from
+// the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements io.Reader.
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
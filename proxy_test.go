@@ -0,0 +1,347 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerConnectProxy(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		tunnels []string
+	)
+
+	device := testDevice(t, func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(tunnels) == 0 {
+			panicf("device request %q arrived before CONNECT tunnel", r.URL.Path)
+		}
+	})
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		dc, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer dc.Close()
+
+		mu.Lock()
+		tunnels = append(tunnels, r.Host)
+		mu.Unlock()
+
+		pc, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panicf("failed to hijack: %v", err)
+		}
+		defer pc.Close()
+
+		_, _ = io.WriteString(pc, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		go func() { _, _ = io.Copy(dc, brw) }()
+		_, _ = io.Copy(pc, dc)
+	}))
+	defer proxy.Close()
+
+	pu, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy URL: %v", err)
+	}
+
+	res := testHandler(t, nil, device.URL, keylightexporter.WithConnectProxy(pu))
+	defer res.Body.Close()
+
+	if diff := cmp.Diff(http.StatusOK, res.StatusCode); diff != "" {
+		t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read HTTP body: %v", err)
+	}
+
+	if !matchDevice(t, b, []string{
+		upMetric(true, device.URL),
+		`keylight_info{address="` + device.URL + `",firmware="1.0.0",firmware_build="",hardware_board_type="",model="unknown",name="test",product="",serial="1111"} 1`,
+		`keylight_lights{serial="1111"} 1`,
+		`keylight_device_http_proto_info{proto="HTTP/1.1",serial="1111"} 1`,
+		`keylight_light_on{light="light0",name="test",serial="1111"} 1`,
+		`keylight_light_brightness_percent{light="light0",name="test",serial="1111"} 20`,
+		`keylight_light_brightness_ratio{light="light0",name="test",serial="1111"} 0.2`,
+		`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`,
+		`keylight_light_color_temperature_mireds{light="light0",name="test",serial="1111"} 238.0952380952381`,
+	}) {
+		t.Fatal("failed to match Prometheus metrics")
+	}
+
+	du, err := url.Parse(device.URL)
+	if err != nil {
+		t.Fatalf("failed to parse device URL: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff([]string{du.Host}, tunnels); diff != "" {
+		t.Fatalf("unexpected CONNECT tunnels (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerProxy(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+
+	device := testDevice(t, func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(paths) == 0 {
+			panicf("device request %q did not traverse the proxy", r.URL.Path)
+		}
+	})
+
+	du, err := url.Parse(device.URL)
+	if err != nil {
+		t.Fatalf("failed to parse device URL: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		proxy func(t *testing.T, record func(host, path string)) *url.URL
+	}{
+		{
+			name:  "HTTP",
+			proxy: testHTTPProxy,
+		},
+		{
+			name:  "SOCKS5",
+			proxy: testSOCKS5Proxy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+
+			proxy := tt.proxy(t, func(host, path string) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if host != du.Host {
+					panicf("proxy request for unexpected host %q", host)
+				}
+				paths = append(paths, path)
+			})
+
+			b := testBody(t, testHandler(t, nil, device.URL, keylightexporter.WithProxy(proxy)))
+
+			up := upMetric(true, device.URL)
+			if !bytes.Contains(b, []byte(up+"\n")) {
+				t.Fatalf("device was not scraped through the proxy:\n%s", b)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(paths) == 0 {
+				t.Fatal("no requests traversed the proxy")
+			}
+		})
+	}
+}
+
+// testHTTPProxy starts an HTTP forward proxy which calls record for each
+// request it forwards, and returns its URL.
+func testHTTPProxy(t *testing.T, record func(host, path string)) *url.URL {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			http.Error(w, "only absolute requests are supported", http.StatusBadRequest)
+			return
+		}
+
+		record(r.URL.Host, r.URL.Path)
+
+		req := r.Clone(r.Context())
+		req.RequestURI = ""
+
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		_, _ = io.Copy(w, res.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy URL: %v", err)
+	}
+
+	return u
+}
+
+// testSOCKS5Proxy starts a SOCKS5 proxy without authentication which calls
+// record once for each tunnel it establishes, and returns its URL.
+func testSOCKS5Proxy(t *testing.T, record func(host, path string)) *url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	t.Cleanup(func() {
+		// Idle connections are held open by the client, so close them too.
+		_ = l.Close()
+		mu.Lock()
+		for _, c := range conns {
+			_ = c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer c.Close()
+
+				addr, err := socks5Handshake(c)
+				if err != nil {
+					return
+				}
+
+				dc, err := net.Dial("tcp", addr)
+				if err != nil {
+					// General SOCKS server failure.
+					_, _ = c.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer dc.Close()
+
+				record(addr, "")
+
+				// Succeeded, with an unspecified bound address.
+				if _, err := c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+					return
+				}
+
+				go func() {
+					_, _ = io.Copy(dc, c)
+					_ = dc.Close()
+				}()
+				_, _ = io.Copy(c, dc)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "socks5", Host: l.Addr().String()}
+}
+
+// socks5Handshake negotiates no authentication with a SOCKS5 client on c and
+// returns the address of its CONNECT request.
+func socks5Handshake(c net.Conn) (string, error) {
+	// Version and authentication methods.
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(c, make([]byte, b[1])); err != nil {
+		return "", err
+	}
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	// Version, command, reserved, and address type.
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return "", err
+	}
+	if b[1] != 1 {
+		return "", fmt.Errorf("unsupported SOCKS5 command %d", b[1])
+	}
+
+	var host string
+	switch b[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if b[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(c, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", b[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,71 @@
+package keylightexporter
+
+import (
+	"context"
+	"time"
+
+	"github.com/mdlayher/metricslite"
+)
+
+var _ Fetcher = &retryFetcher{}
+
+// A retryFetcher is a Fetcher which retries transient failures of another
+// Fetcher using exponential backoff.
+type retryFetcher struct {
+	f        Fetcher
+	attempts int
+	backoff  time.Duration
+
+	// retries counts each retry by target, if set.
+	retries metricslite.Counter
+}
+
+// newRetryFetcher creates a retryFetcher which makes up to attempts calls to
+// f, waiting backoff before the first retry and doubling the wait before each
+// subsequent retry.
+func newRetryFetcher(f Fetcher, attempts int, backoff time.Duration) *retryFetcher {
+	return &retryFetcher{
+		f:        f,
+		attempts: attempts,
+		backoff:  backoff,
+	}
+}
+
+// Fetch implements Fetcher.
+func (f *retryFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	wait := f.backoff
+	for i := 1; ; i++ {
+		d, err := f.f.Fetch(ctx, addr)
+		if err == nil || i >= f.attempts || !transient(err) {
+			return d, err
+		}
+
+		// The context bounds the total time spent retrying, so give up
+		// with the most recent error if it expires while waiting.
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+
+		if f.retries != nil {
+			f.retries(1, addr)
+		}
+
+		wait *= 2
+	}
+}
+
+// transient reports whether err is likely to be a transient failure which may
+// succeed if retried, such as a timeout or connection reset. HTTP error
+// statuses and malformed responses are not considered transient.
+func transient(err error) bool {
+	switch errorReason(err) {
+	case "timeout", "connection":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,141 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerRetry(t *testing.T) {
+	refused := &url.Error{
+		Op:  "Get",
+		URL: "http://foo:9123/elgato/accessory-info",
+		Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+	}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		backoff  time.Duration
+		timeout  string
+		attempts int32
+		ok       bool
+	}{
+		{
+			name:     "transient",
+			errs:     []error{refused, refused},
+			attempts: 3,
+			ok:       true,
+		},
+		{
+			name:     "exhausted",
+			errs:     []error{refused, refused, refused, refused},
+			attempts: 3,
+		},
+		{
+			name:     "HTTP status",
+			errs:     []error{errors.New("keylight: device returned HTTP 404")},
+			attempts: 1,
+		},
+		{
+			// The backoff exceeds the scrape timeout, so the second attempt
+			// is never made.
+			name:     "deadline",
+			errs:     []error{refused},
+			backoff:  1 * time.Minute,
+			timeout:  "0.1",
+			attempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := tt.backoff
+			if backoff == 0 {
+				backoff = 1 * time.Millisecond
+			}
+
+			var attempts atomic.Int32
+			srv := testServer(t, testFetcher{
+				fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+					if n := int(attempts.Add(1)); n <= len(tt.errs) {
+						return nil, tt.errs[n-1]
+					}
+
+					return testData(), nil
+				},
+			}, keylightexporter.WithRetry(3, backoff))
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"?target=foo", nil)
+			if err != nil {
+				t.Fatalf("failed to create HTTP request: %v", err)
+			}
+			if tt.timeout != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.timeout)
+			}
+
+			c := &http.Client{Timeout: 5 * time.Second}
+			res, err := c.Do(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+
+			b := testBody(t, res)
+			if diff := cmp.Diff(tt.attempts, attempts.Load()); diff != "" {
+				t.Fatalf("unexpected number of attempts (-want +got):\n%s", diff)
+			}
+
+			up := upMetric(tt.ok, "http://foo:9123")
+			if !bytes.Contains(b, []byte(up)) {
+				t.Fatalf("up metric was not found: %s", up)
+			}
+		})
+	}
+}
+
+func TestHandlerRetriesTotal(t *testing.T) {
+	refused := &url.Error{
+		Op:  "Get",
+		URL: "http://foo:9123/elgato/accessory-info",
+		Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+	}
+
+	for _, failures := range []int32{1, 2} {
+		t.Run(fmt.Sprintf("%d failures", failures), func(t *testing.T) {
+			// The first fetches fail and are retried, and all later fetches
+			// succeed.
+			var attempts atomic.Int32
+			srv := testServer(t, testFetcher{
+				fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+					if attempts.Add(1) <= failures {
+						return nil, refused
+					}
+
+					return testData(), nil
+				},
+			}, keylightexporter.WithRetry(3, 1*time.Millisecond))
+
+			b := testBody(t, testGet(t, srv, "foo"))
+
+			want := fmt.Sprintf("keylight_exporter_scrape_retries_total{target=%q} %d\n", "http://foo:9123", failures)
+			if !bytes.Contains(b, []byte(want)) {
+				t.Fatalf("retries metric %q was not found:\n%s", want, b)
+			}
+			if !bytes.Contains(b, []byte(upMetric(true, "http://foo:9123"))) {
+				t.Fatal("device was not scraped successfully after retrying")
+			}
+		})
+	}
+}
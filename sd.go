@@ -0,0 +1,181 @@
+package keylightexporter
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sdPath is the HTTP path which serves the known targets for Prometheus HTTP
+// service discovery when named targets or discovery are enabled.
+const sdPath = "/targets"
+
+// Meta labels attached to each target group served at sdPath. Meta labels are
+// available during relabeling but are not attached to the scraped series.
+const (
+	sdLabelAddress = "__meta_keylight_address"
+	sdLabelName    = "__meta_keylight_name"
+	sdLabelSerial  = "__meta_keylight_serial"
+)
+
+// An sdGroup is a target group in the format of Prometheus HTTP service
+// discovery.
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdPage is the HTML template which lists the known targets for a browser.
+var sdPage = template.Must(template.New("targets").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Elgato Key Light exporter targets</title>
+</head>
+<body>
+<h1>Targets</h1>
+<table>
+<tr><th>Target</th><th>Address</th><th>Name</th><th>Serial</th></tr>
+{{range .}}<tr><td>{{index .Targets 0}}</td><td>{{index .Labels "__meta_keylight_address"}}</td><td>{{index .Labels "__meta_keylight_name"}}</td><td>{{index .Labels "__meta_keylight_serial"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// sdEnabled reports whether the handler knows of any targets to serve at
+// sdPath.
+func (h *handler) sdEnabled() bool {
+	return h.names != nil || h.discoverer != nil || h.autoDiscover != nil
+}
+
+// serveSD serves each named target and each device discovered on the local
+// network as a target group for Prometheus HTTP service discovery, or as an
+// HTML table if r is made by a browser. The name and serial of each device are
+// fetched using the handler's Fetcher, and are omitted if the device cannot be
+// reached.
+func (h *handler) serveSD(w http.ResponseWriter, r *http.Request) {
+	timeout := scrapeTimeout(r, h.timeout)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	var (
+		targets []string
+		addrs   []string
+		seen    = make(map[string]struct{})
+	)
+
+	if h.names != nil {
+		// Named targets are scraped by name, so that their configured labels
+		// are attached.
+		for _, name := range h.names.names() {
+			t, ok := h.names.lookup(name)
+			if !ok {
+				// Removed by a concurrent reload.
+				continue
+			}
+
+			addr, err := buildAddr(t.Address, h.port)
+			if err != nil {
+				continue
+			}
+
+			seen[addr] = struct{}{}
+			targets = append(targets, name)
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if d := h.sdDiscoverer(); d != nil {
+		found, err := h.sdDiscover(ctx, d, timeout/2)
+		if err != nil {
+			h.ll.Warn("failed to discover devices", "err", err)
+			httpError(w, r, "failed to discover devices", "", http.StatusInternalServerError)
+			return
+		}
+
+		for _, a := range found {
+			addr, err := buildAddr(a, h.port)
+			if err != nil || (h.allowlist != nil && !h.allowlist.allowed(ctx, addr)) {
+				continue
+			}
+			if _, ok := seen[addr]; ok {
+				// Already served as a named target.
+				continue
+			}
+
+			seen[addr] = struct{}{}
+			targets = append(targets, a)
+			addrs = append(addrs, addr)
+		}
+	}
+
+	groups := make([]sdGroup, 0, len(targets))
+	for i, res := range h.fetch(ctx, addrs) {
+		labels := map[string]string{sdLabelAddress: res.addr}
+		if res.err == nil {
+			labels[sdLabelName] = res.d.Device.DisplayName
+			labels[sdLabelSerial] = res.d.Device.SerialNumber
+		}
+
+		groups = append(groups, sdGroup{
+			Targets: []string{targets[i]},
+			Labels:  labels,
+		})
+	}
+
+	if acceptsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := sdPage.Execute(w, groups); err != nil {
+			h.ll.Warn("failed to render targets page", "err", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(groups)
+}
+
+// sdDiscoverer returns the Discoverer used to find devices on the local
+// network for service discovery, if any.
+func (h *handler) sdDiscoverer() *Discoverer {
+	if h.autoDiscover != nil {
+		return h.autoDiscover
+	}
+
+	return h.discoverer
+}
+
+// sdDiscover returns the addresses of the devices found by d within timeout,
+// or the devices found by the most recent background poll if automatic
+// discovery is enabled.
+func (h *handler) sdDiscover(ctx context.Context, d *Discoverer, timeout time.Duration) ([]string, error) {
+	if h.poller != nil && h.autoDiscover != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.discovered, nil
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return d.Discover(dctx)
+}
+
+// acceptsHTML reports whether the Accept header of r requests HTML, as is sent
+// by web browsers.
+func acceptsHTML(r *http.Request) bool {
+	for _, a := range r.Header.Values("Accept") {
+		for _, mt := range strings.Split(a, ",") {
+			mt, _, _ = strings.Cut(mt, ";")
+			if strings.EqualFold(strings.TrimSpace(mt), "text/html") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,161 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+	"github.com/prometheus/common/model"
+)
+
+func TestHandlerServiceDiscovery(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader(`
+targets:
+  office:
+    address: foo
+  studio:
+    address: http://bar:9123
+  broken:
+    address: baz:8080
+`)); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			if addr == "http://baz:8080" {
+				return nil, errors.New("device unreachable")
+			}
+
+			d := testData()
+			d.Device.SerialNumber = strings.TrimPrefix(addr, "http://")
+			return d, nil
+		},
+	}, keylightexporter.WithNamedTargets(nt))
+
+	get := func(accept string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/targets", nil)
+		if err != nil {
+			t.Fatalf("failed to create HTTP request: %v", err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("failed to perform HTTP request: %v", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected HTTP status: %d", res.StatusCode)
+		}
+
+		return res
+	}
+
+	res := get("")
+	if diff := cmp.Diff("application/json", res.Header.Get("Content-Type")); diff != "" {
+		t.Fatalf("unexpected Content-Type (-want +got):\n%s", diff)
+	}
+
+	// Decode strictly using the HTTP service discovery schema: an array of
+	// objects with only targets and labels.
+	var groups []struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
+	}
+
+	dec := json.NewDecoder(res.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&groups); err != nil {
+		t.Fatalf("failed to decode service discovery JSON: %v", err)
+	}
+	_ = res.Body.Close()
+
+	for _, g := range groups {
+		if len(g.Targets) == 0 {
+			t.Fatalf("target group has no targets: %+v", g)
+		}
+		for k := range g.Labels {
+			if !model.LabelName(k).IsValid() || !strings.HasPrefix(k, "__meta_keylight_") {
+				t.Fatalf("invalid service discovery label %q", k)
+			}
+		}
+	}
+
+	// Each named target is served by name, and its identity is omitted if it
+	// cannot be fetched.
+	want := []struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
+	}{
+		{
+			Targets: []string{"broken"},
+			Labels:  map[string]string{"__meta_keylight_address": "http://baz:8080"},
+		},
+		{
+			Targets: []string{"office"},
+			Labels: map[string]string{
+				"__meta_keylight_address": "http://foo:9123",
+				"__meta_keylight_name":    "test",
+				"__meta_keylight_serial":  "foo:9123",
+			},
+		},
+		{
+			Targets: []string{"studio"},
+			Labels: map[string]string{
+				"__meta_keylight_address": "http://bar:9123",
+				"__meta_keylight_name":    "test",
+				"__meta_keylight_serial":  "bar:9123",
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, groups); diff != "" {
+		t.Fatalf("unexpected target groups (-want +got):\n%s", diff)
+	}
+
+	// Browsers are served an HTML table instead.
+	res = get("text/html,application/xhtml+xml;q=0.9")
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("unexpected Content-Type: %q", ct)
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read HTTP body: %v", err)
+	}
+	_ = res.Body.Close()
+
+	for _, s := range []string{"<td>office</td>", "<td>http://foo:9123</td>", "<td>foo:9123</td>"} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Fatalf("HTML does not contain %q:\n%s", s, b)
+		}
+	}
+}
+
+func TestHandlerServiceDiscoveryDisabled(t *testing.T) {
+	srv := testServer(t, testDataFetcher())
+
+	res, err := srv.Client().Get(srv.URL + "/targets")
+	if err != nil {
+		t.Fatalf("failed to perform HTTP request: %v", err)
+	}
+	defer res.Body.Close()
+
+	// Without named targets or discovery, the path is treated as a scrape
+	// which specifies no target.
+	if diff := cmp.Diff(http.StatusBadRequest, res.StatusCode); diff != "" {
+		t.Fatalf("unexpected HTTP status (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,60 @@
+package keylightexporter
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var _ Fetcher = &singleFlightFetcher{}
+
+// A singleFlightFetcher is a Fetcher which coalesces concurrent fetches of the
+// same device into a single call to another Fetcher, so that simultaneous
+// scrapes do not make duplicate requests to a device. Results are only shared
+// by fetches which are in flight at the same time.
+type singleFlightFetcher struct {
+	f Fetcher
+	g singleflight.Group
+}
+
+// newSingleFlightFetcher creates a singleFlightFetcher which coalesces
+// concurrent fetches using f.
+func newSingleFlightFetcher(f Fetcher) *singleFlightFetcher {
+	return &singleFlightFetcher{f: f}
+}
+
+// Fetch implements Fetcher.
+func (f *singleFlightFetcher) Fetch(ctx context.Context, addr string) (*Data, error) {
+	ch := f.g.DoChan(addr, func() (any, error) {
+		// The fetch is shared by all callers, so the caller which started it
+		// canceling its request must not fail the others. Its deadline still
+		// bounds the fetch.
+		fctx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			fctx, cancel = context.WithTimeout(fctx, time.Until(deadline))
+			defer cancel()
+		}
+
+		return f.f.Fetch(fctx, addr)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+
+		d := res.Val.(*Data)
+		if res.Shared {
+			// Give each caller its own copy of the shared Data.
+			dd := *d
+			d = &dd
+		}
+
+		return d, nil
+	}
+}
@@ -0,0 +1,97 @@
+package keylightexporter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/keylight"
+)
+
+func TestSingleFlightFetcher(t *testing.T) {
+	var (
+		fetches atomic.Int32
+		started = make(chan struct{})
+		proceed = make(chan struct{})
+	)
+
+	f := newSingleFlightFetcher(discoverFetcher(func(_ context.Context, addr string) (*Data, error) {
+		fetches.Add(1)
+		if addr == "foo" {
+			close(started)
+			<-proceed
+		}
+
+		return &Data{Device: &keylight.Device{SerialNumber: addr}}, nil
+	}))
+
+	var (
+		wg  sync.WaitGroup
+		out [2]*Data
+	)
+
+	fetch := func(ctx context.Context, i int) {
+		defer wg.Done()
+
+		d, err := f.Fetch(ctx, "foo")
+		if err != nil {
+			panicf("failed to fetch: %v", err)
+		}
+		out[i] = d
+	}
+
+	// The first fetch blocks in the underlying Fetcher, and the second waits
+	// for its result.
+	wg.Add(2)
+	go fetch(context.Background(), 0)
+	<-started
+
+	waiting := make(chan struct{})
+	go fetch(&doneContext{Context: context.Background(), done: waiting}, 1)
+	<-waiting
+
+	// Other devices are fetched independently.
+	if _, err := f.Fetch(context.Background(), "bar"); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+
+	close(proceed)
+	wg.Wait()
+
+	if diff := cmp.Diff(int32(2), fetches.Load()); diff != "" {
+		t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+	}
+
+	// Each caller receives its own copy of the shared Data.
+	if out[0] == out[1] {
+		t.Fatal("callers received the same Data")
+	}
+	for _, d := range out {
+		if diff := cmp.Diff("foo", d.Device.SerialNumber); diff != "" {
+			t.Fatalf("unexpected serial (-want +got):\n%s", diff)
+		}
+	}
+
+	// Once complete, the next fetch is not coalesced with the previous one.
+	if _, err := f.Fetch(context.Background(), "bar"); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	if diff := cmp.Diff(int32(3), fetches.Load()); diff != "" {
+		t.Fatalf("unexpected number of fetches (-want +got):\n%s", diff)
+	}
+}
+
+// A doneContext is a context.Context which closes done when its Done method
+// is first called, indicating that a caller is waiting on it.
+type doneContext struct {
+	context.Context
+	once sync.Once
+	done chan struct{}
+}
+
+func (ctx *doneContext) Done() <-chan struct{} {
+	ctx.once.Do(func() { close(ctx.done) })
+	return ctx.Context.Done()
+}
@@ -0,0 +1,126 @@
+package keylightexporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mdlayher/keylight"
+)
+
+var _ Fetcher = &FileFetcher{}
+
+// A FileFetcher is a Fetcher which serves Data from JSON snapshots stored in
+// files rather than contacting a device, so that dashboards may be developed
+// and issues reproduced without any physical Key Light devices. Snapshots are
+// created by DumpData, or equivalently by saving the response of the
+// handler's "/inventory" endpoint.
+//
+// If Path is a directory, the snapshot for each target is read from the file
+// in that directory named after the target's host, such as "192.168.1.5.json"
+// or "office-light.json". Otherwise, the snapshot at Path is served for every
+// target. Snapshots are read on each fetch, so they may be replaced while in
+// use.
+type FileFetcher struct {
+	Path string
+}
+
+// Fetch implements Fetcher.
+func (f *FileFetcher) Fetch(_ context.Context, addr string) (*Data, error) {
+	path := f.Path
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device URL: %q", addr)
+		}
+
+		path = filepath.Join(path, strings.ToLower(u.Hostname())+".json")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	d, err := ReadData(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %q: %w", path, err)
+	}
+
+	return d, nil
+}
+
+// DumpData fetches data from the device specified by target using f, and
+// writes a JSON snapshot of the Data to w which may be served by a
+// FileFetcher. The target is any target accepted by the handler, such as a
+// hostname, host:port pair, or URL. If f is nil, the default HTTP fetcher is
+// used.
+func DumpData(ctx context.Context, w io.Writer, f Fetcher, target string) error {
+	addr, err := buildAddr(target, keylightPort)
+	if err != nil {
+		return err
+	}
+
+	if f == nil {
+		f = NewHTTPFetcher(nil)
+	}
+
+	d, err := f.Fetch(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("failed to fetch data from device: %w", err)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newInventory(addr, d))
+}
+
+// ReadData parses a JSON snapshot of Data from r, as written by DumpData.
+// Fields which describe the state of the exporter rather than the device, such
+// as the time the Data was cached, are ignored.
+func ReadData(r io.Reader) (*Data, error) {
+	var inv inventory
+	if err := json.NewDecoder(r).Decode(&inv); err != nil {
+		return nil, err
+	}
+
+	d := &Data{
+		Device: &keylight.Device{
+			ProductName:         inv.Device.Product,
+			HardwareBoardType:   inv.Device.HardwareBoardType,
+			FirmwareBuildNumber: inv.Device.FirmwareBuild,
+			FirmwareVersion:     inv.Device.Firmware,
+			SerialNumber:        inv.Device.Serial,
+			DisplayName:         inv.Device.Name,
+		},
+		Lights:         make([]*keylight.Light, 0, len(inv.Lights)),
+		Proto:          inv.Proto,
+		WiFiRSSI:       inv.WiFiSignalDBM,
+		TemperatureMin: inv.TemperatureMin,
+		TemperatureMax: inv.TemperatureMax,
+	}
+
+	for _, l := range inv.Lights {
+		d.Lights = append(d.Lights, &keylight.Light{
+			On:          l.On,
+			Brightness:  l.Brightness,
+			Temperature: l.Temperature,
+		})
+	}
+
+	if inv.LightsError != "" {
+		d.LightsErr = errors.New(inv.LightsError)
+	}
+	if inv.BootTime != nil {
+		d.BootTime = *inv.BootTime
+	}
+
+	return d, nil
+}
@@ -0,0 +1,109 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestDumpDataRoundTrip(t *testing.T) {
+	want := testData()
+	want.Proto = "HTTP/1.1"
+	want.WiFiRSSI = -50
+	want.BootTime = time.Unix(1, 0).UTC()
+	want.TemperatureMin = 2900
+	want.TemperatureMax = 7000
+
+	f := testFetcher{
+		fetch: func(_ context.Context, _ string) (*keylightexporter.Data, error) {
+			return want, nil
+		},
+	}
+
+	var b bytes.Buffer
+	if err := keylightexporter.DumpData(context.Background(), &b, f, "foo"); err != nil {
+		t.Fatalf("failed to dump data: %v", err)
+	}
+
+	got, err := keylightexporter.ReadData(&b)
+	if err != nil {
+		t.Fatalf("failed to read data: %v", err)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected Data (-want +got):\n%s", diff)
+	}
+}
+
+func TestFileFetcher(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each device is dumped to a file named after its host.
+	dump := func(path string) {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := keylightexporter.DumpData(context.Background(), &b, testDataFetcher(), "foo"); err != nil {
+			t.Fatalf("failed to dump data: %v", err)
+		}
+		if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+			t.Fatalf("failed to write snapshot: %v", err)
+		}
+	}
+
+	dump(filepath.Join(dir, "foo.json"))
+
+	tests := []struct {
+		name   string
+		path   string
+		target string
+		ok     bool
+	}{
+		{
+			name:   "file",
+			path:   filepath.Join(dir, "foo.json"),
+			target: "bar",
+			ok:     true,
+		},
+		{
+			name:   "directory",
+			path:   dir,
+			target: "foo",
+			ok:     true,
+		},
+		{
+			name:   "directory missing target",
+			path:   dir,
+			target: "bar",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &keylightexporter.FileFetcher{Path: tt.path}
+			b := testBody(t, testHandler(t, f, tt.target))
+
+			addr := "http://" + tt.target + ":9123"
+			if !bytes.Contains(b, []byte(upMetric(tt.ok, addr))) {
+				t.Fatalf("up metric was not found:\n%s", b)
+			}
+			if !tt.ok {
+				return
+			}
+
+			const info = `keylight_info{address=`
+			if !bytes.Contains(b, []byte(info+`"`+addr+`"`)) {
+				t.Fatalf("info metric was not found:\n%s", b)
+			}
+			if !bytes.Contains(b, []byte(`keylight_light_color_temperature_kelvin{light="light0",name="test",serial="1111"} 4200`)) {
+				t.Fatalf("temperature metric was not found:\n%s", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package keylightexporter
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A requestSpacer enforces a minimum interval between the starts of
+// consecutive HTTP requests to the same device, so that devices which
+// misbehave under rapid requests are not overloaded. Requests to different
+// devices are not delayed.
+type requestSpacer struct {
+	interval time.Duration
+
+	// jitter returns a random delay added to the interval, less than max.
+	jitter func(max time.Duration) time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// newRequestSpacer creates a requestSpacer which spaces requests to each
+// device by at least interval, plus up to a quarter of interval of jitter.
+func newRequestSpacer(interval time.Duration) *requestSpacer {
+	return &requestSpacer{
+		interval: interval,
+		jitter: func(max time.Duration) time.Duration {
+			if max <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(max)))
+		},
+		now:  time.Now,
+		next: make(map[string]time.Time),
+	}
+}
+
+// wait blocks until a request may be sent to the device at host, or until ctx
+// is canceled.
+func (s *requestSpacer) wait(ctx context.Context, host string) error {
+	s.mu.Lock()
+	now := s.now()
+	start := now
+	if next, ok := s.next[host]; ok && next.After(now) {
+		start = next
+	}
+
+	// Reserve the next slot before waiting so that concurrent requests to
+	// the same device are spaced from each other. Devices whose slots have
+	// passed no longer need to be tracked.
+	for h, next := range s.next {
+		if !next.After(now) {
+			delete(s.next, h)
+		}
+	}
+	s.next[host] = start.Add(s.interval + s.jitter(s.interval/4))
+	s.mu.Unlock()
+
+	if !start.After(now) {
+		return nil
+	}
+
+	t := time.NewTimer(start.Sub(now))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// A spacingTransport is an http.RoundTripper which delays each request using
+// a requestSpacer before sending it with its underlying http.RoundTripper.
+type spacingTransport struct {
+	rt http.RoundTripper
+	s  *requestSpacer
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *spacingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.s.wait(r.Context(), r.URL.Host); err != nil {
+		return nil, err
+	}
+
+	return t.rt.RoundTrip(r)
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// http.RoundTripper, if supported.
+func (t *spacingTransport) CloseIdleConnections() { closeIdleConnections(t.rt) }
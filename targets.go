@@ -0,0 +1,317 @@
+package keylightexporter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/keylight"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// NamedTargets maps friendly names to the addresses of Key Light devices and
+// the labels attached to their series, so that a scrape may specify a target
+// such as "office-light" rather than the device's address. NamedTargets may be
+// reloaded while in use by a handler.
+//
+// Named targets are loaded from YAML of the form:
+//
+//	targets:
+//	  office-light:
+//	    address: 192.168.1.5:9123
+//	    labels:
+//	      room: office
+//	    baseline:
+//	      on: true
+//	      brightness: 20
+//	      temperature: 4200
+//	    maintenance: false
+//
+// The address may be any target accepted by the handler, such as a hostname,
+// host:port pair, or URL. If a baseline is configured, the keylight_light_drift
+// metric reports whether each of the target's lights differs from any of the
+// baseline settings which are specified. A target in maintenance is reported
+// as down with the label maintenance="1" without being fetched, so that alerts
+// for the target may be suppressed using relabeling.
+//
+// The same YAML may also define modules, one of which is selected by a scrape
+// using the module query parameter, as in the blackbox_exporter:
+//
+//	modules:
+//	  basic:
+//	    collect: [device, on]
+//	    labels:
+//	      detail: basic
+//	    timeout: 2s
+//
+// A module gathers only the metrics of the collectors it lists, as if each was
+// selected by a collect[] query parameter, or all metrics if it lists none. Its
+// labels are attached to every series, and those specified by the request take
+// precedence. If a timeout is configured, it replaces the handler's timeout.
+type NamedTargets struct {
+	mu      sync.RWMutex
+	targets map[string]namedTarget
+	modules map[string]module
+}
+
+// A namedTarget is the configuration for a single named target.
+type namedTarget struct {
+	Address     string            `yaml:"address"`
+	Labels      prometheus.Labels `yaml:"labels"`
+	Baseline    *lightBaseline    `yaml:"baseline"`
+	Maintenance bool              `yaml:"maintenance"`
+}
+
+// A module is the configuration for a single module.
+type module struct {
+	Collect []string          `yaml:"collect"`
+	Labels  prometheus.Labels `yaml:"labels"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+// A lightBaseline is the expected state of each light on a named target. Nil
+// fields are not compared.
+type lightBaseline struct {
+	On          *bool `yaml:"on"`
+	Brightness  *int  `yaml:"brightness"`
+	Temperature *int  `yaml:"temperature"`
+}
+
+// drifted reports whether any of the settings of l differ from b.
+func (b *lightBaseline) drifted(l *keylight.Light) bool {
+	switch {
+	case b.On != nil && *b.On != l.On:
+		return true
+	case b.Brightness != nil && *b.Brightness != l.Brightness:
+		return true
+	case b.Temperature != nil && *b.Temperature != l.Temperature:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewNamedTargets creates an empty NamedTargets. Use Load to configure its
+// targets.
+func NewNamedTargets() *NamedTargets {
+	return &NamedTargets{
+		targets: make(map[string]namedTarget),
+		modules: make(map[string]module),
+	}
+}
+
+// Load parses the YAML configuration from r and replaces all of the named
+// targets and modules with those it specifies. If the configuration is
+// invalid, Load returns an error and the existing targets and modules are
+// retained.
+func (nt *NamedTargets) Load(r io.Reader) error {
+	var cfg struct {
+		Targets map[string]namedTarget `yaml:"targets"`
+		Modules map[string]module      `yaml:"modules"`
+	}
+
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		// An empty configuration specifies no targets.
+		return fmt.Errorf("failed to parse named targets: %v", err)
+	}
+
+	for name, t := range cfg.Targets {
+		if err := t.check(name); err != nil {
+			return err
+		}
+	}
+
+	for name, m := range cfg.Modules {
+		if err := m.check(name); err != nil {
+			return err
+		}
+	}
+
+	targets := cfg.Targets
+	if targets == nil {
+		targets = make(map[string]namedTarget)
+	}
+
+	modules := cfg.Modules
+	if modules == nil {
+		modules = make(map[string]module)
+	}
+
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+
+	nt.targets = targets
+	nt.modules = modules
+	return nil
+}
+
+// errUnknownTarget is returned by resolve when a target name is not
+// configured.
+var errUnknownTarget = errors.New("unknown target name")
+
+// resolve resolves the comma-separated target names in s to a sorted list of
+// unique device addresses, as normalized by buildAddr using port, and the
+// target configured for each address.
+func (nt *NamedTargets) resolve(s, port string) ([]string, map[string]namedTarget, error) {
+	var (
+		addrs   []string
+		targets = make(map[string]namedTarget)
+	)
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, nil, errors.New("empty target")
+		}
+
+		t, ok := nt.lookup(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %q", errUnknownTarget, name)
+		}
+
+		addr, err := buildAddr(t.Address, port)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, ok := targets[addr]; ok {
+			continue
+		}
+		targets[addr] = t
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+	return addrs, targets, nil
+}
+
+// addrs returns the sorted, unique addresses of all of the named targets which
+// are not in maintenance, as normalized by buildAddr using port.
+func (nt *NamedTargets) addrs(port string) []string {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+
+	seen := make(map[string]struct{}, len(nt.targets))
+	addrs := make([]string, 0, len(nt.targets))
+	for _, t := range nt.targets {
+		if t.Maintenance {
+			continue
+		}
+
+		addr, err := buildAddr(t.Address, port)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+	return addrs
+}
+
+// names returns the sorted names of all of the named targets.
+func (nt *NamedTargets) names() []string {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+
+	names := make([]string, 0, len(nt.targets))
+	for name := range nt.targets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the configuration for the target named name, if any.
+func (nt *NamedTargets) lookup(name string) (namedTarget, bool) {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+
+	t, ok := nt.targets[name]
+	return t, ok
+}
+
+// module returns the configuration for the module named name, if any.
+func (nt *NamedTargets) module(name string) (module, bool) {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+
+	m, ok := nt.modules[name]
+	return m, ok
+}
+
+// check verifies that the target named name is well formed.
+func (t *namedTarget) check(name string) error {
+	if name == "" || strings.Contains(name, ",") {
+		return fmt.Errorf("invalid target name %q", name)
+	}
+	if t.Address == "" {
+		return fmt.Errorf("missing address for target %q", name)
+	}
+	if _, err := buildAddr(t.Address, keylightPort); err != nil {
+		return fmt.Errorf("invalid address for target %q: %v", name, err)
+	}
+
+	for k := range t.Labels {
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid label name %q for target %q", k, name)
+		}
+	}
+
+	if b := t.Baseline; b != nil {
+		if b.Brightness != nil && (*b.Brightness < 3 || *b.Brightness > 100) {
+			return fmt.Errorf("invalid baseline brightness %d for target %q: must be between 3 and 100",
+				*b.Brightness, name)
+		}
+		if b.Temperature != nil && (*b.Temperature < 2900 || *b.Temperature > 7000) {
+			return fmt.Errorf("invalid baseline temperature %d for target %q: must be between 2900 and 7000",
+				*b.Temperature, name)
+		}
+	}
+
+	return nil
+}
+
+// check verifies that the module named name is well formed.
+func (m *module) check(name string) error {
+	if name == "" {
+		return errors.New("empty module name")
+	}
+	if _, err := excludeCollectors(m.Collect); err != nil {
+		return fmt.Errorf("invalid collectors for module %q: %v", name, err)
+	}
+
+	for k := range m.Labels {
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid label name %q for module %q", k, name)
+		}
+	}
+
+	if m.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %s for module %q", m.Timeout, name)
+	}
+
+	return nil
+}
+
+// exclude returns the set of device metrics which are excluded by the
+// collectors of m, or nil if m gathers all metrics.
+func (m *module) exclude() map[string]struct{} {
+	// The collectors were validated when the module was loaded.
+	exclude, _ := excludeCollectors(m.Collect)
+	return exclude
+}
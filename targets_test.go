@@ -0,0 +1,437 @@
+package keylightexporter_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerNamedTargets(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader(`
+targets:
+  office-light:
+    address: foo
+    labels:
+      room: office
+  desk-light:
+    address: https://bar:9124
+`)); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetched = append(fetched, addr)
+
+			return testData(), nil
+		},
+	},
+		keylightexporter.WithNamedTargets(nt),
+		keylightexporter.WithExternalLabels(prometheus.Labels{"exporter": "home"}),
+	)
+
+	tests := []struct {
+		name, query string
+		code        int
+		fetched     []string
+		series      string
+	}{
+		{
+			name:    "labels",
+			query:   "?target=office-light&label_room=kitchen",
+			code:    http.StatusOK,
+			fetched: []string{"http://foo:9123"},
+			series:  `keylight_light_on{exporter="home",light="light0",name="test",room="office",serial="1111"} 1`,
+		},
+		{
+			name:    "no labels",
+			query:   "?target=desk-light",
+			code:    http.StatusOK,
+			fetched: []string{"https://bar:9124"},
+			series:  `keylight_light_on{exporter="home",light="light0",name="test",serial="1111"} 1`,
+		},
+		{
+			name:    "probe path",
+			query:   "probe/office-light",
+			code:    http.StatusOK,
+			fetched: []string{"http://foo:9123"},
+			series:  `keylight_light_on{exporter="home",light="light0",name="test",room="office",serial="1111"} 1`,
+		},
+		{
+			name:    "multiple",
+			query:   "?target=office-light,desk-light,office-light",
+			code:    http.StatusOK,
+			fetched: []string{"http://foo:9123", "https://bar:9124"},
+		},
+		{
+			name:  "address",
+			query: "?target=foo",
+			code:  http.StatusNotFound,
+		},
+		{
+			name:  "unknown",
+			query: "?target=office-light,garage-light",
+			code:  http.StatusNotFound,
+		},
+		{
+			name:  "empty",
+			query: "?target=office-light,,desk-light",
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			fetched = nil
+			mu.Unlock()
+
+			res, err := http.Get(srv.URL + "/" + tt.query)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+
+			if tt.code != http.StatusOK {
+				_ = res.Body.Close()
+				if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+					t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			b := testBody(t, res)
+
+			// Devices may be fetched concurrently.
+			mu.Lock()
+			got := fetched
+			mu.Unlock()
+			sort.Strings(got)
+
+			if diff := cmp.Diff(tt.fetched, got); diff != "" {
+				t.Fatalf("unexpected devices fetched (-want +got):\n%s", diff)
+			}
+
+			if tt.series != "" && !bytes.Contains(b, []byte(tt.series+"\n")) {
+				t.Fatalf("series with target labels was not found: %s", tt.series)
+			}
+		})
+	}
+}
+
+func TestHandlerNamedTargetsDrift(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader(`
+targets:
+  matching:
+    address: foo
+    baseline:
+      on: true
+      brightness: 20
+      temperature: 4200
+  drifting:
+    address: bar
+    baseline:
+      brightness: 50
+  partial:
+    address: baz
+    baseline:
+      temperature: 4200
+  none:
+    address: qux
+`)); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithNamedTargets(nt))
+
+	tests := []struct {
+		name, target string
+		drift        []string
+	}{
+		{
+			// light1 is off, so it differs from the baseline.
+			name:   "matching",
+			target: "matching",
+			drift: []string{
+				`keylight_light_drift{light="light0",name="test",serial="1111"} 0`,
+				`keylight_light_drift{light="light1",name="test",serial="1111"} 1`,
+			},
+		},
+		{
+			name:   "drifting",
+			target: "drifting",
+			drift: []string{
+				`keylight_light_drift{light="light0",name="test",serial="1111"} 1`,
+				`keylight_light_drift{light="light1",name="test",serial="1111"} 1`,
+			},
+		},
+		{
+			// Only the temperature is compared.
+			name:   "partial",
+			target: "partial",
+			drift: []string{
+				`keylight_light_drift{light="light0",name="test",serial="1111"} 0`,
+				`keylight_light_drift{light="light1",name="test",serial="1111"} 1`,
+			},
+		},
+		{
+			name:   "no baseline",
+			target: "none",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBody(t, testGet(t, srv, tt.target))
+
+			var got []string
+			for _, l := range strings.Split(string(b), "\n") {
+				if strings.HasPrefix(l, "keylight_light_drift{") {
+					got = append(got, l)
+				}
+			}
+
+			if diff := cmp.Diff(tt.drift, got); diff != "" {
+				t.Fatalf("unexpected drift series (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerNamedTargetsMaintenance(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader(`
+targets:
+  office:
+    address: foo
+    labels:
+      room: office
+    maintenance: true
+  desk:
+    address: bar
+`)); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetched = append(fetched, addr)
+
+			return testData(), nil
+		},
+	}, keylightexporter.WithNamedTargets(nt))
+
+	b := testBody(t, testGet(t, srv, "office,desk"))
+
+	// The target in maintenance is reported as down without being fetched,
+	// while the other target is scraped as usual.
+	for _, s := range []string{
+		`keylight_up{maintenance="1",room="office",serial="",target="http://foo:9123"} 0`,
+		`keylight_up{serial="1111",target="http://bar:9123"} 1`,
+	} {
+		if !bytes.Contains(b, []byte(s+"\n")) {
+			t.Fatalf("series was not found: %s\n%s", s, b)
+		}
+	}
+
+	if bytes.Contains(b, []byte(`keylight_scrape_consecutive_failures{target="http://foo:9123"}`)) {
+		t.Fatal("target in maintenance was counted as a failure")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff([]string{"http://bar:9123"}, fetched); diff != "" {
+		t.Fatalf("unexpected fetched devices (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerNamedTargetsModules(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader(`
+targets:
+  office:
+    address: foo
+modules:
+  basic:
+    collect: [on]
+    labels:
+      detail: basic
+    timeout: 2s
+  full:
+    labels:
+      detail: full
+`)); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithNamedTargets(nt))
+
+	tests := []struct {
+		name, query string
+		code        int
+		want, not   []string
+	}{
+		{
+			name:  "basic",
+			query: "?target=office&module=basic",
+			code:  http.StatusOK,
+			want: []string{
+				`keylight_light_on{detail="basic",light="light0",name="test",serial="1111"} 1`,
+				`keylight_exporter_scrape_timeout_seconds{detail="basic"} 2`,
+			},
+			not: []string{"keylight_light_brightness_percent", "keylight_info"},
+		},
+		{
+			name:  "full",
+			query: "?target=office&module=full",
+			code:  http.StatusOK,
+			want: []string{
+				`keylight_light_on{detail="full",light="light0",name="test",serial="1111"} 1`,
+				`keylight_light_brightness_percent{detail="full",light="light0",name="test",serial="1111"} 20`,
+			},
+		},
+		{
+			name:  "request overrides",
+			query: "?target=office&module=basic&collect[]=brightness&label_detail=custom",
+			code:  http.StatusOK,
+			want: []string{
+				`keylight_light_brightness_percent{detail="custom",light="light0",name="test",serial="1111"} 20`,
+			},
+			not: []string{"keylight_light_on"},
+		},
+		{
+			name:  "unknown",
+			query: "?target=office&module=extra",
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/" + tt.query)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+
+			if tt.code != http.StatusOK {
+				_ = res.Body.Close()
+				if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+					t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			b := testBody(t, res)
+			for _, s := range tt.want {
+				if !bytes.Contains(b, []byte(s+"\n")) {
+					t.Fatalf("series was not found: %s\n%s", s, b)
+				}
+			}
+			for _, s := range tt.not {
+				if bytes.Contains(b, []byte(s+"{")) {
+					t.Fatalf("series %s should not have been gathered:\n%s", s, b)
+				}
+			}
+		})
+	}
+}
+
+func TestNamedTargetsLoad(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithNamedTargets(nt))
+
+	code := func(name string) int {
+		t.Helper()
+
+		res, err := http.Get(srv.URL + "/?target=" + name)
+		if err != nil {
+			t.Fatalf("failed to perform HTTP request: %v", err)
+		}
+		_ = res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	check := func(want map[string]int) {
+		t.Helper()
+
+		got := make(map[string]int, len(want))
+		for name := range want {
+			got[name] = code(name)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected HTTP status codes (-want +got):\n%s", diff)
+		}
+	}
+
+	load := func(s string, ok bool) {
+		t.Helper()
+
+		err := nt.Load(strings.NewReader(s))
+		if ok && err != nil {
+			t.Fatalf("failed to load named targets: %v", err)
+		}
+		if !ok && err == nil {
+			t.Fatal("expected an error, but none occurred")
+		}
+	}
+
+	// Nothing is configured initially or by an empty configuration.
+	check(map[string]int{"office": http.StatusNotFound})
+	load("", true)
+	check(map[string]int{"office": http.StatusNotFound})
+
+	load("targets:\n  office:\n    address: foo\n", true)
+	check(map[string]int{"office": http.StatusOK, "desk": http.StatusNotFound})
+
+	// Reloading replaces all of the targets.
+	load("targets:\n  desk:\n    address: bar\n", true)
+	check(map[string]int{"office": http.StatusNotFound, "desk": http.StatusOK})
+
+	// Invalid configurations are rejected and the previous targets retained.
+	for _, s := range []string{
+		"targets: [",
+		"target:\n  office:\n    address: foo\n",
+		"targets:\n  office:\n    addr: foo\n",
+		"targets:\n  office:\n    labels:\n      room: office\n",
+		"targets:\n  office:\n    address: sftp://foo\n",
+		"targets:\n  office:\n    address: foo:bar\n",
+		"targets:\n  office,desk:\n    address: foo\n",
+		"targets:\n  office:\n    address: foo\n    labels:\n      __name__: office\n",
+		"targets:\n  office:\n    address: foo\n    baseline:\n      brightness: 101\n",
+		"targets:\n  office:\n    address: foo\n    baseline:\n      temperature: 2000\n",
+		"targets:\n  office:\n    address: foo\n    baseline:\n      color: red\n",
+		"modules:\n  basic:\n    collect: [colour]\n",
+		"modules:\n  basic:\n    labels:\n      __name__: basic\n",
+		"modules:\n  basic:\n    timeout: soon\n",
+		"modules:\n  basic:\n    timeout: -1s\n",
+	} {
+		load(s, false)
+	}
+	check(map[string]int{"office": http.StatusNotFound, "desk": http.StatusOK})
+}
@@ -0,0 +1,56 @@
+package keylightexporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// validatePath is the HTTP path which validates and normalizes a target
+// without contacting any devices.
+const validatePath = "/validate"
+
+// A validation is the result of validating a target, served by the validation
+// endpoint.
+type validation struct {
+	Target    string   `json:"target"`
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// serveValidate resolves the target of r to the device addresses which would
+// be scraped, and serves them as JSON, or the reason the target is invalid
+// with HTTP 400. Devices are never fetched.
+func (h *handler) serveValidate(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+
+	var (
+		addrs []string
+		err   error
+	)
+	switch {
+	case target == "":
+		err = errMissingTarget
+	case h.names != nil:
+		addrs, _, err = h.names.resolve(target, h.port)
+	default:
+		addrs, err = buildAddrs(target, h.port)
+	}
+
+	v := validation{Target: target, Addresses: addrs}
+	code := http.StatusOK
+	if err != nil {
+		if !errors.Is(err, errMissingTarget) && !errors.Is(err, errUnknownTarget) {
+			err = fmt.Errorf("malformed target parameter: %v", err)
+		}
+
+		v = validation{Target: target, Error: err.Error()}
+		code = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,156 @@
+package keylightexporter_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	keylightexporter "github.com/mdlayher/keylight_exporter"
+)
+
+func TestHandlerValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		addrs  []string
+		ok     bool
+	}{
+		{name: "no target"},
+		{name: "bad scheme", target: "sftp://foo"},
+		{name: "bad host", target: "http://"},
+		{name: "bad port", target: "foo:bar"},
+		{name: "bad port range", target: "foo:70000"},
+		{name: "bad path", target: "http://foo/bar"},
+		{name: "bad empty target", target: "foo,,bar"},
+		{name: "bad second target", target: "foo,sftp://bar"},
+		{name: "bad IPv6 address", target: "fe80::1::2"},
+		{name: "bad bracketed IPv6 address", target: "[fe80::zz]:9123"},
+		{
+			name:   "OK host",
+			target: "foo",
+			addrs:  []string{"http://foo:9123"},
+			ok:     true,
+		},
+		{
+			name:   "OK host:port",
+			target: "foo:9123",
+			addrs:  []string{"http://foo:9123"},
+			ok:     true,
+		},
+		{
+			name:   "OK HTTP trailing slash",
+			target: "http://foo:9123/",
+			addrs:  []string{"http://foo:9123"},
+			ok:     true,
+		},
+		{
+			name:   "OK HTTPS",
+			target: "https://foo:9123",
+			addrs:  []string{"https://foo:9123"},
+			ok:     true,
+		},
+		{
+			name:   "OK multiple",
+			target: "foo,bar:8080,foo:9123",
+			addrs:  []string{"http://bar:8080", "http://foo:9123"},
+			ok:     true,
+		},
+		{
+			name:   "OK IPv6 bare",
+			target: "fe80::1",
+			addrs:  []string{"http://[fe80::1]:9123"},
+			ok:     true,
+		},
+		{
+			name:   "OK IPv6 zone",
+			target: "fe80::1%eth0",
+			addrs:  []string{"http://[fe80::1%25eth0]:9123"},
+			ok:     true,
+		},
+		{
+			name:   "OK IPv6 non-canonical",
+			target: "[FE80:0:0::0001%eth0]:9123",
+			addrs:  []string{"http://[fe80::1%25eth0]:9123"},
+			ok:     true,
+		},
+	}
+
+	// Validation never contacts a device.
+	srv := testServer(t, testFetcher{
+		fetch: func(_ context.Context, addr string) (*keylightexporter.Data, error) {
+			panicf("unexpected fetch of %q", addr)
+			return nil, nil
+		},
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := srv.Client().Get(srv.URL + "/validate?target=" + url.QueryEscape(tt.target))
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			code := http.StatusBadRequest
+			if tt.ok {
+				code = http.StatusOK
+			}
+			if diff := cmp.Diff(code, res.StatusCode); diff != "" {
+				t.Fatalf("unexpected HTTP status code (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("application/json", res.Header.Get("Content-Type")); diff != "" {
+				t.Fatalf("unexpected Content-Type (-want +got):\n%s", diff)
+			}
+
+			var v struct {
+				Target    string   `json:"target"`
+				Addresses []string `json:"addresses"`
+				Error     string   `json:"error"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+				t.Fatalf("failed to decode JSON: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.target, v.Target); diff != "" {
+				t.Fatalf("unexpected target (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.addrs, v.Addresses); diff != "" {
+				t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+			}
+			if tt.ok != (v.Error == "") {
+				t.Fatalf("unexpected error: %q", v.Error)
+			}
+		})
+	}
+}
+
+func TestHandlerValidateNamedTargets(t *testing.T) {
+	nt := keylightexporter.NewNamedTargets()
+	if err := nt.Load(strings.NewReader("targets:\n  office:\n    address: foo\n")); err != nil {
+		t.Fatalf("failed to load named targets: %v", err)
+	}
+
+	srv := testServer(t, testDataFetcher(), keylightexporter.WithNamedTargets(nt))
+
+	for _, tt := range []struct {
+		target string
+		code   int
+	}{
+		{target: "office", code: http.StatusOK},
+		{target: "kitchen", code: http.StatusBadRequest},
+	} {
+		res, err := srv.Client().Get(srv.URL + "/validate?target=" + tt.target)
+		if err != nil {
+			t.Fatalf("failed to perform HTTP request: %v", err)
+		}
+		_ = res.Body.Close()
+
+		if diff := cmp.Diff(tt.code, res.StatusCode); diff != "" {
+			t.Fatalf("unexpected HTTP status code for %q (-want +got):\n%s", tt.target, diff)
+		}
+	}
+}